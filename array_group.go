@@ -0,0 +1,88 @@
+package sorted_array
+
+import (
+	"errors"
+	errors2 "github.com/pkg/errors"
+)
+
+// GroupTx makes writes of several arrays atomic
+// the storage backend must be able to undo writes made after Begin
+type GroupTx interface {
+	Begin() error
+	Commit() error
+	Rollback() error
+}
+
+// ArrayGroup owns several sorted arrays living in the same storage backend
+// (e.g. many term arrays within one SQLite tx) and flushes them all or none
+type ArrayGroup struct {
+	maxChunkSize   uint32
+	tx             GroupTx // nil means the backend can't fail mid-way (in-memory)
+	storageFactory func(key []byte) ChunkStorage
+	arrays         map[string]*SortedArray
+	keys           []string // keep the order arrays were added in, so flushes are deterministic
+}
+
+// Get returns the array for the key, it is created on the first call
+func (g *ArrayGroup) Get(key []byte) *SortedArray {
+	arr, ok := g.arrays[string(key)]
+	if !ok {
+		arr = NewSortedArray(g.maxChunkSize, g.storageFactory(key))
+		g.arrays[string(key)] = arr
+		g.keys = append(g.keys, string(key))
+	}
+	return arr
+}
+
+// Flush writes pending changes of all arrays in the group
+// if any array fails, all writes are rolled back and all arrays keep their pending changes
+func (g *ArrayGroup) Flush() error {
+	if g.tx != nil {
+		err := g.tx.Begin()
+		if err != nil {
+			return errors2.Wrap(err, "unable to begin group flush")
+		}
+	}
+	for _, key := range g.keys {
+		err := g.arrays[key].writePending()
+		if err == nil {
+			continue
+		}
+		err = errors2.Wrapf(err, "unable to flush array %s", key)
+		if g.tx != nil {
+			rollbackErr := g.tx.Rollback()
+			if rollbackErr != nil {
+				err = errors.Join(err, errors2.Wrap(rollbackErr, "rollback failed"))
+			}
+		}
+		for _, key := range g.keys {
+			g.arrays[key].forgetPersisted() // the storage no longer has what arrays wrote (or may not have it)
+		}
+		return err
+	}
+	if g.tx != nil {
+		err := g.tx.Commit()
+		if err != nil {
+			return errors2.Wrap(err, "unable to commit group flush")
+		}
+	}
+	for _, key := range g.keys {
+		g.arrays[key].clearPending()
+	}
+	return nil
+}
+
+// reset forgets all arrays, they are loaded again on the next Get
+func (g *ArrayGroup) reset() {
+	g.arrays = make(map[string]*SortedArray)
+	g.keys = nil
+}
+
+func NewArrayGroup(maxChunkSize uint32, tx GroupTx, storageFactory func(key []byte) ChunkStorage) *ArrayGroup {
+	return &ArrayGroup{
+		maxChunkSize:   maxChunkSize,
+		tx:             tx,
+		storageFactory: storageFactory,
+		arrays:         make(map[string]*SortedArray),
+	}
+}
@@ -0,0 +1,114 @@
+package sorted_array
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+// failingStorage imitates a storage that breaks on writes
+type failingStorage struct {
+	ChunkStorage
+	fail bool
+}
+
+func (s *failingStorage) Save(chunks map[uint32]*Chunk) error {
+	if s.fail {
+		return fmt.Errorf("disk is full")
+	}
+	return s.ChunkStorage.Save(chunks)
+}
+
+func TestArrayGroupFlush(t *testing.T) {
+	db := MakeSqliteDb()
+	defer db.Close()
+
+	tx, err := db.Begin()
+	require.NoError(t, err)
+	group := NewArrayGroup(2, NewSqliteSavepoint(tx, "array_group"), func(key []byte) ChunkStorage {
+		return NewSqliteTxSortedArrayStorage(tx, key)
+	})
+	require.NoError(t, group.Get([]byte("term1")).Add([]uint32{1, 2, 3}))
+	require.NoError(t, group.Get([]byte("term2")).Add([]uint32{4, 5, 6}))
+	require.NoError(t, group.Flush())
+	require.NoError(t, tx.Commit())
+
+	tx, err = db.Begin()
+	require.NoError(t, err)
+	require.EqualValues(t, []uint32{1, 2, 3}, NewSortedArray(2, NewSqliteTxSortedArrayStorage(tx, []byte("term1"))).ToSlice())
+	require.EqualValues(t, []uint32{4, 5, 6}, NewSortedArray(2, NewSqliteTxSortedArrayStorage(tx, []byte("term2"))).ToSlice())
+	require.NoError(t, tx.Commit())
+}
+
+func TestArrayGroupFlushAllOrNone(t *testing.T) {
+	db := MakeSqliteDb()
+	defer db.Close()
+
+	tx, err := db.Begin()
+	require.NoError(t, err)
+	broken := &failingStorage{NewSqliteTxSortedArrayStorage(tx, []byte("term2")), true}
+	group := NewArrayGroup(2, NewSqliteSavepoint(tx, "array_group"), func(key []byte) ChunkStorage {
+		if string(key) == "term2" {
+			return broken
+		}
+		return NewSqliteTxSortedArrayStorage(tx, key)
+	})
+	require.NoError(t, group.Get([]byte("term1")).Add([]uint32{1, 2, 3}))
+	require.NoError(t, group.Get([]byte("term2")).Add([]uint32{4, 5, 6}))
+	require.Error(t, group.Flush())
+
+	// nothing is written, even for the first array
+	require.Empty(t, NewSortedArray(2, NewSqliteTxSortedArrayStorage(tx, []byte("term1"))).ToSlice())
+
+	// pending changes survive the failure, so the flush can be retried
+	broken.fail = false
+	require.NoError(t, group.Flush())
+	require.NoError(t, tx.Commit())
+
+	tx, err = db.Begin()
+	require.NoError(t, err)
+	require.EqualValues(t, []uint32{1, 2, 3}, NewSortedArray(2, NewSqliteTxSortedArrayStorage(tx, []byte("term1"))).ToSlice())
+	require.EqualValues(t, []uint32{4, 5, 6}, NewSortedArray(2, NewSqliteTxSortedArrayStorage(tx, []byte("term2"))).ToSlice())
+	require.NoError(t, tx.Commit())
+}
+
+// failingRollback undoes the writes but still reports an error, like a driver losing the connection afterwards
+type failingRollback struct {
+	GroupTx
+}
+
+func (tx *failingRollback) Rollback() error {
+	_ = tx.GroupTx.Rollback()
+	return fmt.Errorf("connection lost")
+}
+
+func TestArrayGroupFlushFailedRollback(t *testing.T) {
+	db := MakeSqliteDb()
+	defer db.Close()
+
+	tx, err := db.Begin()
+	require.NoError(t, err)
+	broken := &failingStorage{NewSqliteTxSortedArrayStorage(tx, []byte("term2")), true}
+	group := NewArrayGroup(2, &failingRollback{NewSqliteSavepoint(tx, "array_group")}, func(key []byte) ChunkStorage {
+		if string(key) == "term2" {
+			return broken
+		}
+		return NewSqliteTxSortedArrayStorage(tx, key)
+	})
+	require.NoError(t, group.Get([]byte("term1")).Add([]uint32{1, 2, 3}))
+	require.NoError(t, group.Get([]byte("term2")).Add([]uint32{4, 5, 6}))
+	err = group.Flush()
+	require.ErrorContains(t, err, "disk is full")
+	require.ErrorContains(t, err, "connection lost")
+
+	// arrays don't believe the abandoned writes were persisted
+	broken.fail = false
+	require.NoError(t, group.Flush())
+	require.NoError(t, tx.Commit())
+
+	tx, err = db.Begin()
+	require.NoError(t, err)
+	require.EqualValues(t, []uint32{1, 2, 3}, NewSortedArray(2, NewSqliteTxSortedArrayStorage(tx, []byte("term1"))).ToSlice())
+	require.EqualValues(t, []uint32{4, 5, 6}, NewSortedArray(2, NewSqliteTxSortedArrayStorage(tx, []byte("term2"))).ToSlice())
+	require.NoError(t, tx.Commit())
+}
@@ -0,0 +1,214 @@
+package sorted_array
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"golang.org/x/exp/maps"
+	"hash/crc32"
+)
+
+// BlobStorage is a raw key-value storage for serialized chunks and meta of one array
+// keys are local to the array, the storage is free to prefix them
+// it allows decorating the bytes on their way to the disk (encryption etc.)
+type BlobStorage interface {
+	// ReadBlobs returns only found keys, missing keys are omitted
+	ReadBlobs(keys []string) (map[string][]byte, error)
+	SaveBlobs(blobs map[string][]byte) error
+	RemoveBlobs(keys []string) error
+}
+
+const metaBlobKey = ""
+
+// errCorruptedBlob is returned by BlobStorage decorators which detect damaged blobs (e.g. encryption),
+// BlobChunkStorage reports it as ErrCorrupted of the chunk or meta
+type errCorruptedBlob struct {
+	key    string
+	reason string
+}
+
+func (e *errCorruptedBlob) Error() string {
+	return fmt.Sprintf("blob %q is corrupted: %s", e.key, e.reason)
+}
+
+// corrupted converts errCorruptedBlob to ErrCorrupted, chunkIds are ids of the read keys (nil for meta)
+func corrupted(err error, keys []string, chunkIds []uint32) error {
+	var blobErr *errCorruptedBlob
+	if !errors.As(err, &blobErr) {
+		return err
+	}
+	for i, key := range keys {
+		if key == blobErr.key && chunkIds != nil {
+			return &ErrCorrupted{ChunkId: chunkIds[i], Reason: blobErr.reason}
+		}
+	}
+	return &ErrCorrupted{Meta: true, Reason: blobErr.reason}
+}
+
+func chunkBlobKey(id uint32) string    { return fmt.Sprintf("_%d", id) }
+func metaPageBlobKey(id uint32) string { return fmt.Sprintf("_m%d", id) }
+
+// BlobChunkStorage implements ChunkStorage on top of any BlobStorage
+// it does serialization of chunks and meta
+// meta is stored in pages (see meta_pages.go) and loaded lazily
+type BlobChunkStorage struct {
+	blobs        BlobStorage
+	metaPageSize int
+}
+
+func (s *BlobChunkStorage) Read(chunkIds []uint32) (map[uint32]*Chunk, error) {
+	keys := make([]string, 0, len(chunkIds))
+	for _, id := range chunkIds {
+		keys = append(keys, chunkBlobKey(id))
+	}
+	blobs, err := s.blobs.ReadBlobs(keys)
+	if err != nil {
+		return nil, errors.Wrap(corrupted(err, keys, chunkIds), "Read:")
+	}
+	ret := make(map[uint32]*Chunk, len(blobs))
+	for i, id := range chunkIds {
+		serialized, ok := blobs[keys[i]]
+		if !ok {
+			continue
+		}
+		ret[id], err = UnserializeChunk(serialized)
+		var corrupted *ErrCorrupted
+		if errors.As(err, &corrupted) {
+			corrupted.ChunkId = id
+			return nil, corrupted
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+func (s *BlobChunkStorage) Save(chunks map[uint32]*Chunk) error {
+	blobs := make(map[string][]byte, len(chunks))
+	for id, chunk := range chunks {
+		serialized, err := chunk.Serialize()
+		if err != nil {
+			return err
+		}
+		blobs[chunkBlobKey(id)] = serialized
+	}
+	return errors.Wrap(s.blobs.SaveBlobs(blobs), "Save:")
+}
+
+func (s *BlobChunkStorage) Remove(chunkIds []uint32) error {
+	keys := make([]string, 0, len(chunkIds))
+	for _, id := range chunkIds {
+		keys = append(keys, chunkBlobKey(id))
+	}
+	return errors.Wrap(s.blobs.RemoveBlobs(keys), "Remove:")
+}
+
+// ReadMeta only reads the summary of meta pages, pages are loaded when needed
+func (s *BlobChunkStorage) ReadMeta() (*Meta, error) {
+	blobs, err := s.blobs.ReadBlobs([]string{metaBlobKey})
+	if err != nil {
+		return nil, errors.Wrap(corrupted(err, nil, nil), "ReadMeta:")
+	}
+	var meta *Meta
+	serialized, ok := blobs[metaBlobKey]
+	if !ok {
+		meta = NewMeta()
+		meta.pages = []*metaPage{{id: meta.takeNextPageId(), from: 0, loaded: true}}
+	} else if frameKind(serialized) == frameKindMetaSummary {
+		meta, err = unserializeSummary(serialized)
+		if err == nil {
+			meta.summaryCrc = crc32.Checksum(serialized, crcTable)
+		}
+	} else {
+		meta, err = UnserializeMeta(serialized) // a flat meta written before paging
+	}
+	if err != nil {
+		return nil, err
+	}
+	meta.pageLoader = s.readMetaPages
+	return meta, nil
+}
+
+// SaveMeta writes the summary and pages of the meta that changed since they were read or written
+// dropped pages are removed once the new summary is saved, so a failed save leaves the old summary readable
+func (s *BlobChunkStorage) SaveMeta(meta *Meta) error {
+	changes, err := meta.changes(s.metaPageSize)
+	if err != nil {
+		return err
+	}
+	blobs := make(map[string][]byte, len(changes.pages)+1)
+	for id, blob := range changes.pages {
+		blobs[metaPageBlobKey(id)] = blob
+	}
+	if changes.summary != nil {
+		blobs[metaBlobKey] = changes.summary
+	}
+	err = s.blobs.SaveBlobs(blobs)
+	if err != nil {
+		return errors.Wrap(err, "SaveMeta:")
+	}
+	droppedKeys := make([]string, 0, len(changes.dropped))
+	for _, id := range changes.dropped {
+		droppedKeys = append(droppedKeys, metaPageBlobKey(id)) // new pages never reuse ids of dropped ones
+	}
+	err = s.blobs.RemoveBlobs(droppedKeys)
+	if err != nil {
+		return errors.Wrap(err, "SaveMeta:")
+	}
+	meta.persisted(changes)
+	return nil
+}
+
+func (s *BlobChunkStorage) readMetaPages(pageIds []uint32) (map[uint32][]byte, error) {
+	keys := make([]string, 0, len(pageIds))
+	for _, id := range pageIds {
+		keys = append(keys, metaPageBlobKey(id))
+	}
+	blobs, err := s.blobs.ReadBlobs(keys)
+	if err != nil {
+		return nil, errors.Wrap(corrupted(err, nil, nil), "ReadMeta:")
+	}
+	pages := make(map[uint32][]byte, len(blobs))
+	for i, id := range pageIds {
+		if blob, ok := blobs[keys[i]]; ok {
+			pages[id] = blob
+		}
+	}
+	return pages, nil
+}
+
+func NewBlobChunkStorage(blobs BlobStorage) *BlobChunkStorage {
+	return &BlobChunkStorage{blobs, defaultMetaPageSize}
+}
+
+// InMemoryBlobStorage keeps serialized blobs in a map (used for testing purposes)
+type InMemoryBlobStorage struct {
+	blobs map[string][]byte
+}
+
+func (s *InMemoryBlobStorage) ReadBlobs(keys []string) (map[string][]byte, error) {
+	ret := make(map[string][]byte, len(keys))
+	for _, key := range keys {
+		if blob, ok := s.blobs[key]; ok {
+			ret[key] = blob
+		}
+	}
+	return ret, nil
+}
+
+func (s *InMemoryBlobStorage) SaveBlobs(blobs map[string][]byte) error {
+	maps.Copy(s.blobs, blobs)
+	return nil
+}
+
+func (s *InMemoryBlobStorage) RemoveBlobs(keys []string) error {
+	for _, key := range keys {
+		delete(s.blobs, key)
+	}
+	return nil
+}
+
+func NewInMemoryBlobStorage() *InMemoryBlobStorage {
+	return &InMemoryBlobStorage{
+		blobs: make(map[string][]byte),
+	}
+}
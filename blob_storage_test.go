@@ -0,0 +1,56 @@
+package sorted_array
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestBlobChunkStorage(t *testing.T) {
+	storage := NewBlobChunkStorage(NewInMemoryBlobStorage())
+
+	// Read:
+	chunks, err := storage.Read([]uint32{1, 2})
+	require.NoError(t, err)
+	require.Len(t, chunks, 0) // missing ids are omitted
+
+	// Write:
+	chunks[1] = NewChunk([]uint32{100, 200})
+	chunks[2] = NewChunk([]uint32{300, 400})
+	require.NoError(t, storage.Save(chunks))
+
+	chunks2, err := storage.Read([]uint32{1, 2})
+	require.NoError(t, err)
+	require.EqualValues(t, chunks, chunks2)
+
+	// Remove:
+	require.NoError(t, storage.Remove([]uint32{1}))
+	chunks3, err := storage.Read([]uint32{1, 2})
+	require.NoError(t, err)
+	require.Len(t, chunks3, 1)
+	require.EqualValues(t, chunks[2], chunks3[2])
+
+	// Meta:
+	meta, err := storage.ReadMeta()
+	require.NoError(t, err)
+	require.Len(t, meta.chunks, 0)
+
+	meta.Add([]*ChunkMeta{{meta.TakeNextId(), 0, 2, 2}})
+	require.NoError(t, storage.SaveMeta(meta))
+	meta2, err := storage.ReadMeta()
+	require.NoError(t, err)
+	require.NoError(t, meta2.loadAll())
+	require.EqualValues(t, meta.chunks, meta2.chunks)
+	require.EqualValues(t, meta.nextId, meta2.nextId)
+}
+
+func TestBlobChunkStorageIntegration(t *testing.T) {
+	storage := NewBlobChunkStorage(NewInMemoryBlobStorage())
+
+	arr1 := NewSortedArray(2, storage)
+	require.NoError(t, arr1.Add([]uint32{10, 20, 30, 40, 50}))
+	require.NoError(t, arr1.Delete([]uint32{10, 30, 50}))
+	require.NoError(t, arr1.Flush())
+
+	arr2 := NewSortedArray(2, storage)
+	require.EqualValues(t, []uint32{20, 40}, arr2.ToSlice())
+}
@@ -2,30 +2,47 @@ package sorted_array
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/gob"
 	"fmt"
+	"github.com/ronanh/intcomp"
 	"golang.org/x/exp/slices"
+	"math"
+	"math/bits"
 )
 
 // Chunk represents an asc sorted array of numbers, grouped together for faster processing
 // the type chosen to be uint32 to contain unix timestamps in seconds
 // enough for general index purposes when there are not many events per second
+// Items are kept in one of the containers (array, bitmap, runs), see containerKind.
 type Chunk struct {
-	Items []uint32
+	kind   containerKind
+	items  []uint32 // array container
+	bitmap []uint64 // bitmap container, bit i of word w is base+64*w+i
+	base   uint32
+	runs   []run // run container
+	size   int
+	counts []uint32 // multiset chunks: the count of each item in asc order, nil for sets (see multiset.go)
+
+	valueWidth int    // key-value chunks: bytes per value, 0 if items have no values (see key_value.go)
+	values     []byte // key-value chunks: values of items in asc order
 }
 
 // Add insert new values to the sorted array with just one allocation
 // return the number of NEW elements added to the array
+// multiset chunks increment counts of existing items instead, key-value chunks add zero values
 func (c *Chunk) Add(items []uint32) (added int) {
-	// 1. Filter out duplicates
-	// 1.1 Remove duplicates from the list itself
-	uniqueItems := items[:0]
-	for _, item := range items {
-		if !slices.Contains(uniqueItems, item) {
-			uniqueItems = append(uniqueItems, item)
-		}
+	if c.counts != nil {
+		return c.addCounts(items)
 	}
-	items = uniqueItems
+	if c.valueWidth > 0 {
+		return c.putValues(items, nil)
+	}
+	// 1. Filter out duplicates
+	// 1.1 Remove duplicates from the list itself (a copy, the caller's slice is left as is)
+	items = slices.Clone(items)
+	slices.Sort(items)
+	items = slices.Compact(items)
 	// 1.2 Remove existing in the chunk
 	newItems := items[:0]
 	for _, item := range items {
@@ -34,17 +51,37 @@ func (c *Chunk) Add(items []uint32) (added int) {
 		}
 	}
 	items = newItems
+	if len(items) == 0 {
+		return
+	}
+	defer c.optimize()
+
+	// 2. bitmaps and runs are modified in place (a bitmap only within its span)
+	if c.kind == bitmapContainer {
+		for _, item := range items {
+			if !c.inSpan(item) {
+				c.setItems(c.ToSlice(), arrayContainer)
+				break
+			}
+		}
+	}
+	if c.kind != arrayContainer {
+		for _, item := range items {
+			c.insert(item)
+		}
+		return len(items)
+	}
 
-	// 2. allocate max possible at once
-	newItems = make([]uint32, len(c.Items)+len(items))
-	copy(newItems, c.Items)
+	// 3. allocate max possible at once
+	newItems = make([]uint32, len(c.items)+len(items))
+	copy(newItems, c.items)
 	var (
 		item uint32
 		pos  int
 	)
 
 	for _, item = range items {
-		pos, _ = slices.BinarySearch(newItems[:len(c.Items)+added], item)
+		pos, _ = slices.BinarySearch(newItems[:len(c.items)+added], item)
 		added++
 		if pos == len(newItems) { // edge-case: append at the end
 			newItems = append(newItems, item)
@@ -53,47 +90,210 @@ func (c *Chunk) Add(items []uint32) (added int) {
 		copy(newItems[pos+1:], newItems[pos:])
 		newItems[pos] = item
 	}
-	c.Items = newItems
+	c.items = newItems
+	c.size = len(newItems)
 	return
 }
 
+// Remove returns the number of removed items
+// multiset chunks decrement counts instead and drop items whose count reaches 0 (removed counts occurrences)
 func (c *Chunk) Remove(itemsToRemove []uint32) (removed int) {
+	if c.counts != nil {
+		return c.removeCounts(itemsToRemove, false)
+	}
+	if c.valueWidth > 0 {
+		return c.removeValues(itemsToRemove)
+	}
+	defer func() {
+		if removed > 0 {
+			c.optimize()
+		}
+	}()
+	if c.kind != arrayContainer {
+		for _, removeItem := range itemsToRemove {
+			if c.containerContains(removeItem) {
+				c.delete(removeItem)
+				removed++
+			}
+		}
+		return
+	}
 	// in-place removal
 	for _, removeItem := range itemsToRemove {
-		pos, exists := slices.BinarySearch(c.Items, removeItem)
+		pos, exists := slices.BinarySearch(c.items, removeItem)
 		if !exists {
 			continue
 		}
 		removed++
-		if pos != len(c.Items)-1 {
-			copy(c.Items[pos:], c.Items[pos+1:]) // shift
+		if pos != len(c.items)-1 {
+			copy(c.items[pos:], c.items[pos+1:]) // shift
 		}
-		c.Items = c.Items[:len(c.Items)-1] // reduce size
+		c.items = c.items[:len(c.items)-1] // reduce size
 	}
+	c.size = len(c.items)
 	return
 }
 
-func (c *Chunk) Contains(item uint32) bool { return contains(c.Items, item) }
+func (c *Chunk) Contains(item uint32) bool { return c.containerContains(item) }
 func (c *Chunk) GetInRange(from, to uint32) []uint32 {
 	if from > to {
 		panic("from > to")
 	}
-	retItems := make([]uint32, 0)
-	for _, item := range c.Items {
-		if item >= from && item <= to {
-			retItems = append(retItems, item)
+	return c.appendInRange(make([]uint32, 0), from, to)
+}
+
+// clone returns a deep copy of the chunk
+func (c *Chunk) clone() *Chunk {
+	c2 := *c
+	c2.items = slices.Clone(c.items)
+	c2.bitmap = slices.Clone(c.bitmap)
+	c2.runs = slices.Clone(c.runs)
+	c2.counts = slices.Clone(c.counts)
+	c2.values = slices.Clone(c.values)
+	return &c2
+}
+
+// ToSlice returns all items in asc order
+func (c *Chunk) ToSlice() []uint32 {
+	return c.appendInRange(make([]uint32, 0, c.size), 0, math.MaxUint32)
+}
+
+// Items returns a copy of all items in asc order
+//
+// Deprecated: Items replaces the exported field of chunks kept as a plain slice, use ToSlice.
+func (c *Chunk) Items() []uint32 { return c.ToSlice() }
+
+// Len returns the number of items in the chunk
+func (c *Chunk) Len() int { return c.size }
+
+// Min returns the smallest item, the chunk must not be empty
+func (c *Chunk) Min() uint32 {
+	switch c.kind {
+	case bitmapContainer:
+		for w, word := range c.bitmap {
+			if word != 0 {
+				return c.base + uint32(w)*64 + uint32(bits.TrailingZeros64(word))
+			}
 		}
+		panic("empty chunk")
+	case runContainer:
+		return c.runs[0].start
+	default:
+		return c.items[0]
 	}
-	return retItems
 }
+
+// Max returns the biggest item, the chunk must not be empty
+func (c *Chunk) Max() uint32 {
+	switch c.kind {
+	case bitmapContainer:
+		for w := len(c.bitmap) - 1; w >= 0; w-- {
+			if c.bitmap[w] != 0 {
+				return c.base + uint32(w)*64 + 63 - uint32(bits.LeadingZeros64(c.bitmap[w]))
+			}
+		}
+		panic("empty chunk")
+	case runContainer:
+		return c.runs[len(c.runs)-1].last
+	default:
+		return c.items[len(c.items)-1]
+	}
+}
+
+// splitAt keeps the first n items in the chunk and returns the rest as a new chunk
+func (c *Chunk) splitAt(n int) (tail *Chunk) {
+	items := c.ToSlice()
+	tail = &Chunk{valueWidth: c.valueWidth}
+	tail.setItems(items[n:], arrayContainer)
+	c.setItems(items[:n:n], arrayContainer)
+	if c.counts != nil {
+		tail.counts = slices.Clone(c.counts[n:])
+		c.counts = c.counts[:n:n]
+	}
+	if c.valueWidth > 0 {
+		tail.values = slices.Clone(c.values[n*c.valueWidth:])
+		c.values = c.values[: n*c.valueWidth : n*c.valueWidth]
+	}
+	c.optimize()
+	tail.optimize()
+	return tail
+}
+
+// absorb appends items of the next chunk (all bigger than items of c) to the chunk
+func (c *Chunk) absorb(next *Chunk) {
+	if c.counts != nil || next.counts != nil {
+		c.counts = append(c.allCounts(), next.allCounts()...)
+	}
+	if c.valueWidth > 0 {
+		c.values = append(c.values, next.values...) // chunks of one array have values of the same width
+	}
+	c.setItems(next.appendInRange(c.ToSlice(), 0, math.MaxUint32), arrayContainer)
+	c.optimize()
+}
+
+// allCounts returns counts of items, chunks without counts have 1 per item
+func (c *Chunk) allCounts() []uint32 {
+	if c.counts != nil {
+		return c.counts
+	}
+	counts := make([]uint32, c.size)
+	for i := range counts {
+		counts[i] = 1
+	}
+	return counts
+}
+
+// Serialize writes the container as is:
+// kind (1 byte) | array: uvarint count, uvarint len(compressed), compressed uint32 words (LE)
+// bitmap: uvarint base, uvarint len(bitmap), uint64 words (LE)
+// runs: uvarint count, (uvarint start-prev.last, uvarint last-start) per run
+// multiset chunks set countsFlag in kind and append counts: uvarint len(compressed), compressed uint32 words (LE)
+// key-value chunks set valuesFlag in kind and append values: uvarint width, uvarint len(compressed), compressed values
 func (c *Chunk) Serialize() ([]byte, error) {
-	var serialized bytes.Buffer
-	enc := gob.NewEncoder(&serialized)
-	err := enc.Encode(c)
-	if err != nil {
-		return nil, fmt.Errorf("unable to encode: %s", err)
+	buf := []byte{byte(c.kind)}
+	if c.counts != nil {
+		buf[0] |= countsFlag
+	}
+	if c.valueWidth > 0 {
+		buf[0] |= valuesFlag
+	}
+	switch c.kind {
+	case bitmapContainer:
+		buf = binary.AppendUvarint(buf, uint64(c.base))
+		buf = binary.AppendUvarint(buf, uint64(len(c.bitmap)))
+		for _, w := range c.bitmap {
+			buf = binary.LittleEndian.AppendUint64(buf, w)
+		}
+	case runContainer:
+		buf = binary.AppendUvarint(buf, uint64(len(c.runs)))
+		prev := uint32(0)
+		for _, r := range c.runs {
+			buf = binary.AppendUvarint(buf, uint64(r.start-prev))
+			buf = binary.AppendUvarint(buf, uint64(r.last-r.start))
+			prev = r.last
+		}
+	default:
+		compressed := intcomp.CompressUint32(c.items, nil)
+		buf = binary.AppendUvarint(buf, uint64(len(c.items)))
+		buf = binary.AppendUvarint(buf, uint64(len(compressed)))
+		for _, w := range compressed {
+			buf = binary.LittleEndian.AppendUint32(buf, w)
+		}
+	}
+	if c.counts != nil {
+		compressed := intcomp.CompressUint32(c.counts, nil)
+		buf = binary.AppendUvarint(buf, uint64(len(compressed)))
+		for _, w := range compressed {
+			buf = binary.LittleEndian.AppendUint32(buf, w)
+		}
 	}
-	return serialized.Bytes(), nil
+	if c.valueWidth > 0 {
+		compressed := compressValues(c.values, c.valueWidth)
+		buf = binary.AppendUvarint(buf, uint64(c.valueWidth))
+		buf = binary.AppendUvarint(buf, uint64(len(compressed)))
+		buf = append(buf, compressed...)
+	}
+	return frame(frameKindContainerChunk, buf), nil
 }
 
 func NewChunk(items []uint32) *Chunk {
@@ -101,16 +301,212 @@ func NewChunk(items []uint32) *Chunk {
 		items = make([]uint32, 0)
 	}
 	slices.Sort(items)
-	return &Chunk{items}
+	c := &Chunk{}
+	c.setItems(slices.Compact(items), arrayContainer)
+	c.optimize()
+	return c
 }
 
+// UnserializeChunk returns *ErrCorrupted if the data is damaged
 func UnserializeChunk(data []byte) (*Chunk, error) {
-	var c Chunk
+	kind := frameKind(data)
+	if kind == frameKindContainerChunk {
+		data, err := unframe(frameKindContainerChunk, data)
+		if err != nil {
+			return nil, &ErrCorrupted{Reason: err.Error()}
+		}
+		c, err := unserializeContainer(data)
+		if err != nil {
+			return nil, &ErrCorrupted{Reason: fmt.Sprintf("unable to decode: %s", err)}
+		}
+		return c, nil
+	}
+
+	// chunks written before containers were introduced are gob-encoded sorted slices
+	data, err := unframe(frameKindChunk, data)
+	if err != nil {
+		return nil, &ErrCorrupted{Reason: err.Error()}
+	}
+	var legacy struct{ Items []uint32 }
 	buf := bytes.NewBuffer(data)
 	enc := gob.NewDecoder(buf)
-	err := enc.Decode(&c)
+	err = enc.Decode(&legacy)
+	if err != nil {
+		return nil, &ErrCorrupted{Reason: fmt.Sprintf("unable to decode: %s", err)}
+	}
+	return NewChunk(legacy.Items), nil
+}
+
+func unserializeContainer(data []byte) (*Chunk, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("empty payload")
+	}
+	r := bytes.NewReader(data[1:])
+	uvarint := func(limit uint64) (uint64, error) {
+		v, err := binary.ReadUvarint(r)
+		if err == nil && v > limit {
+			err = fmt.Errorf("value %d is out of range", v)
+		}
+		return v, err
+	}
+	c := &Chunk{}
+	switch containerKind(data[0] &^ (countsFlag | valuesFlag)) {
+	case arrayContainer:
+		n, err := uvarint(math.MaxUint32)
+		if err != nil {
+			return nil, err
+		}
+		words, err := uvarint(uint64(r.Len() / 4))
+		if err != nil {
+			return nil, err
+		}
+		compressed := make([]uint32, words)
+		err = binary.Read(r, binary.LittleEndian, compressed)
+		if err != nil {
+			return nil, err
+		}
+		items, err := uncompressUint32(compressed, n)
+		if err != nil {
+			return nil, err
+		}
+		if uint64(len(items)) != n || !slices.IsSorted(items) {
+			return nil, fmt.Errorf("unexpected array items")
+		}
+		c.setItems(items, arrayContainer)
+	case bitmapContainer:
+		base, err := uvarint(math.MaxUint32)
+		if err != nil {
+			return nil, err
+		}
+		words, err := uvarint(uint64(r.Len() / 8))
+		if err != nil {
+			return nil, err
+		}
+		if words == 0 || base%64 != 0 || base+words*64 > math.MaxUint32+1 {
+			return nil, fmt.Errorf("unexpected bitmap span")
+		}
+		c.kind, c.base, c.bitmap = bitmapContainer, uint32(base), make([]uint64, words)
+		err = binary.Read(r, binary.LittleEndian, c.bitmap)
+		if err != nil {
+			return nil, err
+		}
+		for _, w := range c.bitmap {
+			c.size += bits.OnesCount64(w)
+		}
+	case runContainer:
+		n, err := uvarint(uint64(r.Len() / 2))
+		if err != nil {
+			return nil, err
+		}
+		c.kind, c.runs = runContainer, make([]run, 0, n)
+		next := uint64(0) // the smallest possible start of the next run
+		for i := uint64(0); i < n; i++ {
+			delta, err := uvarint(math.MaxUint32)
+			if err != nil {
+				return nil, err
+			}
+			length, err := uvarint(math.MaxUint32)
+			if err != nil {
+				return nil, err
+			}
+			start := next + delta
+			if i > 0 {
+				start-- // next is prev.last+1
+			}
+			if (i > 0 && delta < 2) || start+length > math.MaxUint32 {
+				return nil, fmt.Errorf("unexpected runs")
+			}
+			c.runs = append(c.runs, run{uint32(start), uint32(start + length)})
+			c.size += int(length) + 1
+			next = start + length + 1
+		}
+		if n == 0 {
+			return nil, fmt.Errorf("no runs")
+		}
+	default:
+		return nil, fmt.Errorf("unknown container %d", data[0])
+	}
+	if data[0]&countsFlag != 0 {
+		words, err := uvarint(uint64(r.Len() / 4))
+		if err != nil {
+			return nil, err
+		}
+		compressed := make([]uint32, words)
+		err = binary.Read(r, binary.LittleEndian, compressed)
+		if err != nil {
+			return nil, err
+		}
+		c.counts, err = uncompressUint32(compressed, uint64(c.size))
+		if err != nil {
+			return nil, err
+		}
+		if len(c.counts) != c.size || slices.Contains(c.counts, 0) {
+			return nil, fmt.Errorf("unexpected counts")
+		}
+	}
+	if data[0]&valuesFlag != 0 {
+		width, err := uvarint(maxValueWidth)
+		if err != nil {
+			return nil, err
+		}
+		size, err := uvarint(uint64(r.Len()))
+		if err != nil {
+			return nil, err
+		}
+		if width == 0 {
+			return nil, fmt.Errorf("zero value width")
+		}
+		compressed := make([]byte, size)
+		err = binary.Read(r, binary.LittleEndian, compressed)
+		if err != nil {
+			return nil, err
+		}
+		c.valueWidth = int(width)
+		c.values, err = uncompressValues(compressed, c.size, c.valueWidth)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if r.Len() > 0 {
+		return nil, fmt.Errorf("unexpected trailing bytes")
+	}
+	return c, nil
+}
+
+// uncompressUint32 checks block headers before intcomp trusts them (it allocates by the headers)
+// and protects from its panics on damaged input
+func uncompressUint32(compressed []uint32, n uint64) (items []uint32, err error) {
+	if n > 128*uint64(len(compressed)+1) {
+		return nil, fmt.Errorf("too many items for %d words", len(compressed))
+	}
+	total, err := uncompressedLen(compressed)
 	if err != nil {
-		return nil, fmt.Errorf("unable to decode: %s", err)
+		return nil, err
+	}
+	if total != n {
+		return nil, fmt.Errorf("blocks hold %d items, expected %d", total, n)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("unable to uncompress: %v", r)
+		}
+	}()
+	items = intcomp.UncompressUint32(compressed, make([]uint32, 0, n+1))
+	if uint64(len(items)) != n {
+		return nil, fmt.Errorf("got %d items, expected %d", len(items), n)
+	}
+	return items, nil
+}
+
+// uncompressedLen returns the number of items the block headers of compressed claim
+func uncompressedLen(compressed []uint32) (uint64, error) {
+	total, pos := uint64(0), 0
+	for pos < len(compressed)-1 { // the last word is not a block
+		if pos+1 >= len(compressed)-1 || compressed[pos+1] == 0 {
+			return 0, fmt.Errorf("broken block header")
+		}
+		total += uint64(compressed[pos])
+		pos += int(compressed[pos+1])
 	}
-	return &c, nil
+	return total, nil
 }
@@ -0,0 +1,281 @@
+package sorted_array
+
+import (
+	"golang.org/x/exp/slices"
+	"math"
+	"math/bits"
+	"sort"
+)
+
+// containerKind tells how a chunk keeps its items in memory (and on disk), like Roaring bitmaps do:
+// sparse items are kept in a sorted array, dense ones in a bitmap, consecutive ones as runs.
+// The cheapest representation is selected after every modification.
+type containerKind byte
+
+const (
+	arrayContainer  containerKind = iota // sorted []uint32
+	bitmapContainer                      // bitset over [base, base+64*len(bitmap))
+	runContainer                         // sorted non-adjacent [start,last] runs
+
+	countsFlag = 0x80 // set in the serialized kind of multiset chunks
+	valuesFlag = 0x40 // set in the serialized kind of key-value chunks
+)
+
+// run is an inclusive range of consecutive items
+type run struct{ start, last uint32 }
+
+// optimize switches the chunk to the cheapest container for its items
+func (c *Chunk) optimize() {
+	best := arrayContainer
+	if c.size > 0 {
+		arrayCost := 4 * c.size
+		bitmapCost := 8 * (int(c.Max()>>6-c.Min()>>6) + 1)
+		runCost := 8 * c.countRuns()
+		if bitmapCost < arrayCost && bitmapCost <= runCost {
+			best = bitmapContainer
+		} else if runCost < arrayCost && runCost < bitmapCost {
+			best = runContainer
+		}
+	}
+	if best != c.kind {
+		c.setItems(c.ToSlice(), best)
+	} else if c.kind == bitmapContainer && (c.bitmap[0] == 0 || c.bitmap[len(c.bitmap)-1] == 0) {
+		c.setItems(c.ToSlice(), best) // trim empty words after removals
+	}
+}
+
+// setItems replaces the content of the chunk with sorted unique items kept in the given container
+func (c *Chunk) setItems(items []uint32, kind containerKind) {
+	c.kind, c.size = kind, len(items)
+	c.items, c.bitmap, c.base, c.runs = nil, nil, 0, nil
+	switch kind {
+	case arrayContainer:
+		c.items = items
+		if c.items == nil {
+			c.items = make([]uint32, 0)
+		}
+	case bitmapContainer:
+		c.base = items[0] &^ 63
+		c.bitmap = make([]uint64, (items[len(items)-1]-c.base)/64+1)
+		for _, item := range items {
+			c.bitmap[(item-c.base)/64] |= 1 << ((item - c.base) % 64)
+		}
+	case runContainer:
+		c.runs = make([]run, 0, 1)
+		for i, item := range items {
+			if i > 0 && items[i-1]+1 == item {
+				c.runs[len(c.runs)-1].last = item
+				continue
+			}
+			c.runs = append(c.runs, run{item, item})
+		}
+	}
+}
+
+func (c *Chunk) countRuns() (runs int) {
+	switch c.kind {
+	case bitmapContainer:
+		carry := uint64(0) // the top bit of the previous word
+		for _, w := range c.bitmap {
+			runs += bits.OnesCount64(w &^ (w<<1 | carry)) // bits that start a run
+			carry = w >> 63
+		}
+	case runContainer:
+		runs = len(c.runs)
+	default:
+		for i, item := range c.items {
+			if i == 0 || c.items[i-1]+1 != item {
+				runs++
+			}
+		}
+	}
+	return
+}
+
+// inSpan tells if the item can be set in the bitmap without growing it
+func (c *Chunk) inSpan(item uint32) bool {
+	return item >= c.base && uint64(item-c.base) < uint64(len(c.bitmap))*64
+}
+
+func (c *Chunk) containerContains(item uint32) bool {
+	switch c.kind {
+	case bitmapContainer:
+		if !c.inSpan(item) {
+			return false
+		}
+		return c.bitmap[(item-c.base)/64]&(1<<((item-c.base)%64)) != 0
+	case runContainer:
+		i := c.runPos(item)
+		return i < len(c.runs) && c.runs[i].start <= item
+	default:
+		_, ok := slices.BinarySearch(c.items, item)
+		return ok
+	}
+}
+
+// rank returns the number of items smaller than the item (its position if the chunk contains it)
+func (c *Chunk) rank(item uint32) int {
+	switch c.kind {
+	case bitmapContainer:
+		if item <= c.base {
+			return 0
+		}
+		if !c.inSpan(item) {
+			return c.size
+		}
+		w, rank := (item-c.base)/64, 0
+		for _, word := range c.bitmap[:w] {
+			rank += bits.OnesCount64(word)
+		}
+		return rank + bits.OnesCount64(c.bitmap[w]&(1<<((item-c.base)%64)-1))
+	case runContainer:
+		i, rank := c.runPos(item), 0
+		for _, r := range c.runs[:i] {
+			rank += int(r.last-r.start) + 1
+		}
+		if i < len(c.runs) && c.runs[i].start < item {
+			rank += int(item - c.runs[i].start)
+		}
+		return rank
+	default:
+		pos, _ := slices.BinarySearch(c.items, item)
+		return pos
+	}
+}
+
+// seek tells if the chunk contains the item, searching array and run containers from the position hint onwards
+// (galloping: the step doubles until the item is passed), the returned position is the hint for the next bigger item
+func (c *Chunk) seek(item uint32, hint int) (found bool, pos int) {
+	switch c.kind {
+	case arrayContainer:
+		pos = gallop(len(c.items), hint, func(i int) bool { return c.items[i] >= item })
+		return pos < len(c.items) && c.items[pos] == item, pos
+	case runContainer:
+		pos = gallop(len(c.runs), hint, func(i int) bool { return c.runs[i].last >= item })
+		return pos < len(c.runs) && c.runs[pos].start <= item, pos
+	default:
+		return c.containerContains(item), hint
+	}
+}
+
+// gallop returns the smallest i in [hint,n) where f(i) is true (or n), f must be monotone
+func gallop(n, hint int, f func(i int) bool) int {
+	if hint >= n || f(hint) {
+		return hint
+	}
+	lo, step := hint, 1 // f(lo) is false
+	for lo+step < n && !f(lo+step) {
+		lo += step
+		step *= 2
+	}
+	hi := lo + step
+	if hi > n {
+		hi = n
+	}
+	return lo + 1 + sort.Search(hi-lo-1, func(i int) bool { return f(lo + 1 + i) })
+}
+
+// runPos returns the position of the first run that ends at or after the item
+func (c *Chunk) runPos(item uint32) int {
+	return sort.Search(len(c.runs), func(i int) bool { return c.runs[i].last >= item })
+}
+
+// insert puts a new item (known to be absent) into a bitmap or run container
+// the item must be within the bitmap span, see inSpan
+func (c *Chunk) insert(item uint32) {
+	c.size++
+	switch c.kind {
+	case bitmapContainer:
+		c.bitmap[(item-c.base)/64] |= 1 << ((item - c.base) % 64)
+	case runContainer:
+		i := c.runPos(item)
+		mergeLeft := i > 0 && c.runs[i-1].last+1 == item
+		mergeRight := i < len(c.runs) && item < math.MaxUint32 && c.runs[i].start == item+1
+		switch {
+		case mergeLeft && mergeRight:
+			c.runs[i-1].last = c.runs[i].last
+			c.runs = append(c.runs[:i], c.runs[i+1:]...)
+		case mergeLeft:
+			c.runs[i-1].last = item
+		case mergeRight:
+			c.runs[i].start = item
+		default:
+			c.runs = append(c.runs, run{})
+			copy(c.runs[i+1:], c.runs[i:])
+			c.runs[i] = run{item, item}
+		}
+	}
+}
+
+// delete removes an existing item from a bitmap or run container
+func (c *Chunk) delete(item uint32) {
+	c.size--
+	switch c.kind {
+	case bitmapContainer:
+		c.bitmap[(item-c.base)/64] &^= 1 << ((item - c.base) % 64)
+	case runContainer:
+		i := c.runPos(item)
+		r := c.runs[i]
+		switch {
+		case r.start == r.last:
+			c.runs = append(c.runs[:i], c.runs[i+1:]...)
+		case item == r.start:
+			c.runs[i].start++
+		case item == r.last:
+			c.runs[i].last--
+		default: // split the run
+			c.runs = append(c.runs, run{})
+			copy(c.runs[i+1:], c.runs[i:])
+			c.runs[i] = run{r.start, item - 1}
+			c.runs[i+1] = run{item + 1, r.last}
+		}
+	}
+}
+
+// appendInRange appends items within [from,to] to dst in asc order
+func (c *Chunk) appendInRange(dst []uint32, from, to uint32) []uint32 {
+	switch c.kind {
+	case bitmapContainer:
+		for w, word := range c.bitmap {
+			for word != 0 {
+				item := c.base + uint32(w)*64 + uint32(bits.TrailingZeros64(word))
+				word &= word - 1
+				if item > to {
+					return dst
+				}
+				if item >= from {
+					dst = append(dst, item)
+				}
+			}
+		}
+	case runContainer:
+		for _, r := range c.runs[c.runPos(from):] {
+			if r.start > to {
+				break
+			}
+			item := r.start
+			if item < from {
+				item = from
+			}
+			for ; ; item++ {
+				if item > to {
+					return dst
+				}
+				dst = append(dst, item)
+				if item == r.last {
+					break
+				}
+			}
+		}
+	default:
+		for _, item := range c.items {
+			if item > to {
+				break
+			}
+			if item >= from {
+				dst = append(dst, item)
+			}
+		}
+	}
+	return dst
+}
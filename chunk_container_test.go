@@ -0,0 +1,182 @@
+package sorted_array
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/exp/rand"
+	"golang.org/x/exp/slices"
+	"math"
+	"testing"
+)
+
+func TestContainerSelection(t *testing.T) {
+	tests := []struct {
+		items []uint32
+		kind  containerKind
+	}{
+		{[]uint32{}, arrayContainer},
+		{[]uint32{1, 100, 10_000}, arrayContainer},
+		{sequence(0, 1000, 1), runContainer},
+		{sequence(0, 1000, 2), bitmapContainer},
+		{[]uint32{math.MaxUint32 - 2, math.MaxUint32 - 1, math.MaxUint32}, bitmapContainer},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("test %d", i), func(t *testing.T) {
+			chunk := NewChunk(slices.Clone(tt.items))
+			require.Equal(t, tt.kind, chunk.kind)
+			require.EqualValues(t, tt.items, chunk.ToSlice())
+
+			s, err := chunk.Serialize()
+			require.NoError(t, err)
+			chunk2, err := UnserializeChunk(s)
+			require.NoError(t, err)
+			require.EqualValues(t, chunk, chunk2)
+		})
+	}
+}
+
+func TestContainerSwitchesOnModification(t *testing.T) {
+	chunk := NewChunk(sequence(0, 1000, 1))
+	require.Equal(t, runContainer, chunk.kind)
+
+	chunk.Remove(sequence(1, 1000, 2)) // every other item
+	require.Equal(t, bitmapContainer, chunk.kind)
+
+	chunk.Remove(sequence(2, 998, 2))
+	require.Equal(t, arrayContainer, chunk.kind)
+	require.EqualValues(t, []uint32{0, 998}, chunk.ToSlice())
+
+	chunk.Add(sequence(0, 1000, 1))
+	require.Equal(t, runContainer, chunk.kind)
+	require.EqualValues(t, sequence(0, 1000, 1), chunk.ToSlice())
+}
+
+func TestContainersRandomized(t *testing.T) {
+	for _, span := range []int{50, 500, 100_000} {
+		chunk := NewChunk(nil)
+		model := make(map[uint32]struct{})
+		for i := 0; i < 500; i++ {
+			items := make([]uint32, 0)
+			start := uint32(rand.Intn(span))
+			for j := rand.Intn(60); j > 0; j-- {
+				items = append(items, start+uint32(rand.Intn(30)))
+			}
+			if rand.Intn(3) == 0 {
+				removed := chunk.Remove(items)
+				expected := 0
+				for _, item := range items {
+					if _, ok := model[item]; ok {
+						expected++
+						delete(model, item)
+					}
+				}
+				require.Equal(t, expected, removed)
+			} else {
+				for _, item := range items {
+					model[item] = struct{}{}
+				}
+				chunk.Add(items)
+			}
+
+			expected := make([]uint32, 0, len(model))
+			for item := range model {
+				expected = append(expected, item)
+			}
+			slices.Sort(expected)
+			require.EqualValues(t, expected, chunk.ToSlice())
+			require.Equal(t, len(expected), chunk.Len())
+			if len(expected) > 0 {
+				require.Equal(t, expected[0], chunk.Min())
+				require.Equal(t, expected[len(expected)-1], chunk.Max())
+				require.True(t, chunk.Contains(expected[len(expected)/2]))
+			}
+
+			s, err := chunk.Serialize()
+			require.NoError(t, err)
+			chunk2, err := UnserializeChunk(s)
+			require.NoError(t, err)
+			require.EqualValues(t, chunk, chunk2)
+		}
+	}
+}
+
+func TestLegacyGobChunk(t *testing.T) {
+	var legacy bytes.Buffer
+	require.NoError(t, gob.NewEncoder(&legacy).Encode(struct{ Items []uint32 }{[]uint32{1, 2, 3}}))
+
+	chunk, err := UnserializeChunk(frame(frameKindChunk, legacy.Bytes()))
+	require.NoError(t, err)
+	require.EqualValues(t, []uint32{1, 2, 3}, chunk.ToSlice())
+}
+
+func TestDamagedContainers(t *testing.T) {
+	for _, items := range [][]uint32{{1, 100}, sequence(0, 100, 1), sequence(0, 1000, 2)} {
+		s, err := NewChunk(items).Serialize()
+		require.NoError(t, err)
+		payload := s[frameHeaderSize:]
+		for i := 0; i < len(payload); i++ { // a valid checksum over garbage must not panic
+			damaged := slices.Clone(payload)
+			damaged[i] ^= 0xff
+			_, _ = UnserializeChunk(frame(frameKindContainerChunk, damaged))
+			_, _ = UnserializeChunk(frame(frameKindContainerChunk, payload[:i]))
+		}
+	}
+}
+
+// sequence returns items in [from,to) with the step
+func sequence(from, to, step uint32) []uint32 {
+	items := make([]uint32, 0)
+	for i := from; i < to; i += step {
+		items = append(items, i)
+	}
+	return items
+}
+
+// BenchmarkContainers compares containers with the plain sorted slice (the representation before containers)
+func BenchmarkContainers(b *testing.B) {
+	datasets := map[string][]uint32{
+		"sparse": sequence(0, 10_000_000, 1000),
+		"dense":  sequence(0, 20_000, 2),
+		"runs":   sequence(0, 10_000, 1),
+	}
+	for name, items := range datasets {
+		b.Run(name+"/plain/serialize", func(b *testing.B) {
+			var buf bytes.Buffer
+			for n := 0; n < b.N; n++ {
+				buf.Reset()
+				_ = gob.NewEncoder(&buf).Encode(struct{ Items []uint32 }{items})
+			}
+			b.ReportMetric(float64(buf.Len()), "bytes")
+		})
+		b.Run(name+"/container/serialize", func(b *testing.B) {
+			chunk := NewChunk(slices.Clone(items))
+			var s []byte
+			for n := 0; n < b.N; n++ {
+				s, _ = chunk.Serialize()
+			}
+			b.ReportMetric(float64(len(s)), "bytes")
+		})
+		b.Run(name+"/plain/contains", func(b *testing.B) {
+			for n := 0; n < b.N; n++ {
+				contains(items, uint32(n))
+			}
+		})
+		b.Run(name+"/container/contains", func(b *testing.B) {
+			chunk := NewChunk(slices.Clone(items))
+			for n := 0; n < b.N; n++ {
+				chunk.Contains(uint32(n))
+			}
+		})
+		b.Run(name+"/container/add-remove", func(b *testing.B) {
+			chunk := NewChunk(slices.Clone(items))
+			for n := 0; n < b.N; n++ {
+				item := items[n%len(items)]
+				chunk.Remove([]uint32{item})
+				chunk.Add([]uint32{item})
+			}
+			b.ReportAllocs()
+		})
+	}
+}
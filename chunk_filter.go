@@ -0,0 +1,61 @@
+package sorted_array
+
+import "math"
+
+// chunkFilter is a bloom filter over items of one chunk
+// it answers "definitely not in the chunk" without loading the chunk
+// the first word keeps the number of hash functions, the rest is the bitset
+type chunkFilter []uint32
+
+func newChunkFilter(items []uint32, bitsPerItem uint32) chunkFilter {
+	bits := uint32(len(items)) * bitsPerItem
+	words := bits/32 + 1
+	hashes := uint32(math.Round(float64(bitsPerItem) * math.Ln2))
+	if hashes < 1 {
+		hashes = 1
+	}
+	if hashes > 16 {
+		hashes = 16
+	}
+	f := make(chunkFilter, words+1)
+	f[0] = hashes
+	for _, item := range items {
+		f.add(item)
+	}
+	return f
+}
+
+func (f chunkFilter) add(item uint32) {
+	bits := uint32(len(f)-1) * 32
+	h1, h2 := filterHashes(item)
+	for i := uint32(0); i < f[0]; i++ {
+		bit := (h1 + i*h2) % bits
+		f[1+bit/32] |= 1 << (bit % 32)
+	}
+}
+
+func (f chunkFilter) mayContain(item uint32) bool {
+	if len(f) < 2 {
+		return true // not a usable filter
+	}
+	bits := uint32(len(f)-1) * 32
+	h1, h2 := filterHashes(item)
+	for i := uint32(0); i < f[0]; i++ {
+		bit := (h1 + i*h2) % bits
+		if f[1+bit/32]&(1<<(bit%32)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// filterHashes makes two independent hashes for double hashing (murmur3 finalizer)
+func filterHashes(item uint32) (uint32, uint32) {
+	x := uint64(item)
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return uint32(x), uint32(x>>32) | 1
+}
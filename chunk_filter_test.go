@@ -0,0 +1,34 @@
+package sorted_array
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestChunkFilter(t *testing.T) {
+	items := make([]uint32, 0, 1000)
+	for i := uint32(0); i < 1000; i++ {
+		items = append(items, i*7)
+	}
+	f := newChunkFilter(items, 10)
+
+	// no false negatives
+	for _, item := range items {
+		require.True(t, f.mayContain(item))
+	}
+
+	// false positives are rare
+	falsePositives := 0
+	for i := uint32(0); i < 10_000; i++ {
+		if f.mayContain(10_000 + i) {
+			falsePositives++
+		}
+	}
+	require.Less(t, falsePositives, 300) // ~1% expected
+}
+
+func TestEmptyChunkFilter(t *testing.T) {
+	f := newChunkFilter(nil, 10)
+	require.False(t, f.mayContain(1))
+	require.True(t, chunkFilter{}.mayContain(1))
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/gob"
 	"fmt"
 	"github.com/ronanh/intcomp"
+	"golang.org/x/exp/maps"
 	"golang.org/x/exp/slices"
 	"sync"
 )
@@ -16,6 +17,16 @@ type ChunkMeta struct {
 	size     uint32 // number of items in the chunk
 }
 
+// NewChunkMeta describes a chunk of size items within [min,max]
+func NewChunkMeta(id, min, max, size uint32) *ChunkMeta {
+	return &ChunkMeta{id: id, min: min, max: max, size: size}
+}
+
+func (cm *ChunkMeta) Id() uint32   { return cm.id }
+func (cm *ChunkMeta) Min() uint32  { return cm.min }
+func (cm *ChunkMeta) Max() uint32  { return cm.max }
+func (cm *ChunkMeta) Size() uint32 { return cm.size }
+
 func (cm *ChunkMeta) intersects(cm2 *ChunkMeta) bool { return cm.max >= cm2.min && cm.min <= cm2.max }
 
 func (cm *ChunkMeta) contains(item uint32) bool { return item >= cm.min && item <= cm.max }
@@ -23,11 +34,20 @@ func (cm *ChunkMeta) contains(item uint32) bool { return item >= cm.min && item
 // Meta contains a list of SORTED chunks descriptions
 // No overlapping allowed
 type Meta struct {
-	nextId uint32
-	chunks []*ChunkMeta
+	nextId  uint32
+	chunks  []*ChunkMeta           // loaded descriptions (all of them unless the meta is paged)
+	filters map[uint32]chunkFilter // optional filters by chunk id
+	index   map[uint32]*ChunkMeta  // id -> description, built on demand
+
+	// paged meta only (see meta_pages.go), nil pages means the meta is flat
+	pages      []*metaPage
+	nextPageId uint32
+	pageLoader func(pageIds []uint32) (map[uint32][]byte, error) // returns serialized pages
+	summaryCrc uint32                                            // checksum of the persisted summary
+	chunkSize  uint32                                            // max chunk size of the array, for page stats
 }
 
-func NewMeta() *Meta { return &Meta{0, make([]*ChunkMeta, 0)} }
+func NewMeta() *Meta { return &Meta{nextId: 0, chunks: make([]*ChunkMeta, 0)} }
 
 // TakeNextId starts from 0 and returns the NEXT available id
 func (m *Meta) TakeNextId() (id uint32) {
@@ -37,12 +57,13 @@ func (m *Meta) TakeNextId() (id uint32) {
 }
 
 func (m *Meta) GetChunkById(id uint32) *ChunkMeta {
-	for _, meta := range m.chunks {
-		if meta.id == id {
-			return meta
+	if m.index == nil {
+		m.index = make(map[uint32]*ChunkMeta, len(m.chunks))
+		for _, meta := range m.chunks {
+			m.index[meta.id] = meta
 		}
 	}
-	return nil
+	return m.index[id]
 }
 
 func (m *Meta) Remove(meta *ChunkMeta) {
@@ -52,6 +73,49 @@ func (m *Meta) Remove(meta *ChunkMeta) {
 	}
 	copy(m.chunks[pos:], m.chunks[pos+1:])
 	m.chunks = m.chunks[:len(m.chunks)-1] // collapse after deletion
+	delete(m.filters, meta.id)
+	delete(m.index, meta.id)
+}
+
+// removeFirst removes n leading (loaded) chunk descriptions at once
+func (m *Meta) removeFirst(n int) {
+	for _, cm := range m.chunks[:n] {
+		delete(m.filters, cm.id)
+		delete(m.index, cm.id)
+	}
+	m.chunks = append(m.chunks[:0], m.chunks[n:]...)
+}
+
+// clone returns a deep copy of a flat meta (filters are never modified in place, so they are shared)
+func (m *Meta) clone() *Meta {
+	m2 := &Meta{nextId: m.nextId, chunks: make([]*ChunkMeta, len(m.chunks))}
+	for i, cm := range m.chunks {
+		cm2 := *cm
+		m2.chunks[i] = &cm2
+	}
+	if m.filters != nil {
+		m2.filters = maps.Clone(m.filters)
+	}
+	return m2
+}
+
+// setFilter attaches a filter to the chunk, nil filter removes it
+func (m *Meta) setFilter(id uint32, f chunkFilter) {
+	if f == nil {
+		delete(m.filters, id)
+		return
+	}
+	if m.filters == nil {
+		m.filters = make(map[uint32]chunkFilter)
+	}
+	m.filters[id] = f
+}
+
+// mayContain tells if the chunk can contain the item according to its filter
+// chunks without a filter may contain anything
+func (m *Meta) mayContain(id uint32, item uint32) bool {
+	f, ok := m.filters[id]
+	return !ok || f.mayContain(item)
 }
 
 func (m *Meta) Add(metas []*ChunkMeta) {
@@ -94,6 +158,9 @@ func (m *Meta) Add(metas []*ChunkMeta) {
 			copy(newMeta[pos+1:], newMeta[pos:])
 			newMeta[pos] = meta
 		}
+		if m.index != nil {
+			m.index[meta.id] = meta
+		}
 	}
 
 	m.chunks = newMeta
@@ -116,6 +183,7 @@ func (m *Meta) FindRelevantForReadRange(min, max uint32) []*ChunkMeta {
 		return nil
 	}
 	maxPos, exists := findPosForItem(m.chunks[minPos:], max)
+	maxPos += minPos // the position is relative to minPos
 	if !exists {
 		maxPos--
 	}
@@ -228,6 +296,18 @@ func (m *Meta) Serialize() ([]byte, error) {
 
 	wg.Wait()
 
+	// 5,6. optional chunk filters: lengths in the chunks order, then all filters concatenated
+	if len(m.filters) > 0 {
+		lengths := make([]uint32, 0, len(m.chunks))
+		words := make([]uint32, 0)
+		for _, cm := range m.chunks {
+			f := m.filters[cm.id]
+			lengths = append(lengths, uint32(len(f)))
+			words = append(words, f...)
+		}
+		serializedState = append(serializedState, intcomp.CompressUint32(lengths, nil), words)
+	}
+
 	// Finally GOB it
 	var gobBuf bytes.Buffer
 	enc := gob.NewEncoder(&gobBuf)
@@ -235,10 +315,15 @@ func (m *Meta) Serialize() ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	return gobBuf.Bytes(), nil
+	return frame(frameKindMeta, gobBuf.Bytes()), nil
 }
 
+// UnserializeMeta returns *ErrCorrupted if the data is damaged
 func UnserializeMeta(data []byte) (*Meta, error) {
+	data, err := unframe(frameKindMeta, data)
+	if err != nil {
+		return nil, &ErrCorrupted{Meta: true, Reason: err.Error()}
+	}
 	gobBuf := bytes.NewBuffer(data)
 	enc := gob.NewDecoder(gobBuf)
 	serializedState := [][]uint32{
@@ -248,23 +333,35 @@ func UnserializeMeta(data []byte) (*Meta, error) {
 		make([]uint32, 0),
 		make([]uint32, 0),
 	}
-	err := enc.Decode(&serializedState)
+	err = enc.Decode(&serializedState)
 	if err != nil {
-		return nil, err
+		return nil, &ErrCorrupted{Meta: true, Reason: fmt.Sprintf("unable to decode: %s", err)}
+	}
+	if len(serializedState) < 5 || len(serializedState[0]) != 1 {
+		return nil, &ErrCorrupted{Meta: true, Reason: "unexpected layout"}
 	}
 
 	meta := NewMeta()
 	meta.nextId = serializedState[0][0]
 
-	var ids, min, max, size []uint32
+	// all columns must hold as many items as the ids one (uncompressUint32 checks that)
+	n, err := uncompressedLen(serializedState[1])
+	if err != nil {
+		return nil, &ErrCorrupted{Meta: true, Reason: err.Error()}
+	}
+	columns, errs := make([][]uint32, 4), make([]error, 4)
 	wg := sync.WaitGroup{}
-	wg.Add(4)
-
-	go func() { defer wg.Done(); ids = intcomp.UncompressUint32(serializedState[1], nil) }()
-	go func() { defer wg.Done(); min = intcomp.UncompressUint32(serializedState[2], nil) }()
-	go func() { defer wg.Done(); max = intcomp.UncompressUint32(serializedState[3], nil) }()
-	go func() { defer wg.Done(); size = intcomp.UncompressUint32(serializedState[4], nil) }()
+	wg.Add(len(columns))
+	for i := range columns {
+		go func(i int) { defer wg.Done(); columns[i], errs[i] = uncompressUint32(serializedState[1+i], n) }(i)
+	}
 	wg.Wait()
+	for _, err = range errs {
+		if err != nil {
+			return nil, &ErrCorrupted{Meta: true, Reason: err.Error()}
+		}
+	}
+	ids, min, max, size := columns[0], columns[1], columns[2], columns[3]
 	meta.chunks = make([]*ChunkMeta, len(ids))
 
 	for i, _ := range ids {
@@ -274,9 +371,32 @@ func UnserializeMeta(data []byte) (*Meta, error) {
 			max:  max[i],
 			size: size[i],
 		}
+		if cm.min > cm.max || i > 0 && meta.chunks[i-1].max >= cm.min {
+			return nil, &ErrCorrupted{Meta: true, Reason: "chunks are out of order"}
+		}
 		meta.chunks[i] = cm
 	}
 
+	if len(serializedState) >= 7 {
+		lengths, err := uncompressUint32(serializedState[5], n)
+		if err != nil {
+			return nil, &ErrCorrupted{Meta: true, Reason: "filters don't match chunks"}
+		}
+		words := serializedState[6]
+		for i, l := range lengths {
+			if uint32(len(words)) < l {
+				return nil, &ErrCorrupted{Meta: true, Reason: "filters are truncated"}
+			}
+			if l > 0 {
+				meta.setFilter(ids[i], chunkFilter(words[:l:l]))
+			}
+			words = words[l:]
+		}
+		if len(words) > 0 {
+			return nil, &ErrCorrupted{Meta: true, Reason: "filters don't match chunks"}
+		}
+	}
+
 	return meta, nil
 }
 
@@ -1,6 +1,8 @@
 package sorted_array
 
 import (
+	"bytes"
+	"encoding/gob"
 	"fmt"
 	"github.com/stretchr/testify/require"
 	"testing"
@@ -104,6 +106,8 @@ func TestMetaSearchRelevantForReadRange(t *testing.T) {
 		{15, 17, []*ChunkMeta{&chunk1}},          // range right boundary overlap
 		{14, 21, []*ChunkMeta{&chunk1, &chunk2}}, // range two chunk partial overlap
 		{0, 100, []*ChunkMeta{&chunk1, &chunk2}}, // range total overlap
+		{22, 25, []*ChunkMeta{&chunk2}},          // range inner overlap of the second chunk
+		{17, 30, []*ChunkMeta{&chunk2}},          // range total overlap of the second chunk
 	}
 
 	for _, tt := range tests {
@@ -114,6 +118,28 @@ func TestMetaSearchRelevantForReadRange(t *testing.T) {
 	}
 }
 
+// chunks after the first relevant one used to be cut off: the max position was taken relative to the min one
+func TestMetaSearchRelevantForReadRangeManyChunks(t *testing.T) {
+	meta := NewMeta()
+	chunks := make([]*ChunkMeta, 0)
+	for i := uint32(0); i < 10; i++ {
+		chunks = append(chunks, &ChunkMeta{i, i * 10, i*10 + 5, 6}) // [0,5], [10,15], ...
+	}
+	meta.Add(chunks)
+
+	for min := uint32(0); min < 110; min++ {
+		for max := min; max < 110; max++ {
+			expected := make([]*ChunkMeta, 0)
+			for _, cm := range chunks {
+				if cm.max >= min && cm.min <= max {
+					expected = append(expected, cm)
+				}
+			}
+			require.ElementsMatch(t, expected, meta.FindRelevantForReadRange(min, max), "[%d,%d]", min, max)
+		}
+	}
+}
+
 func TestMetaSearchRelevantForInsert(t *testing.T) {
 	meta := NewMeta()
 
@@ -187,3 +213,89 @@ func BenchmarkSerialization(b *testing.B) {
 	require.NoError(b, err)
 	require.EqualValues(b, meta, meta2)
 }
+
+func TestSerializationWithFilters(t *testing.T) {
+	meta := NewMeta()
+	c1 := &ChunkMeta{meta.TakeNextId(), 10, 15, 2}
+	c2 := &ChunkMeta{meta.TakeNextId(), 20, 25, 2}
+	c3 := &ChunkMeta{meta.TakeNextId(), 30, 35, 2}
+	meta.Add([]*ChunkMeta{c1, c2, c3})
+	meta.setFilter(c1.id, newChunkFilter([]uint32{10, 15}, 10))
+	meta.setFilter(c3.id, newChunkFilter([]uint32{30, 35}, 10)) // c2 has no filter
+
+	b, err := meta.Serialize()
+	require.NoError(t, err)
+	meta2, err := UnserializeMeta(b)
+	require.NoError(t, err)
+	require.EqualValues(t, meta, meta2)
+
+	require.True(t, meta2.mayContain(c1.id, 15))
+	require.False(t, meta2.mayContain(c1.id, 14))
+	require.True(t, meta2.mayContain(c2.id, 24)) // no filter, anything is possible
+
+	meta2.Remove(c1)
+	require.NotContains(t, meta2.filters, c1.id)
+}
+
+// FuzzMetaAdd adds chunk descriptions one by one, each is 2 bytes: min, max
+// an invalid or overlapping description must panic and leave the meta unchanged
+func FuzzMetaAdd(f *testing.F) {
+	f.Add([]byte{1, 5, 10, 20, 6, 9})
+	f.Add([]byte{10, 20, 15, 25, 5, 4})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		meta := NewMeta()
+		taken := make([]bool, 256)
+		for i := 0; i+1 < len(data); i += 2 {
+			cm := &ChunkMeta{meta.TakeNextId(), uint32(data[i]), uint32(data[i+1]), 1}
+			valid := cm.min <= cm.max
+			for v := cm.min; valid && v <= cm.max; v++ {
+				valid = !taken[v]
+			}
+			before := len(meta.chunks)
+			if !valid {
+				require.Panics(t, func() { meta.Add([]*ChunkMeta{cm}) })
+				require.Len(t, meta.chunks, before)
+				continue
+			}
+			meta.Add([]*ChunkMeta{cm})
+			for v := cm.min; v <= cm.max; v++ {
+				taken[v] = true
+			}
+			require.Len(t, meta.chunks, before+1)
+			require.Same(t, cm, meta.GetChunkById(cm.id))
+			require.Same(t, cm, meta.FindRelevantForRead(cm.min))
+		}
+		for i := 1; i < len(meta.chunks); i++ {
+			require.Less(t, meta.chunks[i-1].max, meta.chunks[i].min)
+		}
+	})
+}
+
+// FuzzUnserializeMeta makes sure damaged input is reported, not panicked on
+func FuzzUnserializeMeta(f *testing.F) {
+	meta := NewMeta()
+	meta.Add([]*ChunkMeta{{meta.TakeNextId(), 10, 15, 2}, {meta.TakeNextId(), 20, 25, 2}})
+	b, err := meta.Serialize()
+	require.NoError(f, err)
+	f.Add(b)
+	meta.setFilter(0, newChunkFilter([]uint32{10, 15}, 10))
+	b, err = meta.Serialize()
+	require.NoError(f, err)
+	f.Add(b)
+	var legacy bytes.Buffer // a broken block header used to panic inside intcomp
+	require.NoError(f, gob.NewEncoder(&legacy).Encode([][]uint32{{1}, {5, 3, 0xdeadbeef}, {}, {}, {}}))
+	f.Add(legacy.Bytes())
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if len(data) > 1<<12 {
+			return // big inputs only slow the fuzzer down, metas are damaged the same way in small ones
+		}
+		meta, err := UnserializeMeta(data)
+		if err != nil {
+			return
+		}
+		for i := 1; i < len(meta.chunks); i++ {
+			require.Less(t, meta.chunks[i-1].max, meta.chunks[i].min)
+		}
+		meta.FindRelevantForReadRange(0, 1<<32-1)
+	})
+}
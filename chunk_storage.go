@@ -1,17 +1,19 @@
 package sorted_array
 
 import (
+	"bytes"
 	"database/sql"
 	"errors"
 	"fmt"
 	errors2 "github.com/pkg/errors"
-	"golang.org/x/exp/maps"
+	"strconv"
+	"strings"
 )
 
 // ChunkStorage does simple CRUD operations on persistent storage
 // Serialization(+compression) must be implemented at this level
 type ChunkStorage interface {
-	// Read if err is nil then it always return a map of size = len(chunkIds)
+	// Read returns found chunks only, missing ids are omitted (not an error)
 	Read(chunkIds []uint32) (map[uint32]*Chunk, error)
 	Save(chunks map[uint32]*Chunk) error
 	Remove(chunkIds []uint32) error
@@ -20,6 +22,7 @@ type ChunkStorage interface {
 	SaveMeta(*Meta) error
 }
 
+// InMemoryChunkStorage keeps copies of saved chunks and meta, so later changes are not visible until saved again
 type InMemoryChunkStorage struct {
 	chunks map[uint32]*Chunk
 	meta   *Meta
@@ -28,10 +31,8 @@ type InMemoryChunkStorage struct {
 func (s *InMemoryChunkStorage) Read(chunkIds []uint32) (map[uint32]*Chunk, error) {
 	chunks := make(map[uint32]*Chunk, len(chunkIds))
 	for _, id := range chunkIds {
-		if _, ok := s.chunks[id]; ok {
-			chunks[id] = s.chunks[id]
-		} else {
-			chunks[id] = nil
+		if chunk, ok := s.chunks[id]; ok {
+			chunks[id] = chunk.clone()
 		}
 	}
 	return chunks, nil
@@ -45,20 +46,22 @@ func (s *InMemoryChunkStorage) Remove(chunkIds []uint32) error {
 }
 
 func (s *InMemoryChunkStorage) Save(chunks map[uint32]*Chunk) error {
-	maps.Copy(s.chunks, chunks)
+	for id, chunk := range chunks {
+		s.chunks[id] = chunk.clone()
+	}
 	return nil
 }
 
 func (s *InMemoryChunkStorage) ReadMeta() (*Meta, error) {
 	m := s.meta
 	if m == nil {
-		return &Meta{0, nil}, nil
+		return &Meta{nextId: 0}, nil
 	}
-	return m, nil
+	return m.clone(), nil
 }
 
 func (s *InMemoryChunkStorage) SaveMeta(meta *Meta) error {
-	s.meta = meta
+	s.meta = meta.clone()
 	return nil
 }
 
@@ -72,7 +75,8 @@ func NewInMemoryChunkStorage() *InMemoryChunkStorage {
 // it uses blobs to store chunks and meta
 // key is used to produce unique ids for the blobs in a shared table
 type SortedArraySqlTxStorage struct {
-	key []byte // id of the array in the storage
+	*BlobChunkStorage        // serialization on top of the blobs below
+	key               []byte // id of the array in the storage
 	// SQLite is NOT threadsafe for writes, so any write can actually return "table is locked"
 	// so to mitigate this it is better to start transaction IMMEDIATELY (instead of lazy transactions)
 	// handle "table is locked" at db.Begin() call so the rest is 100% thread-safe
@@ -82,65 +86,78 @@ type SortedArraySqlTxStorage struct {
 	preparedRead   *sql.Stmt
 }
 
-func (s *SortedArraySqlTxStorage) Read(chunkIds []uint32) (map[uint32]*Chunk, error) {
-	ret := make(map[uint32]*Chunk, 0)
-	for _, id := range chunkIds {
-		r := s.preparedRead.QueryRow(s.chunkId(id))
+func (s *SortedArraySqlTxStorage) ReadBlobs(keys []string) (map[string][]byte, error) {
+	ret := make(map[string][]byte, len(keys))
+	for _, key := range keys {
+		r := s.preparedRead.QueryRow(s.blobKey(key))
 		var serialized []byte
 		err := r.Scan(&serialized)
 		if errors.Is(err, sql.ErrNoRows) {
 			continue
 		} else if err != nil {
-			return nil, errors2.Wrap(err, "Read:")
-		}
-		ret[id], err = UnserializeChunk(serialized)
-		if err != nil {
-			return nil, err
+			return nil, errors2.Wrap(err, "ReadBlobs:")
 		}
+		ret[key] = serialized
 	}
 	return ret, nil
 }
-func (s *SortedArraySqlTxStorage) Save(chunks map[uint32]*Chunk) error {
-	for id, chunk := range chunks {
-		chunkSerialized, err := chunk.Serialize()
+func (s *SortedArraySqlTxStorage) SaveBlobs(blobs map[string][]byte) error {
+	for key, blob := range blobs {
+		_, err := s.preparedUpsert.Exec(s.blobKey(key), blob)
 		if err != nil {
-			return err
+			return errors2.Wrap(err, "SaveBlobs:")
 		}
-		s.preparedUpsert.Exec(s.chunkId(id), chunkSerialized)
 	}
 	return nil
 }
-func (s *SortedArraySqlTxStorage) Remove(chunkIds []uint32) error {
-	for _, id := range chunkIds {
-		_, err := s.preparedRemove.Exec(id)
+func (s *SortedArraySqlTxStorage) RemoveBlobs(keys []string) error {
+	for _, key := range keys {
+		_, err := s.preparedRemove.Exec(s.blobKey(key))
 		if err != nil {
-			return err
+			return errors2.Wrap(err, "RemoveBlobs:")
 		}
 	}
 	return nil
 }
-func (s *SortedArraySqlTxStorage) ReadMeta() (*Meta, error) {
-	r := s.preparedRead.QueryRow(s.key)
-	var serialized []byte
-	err := r.Scan(&serialized)
 
-	if errors.Is(err, sql.ErrNoRows) {
-		return NewMeta(), nil
-	} else if err != nil {
-		return nil, err
-	}
-	return UnserializeMeta(serialized)
-}
-func (s *SortedArraySqlTxStorage) SaveMeta(meta *Meta) error {
-	serialized, err := meta.Serialize()
+// ChunkBytes reads sizes of all chunk blobs of the array with a single query
+func (s *SortedArraySqlTxStorage) ChunkBytes() (map[uint32]int, error) {
+	prefix := s.blobKey(chunkBlobKey(0))
+	prefix = prefix[:len(prefix)-1] // without the id
+	pattern := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(string(prefix)) + "%"
+	rows, err := s.tx.Query(`SELECT key, length(chunk), substr(chunk, 1, ?) FROM sorted_array_chunks WHERE key LIKE ? ESCAPE '\'`, frameHeaderSize, pattern)
 	if err != nil {
-		return err
+		return nil, errors2.Wrap(err, "ChunkBytes:")
 	}
-	s.preparedUpsert.Exec(s.key, serialized)
-	return nil
+	defer rows.Close()
+	ret := make(map[uint32]int)
+	for rows.Next() {
+		var key, header []byte
+		var size int
+		err = rows.Scan(&key, &size, &header)
+		if err != nil {
+			return nil, errors2.Wrap(err, "ChunkBytes:")
+		}
+		// LIKE ignores case and matches meta pages (and meta of arrays with a longer key like "<key>_1") too
+		if !bytes.HasPrefix(key, prefix) {
+			continue
+		}
+		id, err := strconv.ParseUint(string(key[len(prefix):]), 10, 32)
+		kind := frameKind(header)
+		if err != nil || kind == frameKindMeta || kind == frameKindMetaSummary {
+			continue
+		}
+		ret[uint32(id)] = size
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors2.Wrap(err, "ChunkBytes:")
+	}
+	return ret, nil
 }
-func (a *SortedArraySqlTxStorage) chunkId(id uint32) []byte {
-	return []byte(fmt.Sprintf("%s_%d", a.key, id))
+
+// blobKey makes a key unique in the shared table: meta is stored under the array key, chunks under key_id
+func (s *SortedArraySqlTxStorage) blobKey(key string) []byte {
+	return []byte(fmt.Sprintf("%s%s", s.key, key))
 }
 
 func NewSqliteTxSortedArrayStorage(tx *sql.Tx, key []byte) *SortedArraySqlTxStorage {
@@ -156,11 +173,81 @@ func NewSqliteTxSortedArrayStorage(tx *sql.Tx, key []byte) *SortedArraySqlTxStor
 	if err != nil {
 		panic(err)
 	}
-	return &SortedArraySqlTxStorage{
+	s := &SortedArraySqlTxStorage{
 		key:            key,
 		tx:             tx,
 		preparedRemove: prepRemove,
 		preparedUpsert: prepWrite,
 		preparedRead:   prepRead,
 	}
+	s.BlobChunkStorage = NewBlobChunkStorage(s)
+	return s
+}
+
+// ListSqliteArrays returns keys of arrays stored in the shared table
+// arrays are recognized by their meta blobs, so arrays written before framing was introduced are not listed
+func ListSqliteArrays(tx *sql.Tx) ([]string, error) {
+	rows, err := tx.Query("SELECT key, substr(chunk, 1, ?) FROM sorted_array_chunks ORDER BY key", frameHeaderSize)
+	if err != nil {
+		return nil, errors2.Wrap(err, "ListSqliteArrays:")
+	}
+	defer rows.Close()
+	kinds := make(map[string]byte)
+	keys := make([]string, 0)
+	for rows.Next() {
+		var key, header []byte
+		err = rows.Scan(&key, &header)
+		if err != nil {
+			return nil, errors2.Wrap(err, "ListSqliteArrays:")
+		}
+		kind := frameKind(header)
+		if kind == frameKindMetaSummary || kind == frameKindMeta {
+			kinds[string(key)] = kind
+			keys = append(keys, string(key))
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors2.Wrap(err, "ListSqliteArrays:")
+	}
+	// meta pages are framed as meta too, those are stored under <array key>_m<page id>
+	arrays := make([]string, 0, len(keys))
+	for _, key := range keys {
+		pos := strings.LastIndex(key, "_m")
+		if kinds[key] == frameKindMeta && pos >= 0 && kinds[key[:pos]] == frameKindMetaSummary {
+			if _, err := strconv.ParseUint(key[pos+2:], 10, 32); err == nil {
+				continue
+			}
+		}
+		arrays = append(arrays, key)
+	}
+	return arrays, nil
+}
+
+// SqliteSavepoint implements GroupTx as a savepoint within the given transaction
+// so a group of arrays can be flushed atomically without committing the whole tx
+type SqliteSavepoint struct {
+	tx   *sql.Tx
+	name string
+}
+
+func (sp *SqliteSavepoint) Begin() error {
+	_, err := sp.tx.Exec("SAVEPOINT " + sp.name)
+	return err
+}
+func (sp *SqliteSavepoint) Commit() error {
+	_, err := sp.tx.Exec("RELEASE " + sp.name)
+	return err
+}
+func (sp *SqliteSavepoint) Rollback() error {
+	// ROLLBACK TO keeps the savepoint open, so release it afterwards
+	_, err := sp.tx.Exec("ROLLBACK TO " + sp.name)
+	if err != nil {
+		return err
+	}
+	_, err = sp.tx.Exec("RELEASE " + sp.name)
+	return err
+}
+
+func NewSqliteSavepoint(tx *sql.Tx, name string) *SqliteSavepoint {
+	return &SqliteSavepoint{tx, `"` + strings.ReplaceAll(name, `"`, `""`) + `"`} // quoted identifier
 }
@@ -18,9 +18,7 @@ func TestInMemoryChunkStorage(t *testing.T) {
 
 	// Read:
 	chunks, _ := storage.Read([]uint32{1, 2})
-	require.Equal(t, 2, len(chunks))
-	require.Nil(t, chunks[1])
-	require.Nil(t, chunks[2])
+	require.Empty(t, chunks)
 
 	// Write:
 	chunks[1] = NewChunk([]uint32{100, 200})
@@ -34,8 +32,8 @@ func TestInMemoryChunkStorage(t *testing.T) {
 	// Remove:
 	storage.Remove([]uint32{1})
 	chunks3, _ := storage.Read([]uint32{1, 2})
-	require.Equal(t, 2, len(chunks3))
-	require.Nil(t, chunks3[1])
+	require.Equal(t, 1, len(chunks3))
+	require.NotContains(t, chunks3, uint32(1))
 	require.EqualValues(t, chunks[2], chunks3[2])
 
 	// Meta:
@@ -96,6 +94,26 @@ func MakeSqliteDb() *sql.DB {
 	return db
 }
 
+func TestListSqliteArrays(t *testing.T) {
+	db := MakeSqliteDb()
+	defer db.Close()
+
+	tx, err := db.Begin()
+	require.NoError(t, err)
+	for _, key := range []string{"b", "a", "a_mx", "c_1"} {
+		storage := NewSqliteTxSortedArrayStorage(tx, []byte(key))
+		storage.metaPageSize = 1 // "a" gets meta pages a_m0, a_m1...
+		arr := NewSortedArray(2, storage)
+		require.NoError(t, arr.Add(sequence(0, 20, 1)))
+		require.NoError(t, arr.Flush())
+	}
+
+	keys, err := ListSqliteArrays(tx)
+	require.NoError(t, err)
+	require.EqualValues(t, []string{"a", "a_mx", "b", "c_1"}, keys)
+	require.NoError(t, tx.Commit())
+}
+
 func TestConcurrentWrites(t *testing.T) {
 	// Attempt to update index concurrently
 	db := MakeSqliteDb()
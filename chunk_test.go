@@ -42,7 +42,15 @@ func TestBasicAPI(t *testing.T) {
 	slice := chunk.GetInRange(0, 5)
 	require.EqualValues(t, []uint32{2, 3, 4, 5}, slice)
 
-	require.EqualValues(t, []uint32{2, 3, 4, 5, 6, 7, 8}, chunk.Items)
+	require.EqualValues(t, []uint32{2, 3, 4, 5, 6, 7, 8}, chunk.ToSlice())
+
+	input := []uint32{9, 1, 9}
+	NewChunk(nil).Add(input)
+	require.EqualValues(t, []uint32{9, 1, 9}, input) // the input is not changed
+
+	items := chunk.Items() // a copy
+	items[0] = 100
+	require.EqualValues(t, []uint32{2, 3, 4, 5, 6, 7, 8}, chunk.Items())
 }
 
 func TestAdd(t *testing.T) {
@@ -91,7 +99,7 @@ func TestAdd(t *testing.T) {
 			require.Equal(t, tt.expectedAdded, added)
 			added = chunk.Add(tt.addItems)
 			require.Equal(t, 0, added) // idempotency check
-			require.EqualValues(t, tt.expectedSlice, chunk.Items)
+			require.EqualValues(t, tt.expectedSlice, chunk.ToSlice())
 
 			// contains check
 			for _, item := range tt.addItems {
@@ -147,7 +155,7 @@ func TestRemove(t *testing.T) {
 			require.Equal(t, tt.expectedRemoved, added)
 			added = chunk.Remove(tt.removeItems) // idempotency
 			require.Equal(t, 0, added)
-			require.EqualValues(t, tt.expectedSlice, chunk.Items)
+			require.EqualValues(t, tt.expectedSlice, chunk.ToSlice())
 
 			// contains check
 			for _, item := range tt.removeItems {
@@ -163,5 +171,80 @@ func TestSerialize(t *testing.T) {
 	require.NoError(t, err)
 	chunk2, err := UnserializeChunk(s)
 	require.NoError(t, err)
-	require.EqualValues(t, chunk.Items, chunk2.Items)
+	require.EqualValues(t, chunk.ToSlice(), chunk2.ToSlice())
+}
+
+// FuzzChunkAddRemove applies adds and removals to a chunk and a reference set,
+// each op is 3 bytes: op kind, start, length (a run of items from a 12-bit space to hit all containers)
+func FuzzChunkAddRemove(f *testing.F) {
+	f.Add([]byte{0, 1, 10, 1, 3, 2})
+	f.Add([]byte{0, 0, 255, 1, 100, 20, 0, 7, 3})
+	f.Add([]byte{2, 0, 30, 0, 200, 40, 3, 50, 100})
+	f.Fuzz(func(t *testing.T, ops []byte) {
+		chunk := NewChunk(nil)
+		model := make(map[uint32]struct{})
+		for i := 0; i+2 < len(ops); i += 3 {
+			items := make([]uint32, 0, ops[i+2])
+			for j := 0; j < int(ops[i+2]); j++ {
+				items = append(items, (uint32(ops[i+1])*16+uint32(j)*uint32(ops[i]>>2+1))%4096)
+			}
+			if ops[i]&1 == 0 {
+				chunk.Add(items)
+				for _, item := range items {
+					model[item] = struct{}{}
+				}
+			} else {
+				chunk.Remove(items)
+				for _, item := range items {
+					delete(model, item)
+				}
+			}
+		}
+
+		expected := make([]uint32, 0, len(model))
+		for item := uint32(0); item < 4096; item++ {
+			_, found := model[item]
+			if found {
+				expected = append(expected, item)
+			}
+			require.Equal(t, found, chunk.Contains(item), "item %d", item)
+		}
+		require.Equal(t, expected, chunk.ToSlice())
+		require.Equal(t, len(expected), chunk.Len())
+		if len(expected) > 0 {
+			require.Equal(t, expected[0], chunk.Min())
+			require.Equal(t, expected[len(expected)-1], chunk.Max())
+		}
+
+		b, err := chunk.Serialize()
+		require.NoError(t, err)
+		chunk2, err := UnserializeChunk(b)
+		require.NoError(t, err)
+		require.Equal(t, expected, chunk2.ToSlice())
+	})
+}
+
+// FuzzUnserializeChunk makes sure damaged input is reported, not panicked on, and accepted input is a valid chunk
+func FuzzUnserializeChunk(f *testing.F) {
+	for _, items := range [][]uint32{nil, {1, 5, 100}, sequence(0, 1000, 3), sequence(0, 1000, 1)} {
+		b, err := NewChunk(items).Serialize()
+		require.NoError(f, err)
+		f.Add(b)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		chunk, err := UnserializeChunk(data)
+		if err != nil {
+			return
+		}
+		items := chunk.ToSlice()
+		require.Equal(t, len(items), chunk.Len())
+		for i := 1; i < len(items); i++ {
+			require.Less(t, items[i-1], items[i])
+		}
+		b, err := chunk.Serialize()
+		require.NoError(t, err)
+		chunk2, err := UnserializeChunk(b)
+		require.NoError(t, err)
+		require.Equal(t, items, chunk2.ToSlice())
+	})
 }
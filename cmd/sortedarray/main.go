@@ -0,0 +1,278 @@
+// Command sortedarray inspects and modifies sorted arrays kept in a SQLite database
+// (the sorted_array_chunks table used by NewSqliteTxSortedArrayStorage).
+//
+//	sortedarray ls <db>
+//	sortedarray stat [-chunk-size N] <db> <key>
+//	sortedarray dump [-range from..to] <db> <key>
+//	sortedarray add [-chunk-size N] <db> <key> [items...]      items are read from stdin if not given
+//	sortedarray delete [-chunk-size N] <db> <key> [items...]
+//	sortedarray validate <db> <key>
+//	sortedarray compact [-chunk-size N] <db> <key>
+//	sortedarray query <db> <query>                             keys are terms, e.g. "error AND api [100..200]"
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"flag"
+	"fmt"
+	sorted_array "github.com/lezhnev74/SortedArray"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/pkg/errors"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const usage = `usage: sortedarray <command> [flags] <db> [key] [items...]
+
+commands:
+  ls        list array keys
+  stat      show chunks layout
+  dump      print items, one per line (-range from..to)
+  add       add items (from args or stdin)
+  delete    delete items (from args or stdin)
+  validate  check the meta against chunks
+  compact   merge neighbour chunks while they fit into -chunk-size
+  query     print items matching a boolean query over keys, e.g. "error AND api NOT debug [100..200]"
+`
+
+func main() {
+	err := run(os.Args[1:], os.Stdin, os.Stdout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "sortedarray: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string, stdin io.Reader, stdout io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+	command := args[0]
+	switch command {
+	case "ls", "stat", "dump", "add", "delete", "validate", "compact", "query":
+	default:
+		return fmt.Errorf("unknown command %q\n%s", command, usage)
+	}
+	flags := flag.NewFlagSet(command, flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	chunkSize := flags.Uint("chunk-size", 1000, "max chunk size of the array")
+	itemsRange := flags.String("range", "", "dump items within from..to only")
+	err := flags.Parse(args[1:])
+	if err != nil {
+		return err
+	}
+	args = flags.Args()
+	if len(args) == 0 {
+		return fmt.Errorf("the database path is missing")
+	}
+	if *chunkSize == 0 || *chunkSize > math.MaxUint32 {
+		return fmt.Errorf("invalid chunk size %d", *chunkSize)
+	}
+	dbPath := args[0]
+	out := bufio.NewWriter(stdout)
+	defer out.Flush()
+
+	if command == "ls" {
+		return withTx(dbPath, true, func(tx *sql.Tx) error {
+			keys, err := sorted_array.ListSqliteArrays(tx)
+			for _, key := range keys {
+				fmt.Fprintln(out, key)
+			}
+			return err
+		})
+	}
+
+	if command == "query" {
+		if len(args) < 2 {
+			return fmt.Errorf("the query is missing")
+		}
+		return query(dbPath, uint32(*chunkSize), args[1], out)
+	}
+
+	if len(args) < 2 {
+		return fmt.Errorf("the array key is missing")
+	}
+	key := []byte(args[1])
+	readOnly := command == "stat" || command == "dump" || command == "validate"
+	return withTx(dbPath, readOnly, func(tx *sql.Tx) error {
+		arr := sorted_array.NewSortedArray(uint32(*chunkSize), sorted_array.NewSqliteTxSortedArrayStorage(tx, key))
+		switch command {
+		case "stat":
+			return stat(arr, uint32(*chunkSize), out)
+		case "dump":
+			from, to, err := parseRange(*itemsRange)
+			if err != nil {
+				return err
+			}
+			items, err := arr.GetInRange(from, to)
+			if err != nil {
+				return err
+			}
+			for item, ok := items.Next(); ok; item, ok = items.Next() {
+				fmt.Fprintln(out, item)
+			}
+			return sorted_array.StreamErr(items)
+		case "add", "delete":
+			items, err := parseItems(args[2:], stdin)
+			if err != nil {
+				return err
+			}
+			if command == "add" {
+				err = arr.Add(items)
+			} else {
+				err = arr.Delete(items)
+			}
+			if err != nil {
+				return err
+			}
+			return arr.Flush()
+		case "validate":
+			problems, err := arr.Validate()
+			if err != nil {
+				return err
+			}
+			for _, problem := range problems {
+				fmt.Fprintln(out, problem)
+			}
+			if len(problems) > 0 {
+				return fmt.Errorf("found %d problems", len(problems))
+			}
+			fmt.Fprintln(out, "ok")
+			return nil
+		default: // compact
+			return arr.Compact()
+		}
+	})
+}
+
+// withTx runs fn within a transaction, which is committed if fn succeeds
+func withTx(dbPath string, readOnly bool, fn func(tx *sql.Tx) error) error {
+	dsn := "file:" + dbPath + "?_txlock=immediate"
+	if readOnly {
+		dsn = "file:" + dbPath + "?mode=ro"
+	}
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if !readOnly {
+		_, err = db.Exec("CREATE TABLE IF NOT EXISTS sorted_array_chunks (key text PRIMARY KEY, chunk BLOB)")
+		if err != nil {
+			return errors.Wrap(err, "unable to create the table")
+		}
+	}
+	var table string
+	err = db.QueryRow("SELECT name FROM sqlite_master WHERE type='table' AND name='sorted_array_chunks'").Scan(&table)
+	if err != nil {
+		return errors.Wrapf(err, "no sorted_array_chunks table in %s", dbPath)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	err = fn(tx)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// query prints items matching the query, array keys are terms
+func query(dbPath string, chunkSize uint32, s string, out io.Writer) error {
+	parsed, err := sorted_array.ParseQuery(s)
+	var queryErr *sorted_array.QueryError
+	if errors.As(err, &queryErr) {
+		return fmt.Errorf("%s\n  %s\n  %s^", queryErr.Msg, s, strings.Repeat(" ", queryErr.Pos))
+	} else if err != nil {
+		return err
+	}
+	return withTx(dbPath, true, func(tx *sql.Tx) error {
+		items, err := sorted_array.Evaluate(parsed.Query, func(term string) *sorted_array.SortedArray {
+			return sorted_array.NewSortedArray(chunkSize, sorted_array.NewSqliteTxSortedArrayStorage(tx, []byte(term)))
+		}, parsed.Min, parsed.Max)
+		if err != nil {
+			return err
+		}
+		for item, ok := items.Next(); ok; item, ok = items.Next() {
+			fmt.Fprintln(out, item)
+		}
+		return sorted_array.StreamErr(items)
+	})
+}
+
+// stat prints the chunks layout computed from the meta
+func stat(arr *sorted_array.SortedArray, chunkSize uint32, out io.Writer) error {
+	stats, err := arr.Stats()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "chunks: %d\n", stats.Chunks)
+	if stats.Chunks == 0 {
+		return nil
+	}
+	chunks, err := arr.Chunks()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "items: %d [%d..%d]\n", stats.Items, chunks[0].Min(), chunks[len(chunks)-1].Max())
+	fmt.Fprintf(out, "chunk size: min %d, max %d, avg %.1f (of %d)\n", stats.MinChunkSize, stats.MaxChunkSize, stats.AvgChunkSize, chunkSize)
+	fmt.Fprintf(out, "serialized: %d bytes, %.1f per chunk\n", stats.TotalBytes, float64(stats.TotalBytes)/float64(stats.Chunks))
+	fmt.Fprintln(out, "fill histogram:")
+	for i, count := range stats.FillHistogram {
+		fmt.Fprintf(out, "  %3d-%3d%%: %d\n", i*10, (i+1)*10, count)
+	}
+	return nil
+}
+
+// parseRange parses "from..to", an empty range means all items
+func parseRange(s string) (from, to uint32, err error) {
+	if s == "" {
+		return 0, math.MaxUint32, nil
+	}
+	parts := strings.Split(s, "..")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid range %q, expected from..to", s)
+	}
+	f, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "invalid range %q", s)
+	}
+	t, err := strconv.ParseUint(parts[1], 10, 32)
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "invalid range %q", s)
+	}
+	if f > t {
+		return 0, 0, fmt.Errorf("invalid range %q, from > to", s)
+	}
+	return uint32(f), uint32(t), nil
+}
+
+// parseItems parses items from args, or from r (separated by whitespace) if there are no args
+func parseItems(args []string, r io.Reader) ([]uint32, error) {
+	if len(args) == 0 {
+		scanner := bufio.NewScanner(r)
+		scanner.Split(bufio.ScanWords)
+		for scanner.Scan() {
+			args = append(args, scanner.Text())
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	items := make([]uint32, 0, len(args))
+	for _, arg := range args {
+		item, err := strconv.ParseUint(arg, 10, 32)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid item %q", arg)
+		}
+		items = append(items, uint32(item))
+	}
+	return items, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	sorted_array "github.com/lezhnev74/SortedArray"
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func exec(t *testing.T, stdin string, args ...string) (string, error) {
+	var out bytes.Buffer
+	err := run(args, strings.NewReader(stdin), &out)
+	return out.String(), err
+}
+
+func TestCommands(t *testing.T) {
+	db := filepath.Join(t.TempDir(), "test.db")
+
+	_, err := exec(t, "", "ls", db)
+	require.ErrorContains(t, err, "no sorted_array_chunks table")
+
+	_, err = exec(t, "", "add", "-chunk-size", "3", db, "term1", "1", "2", "3", "4", "5", "6", "7")
+	require.NoError(t, err)
+	_, err = exec(t, "10 20\n30", "add", "-chunk-size", "3", db, "term2")
+	require.NoError(t, err)
+	_, err = exec(t, "", "delete", "-chunk-size", "3", db, "term1", "2", "3")
+	require.NoError(t, err)
+
+	out, err := exec(t, "", "ls", db)
+	require.NoError(t, err)
+	require.Equal(t, "term1\nterm2\n", out)
+
+	out, err = exec(t, "", "dump", db, "term1")
+	require.NoError(t, err)
+	require.Equal(t, "1\n4\n5\n6\n7\n", out)
+	out, err = exec(t, "", "dump", "-range", "2..5", db, "term1")
+	require.NoError(t, err)
+	require.Equal(t, "4\n5\n", out)
+
+	out, err = exec(t, "", "stat", "-chunk-size", "3", db, "term2")
+	require.NoError(t, err)
+	require.Contains(t, out, "items: 3 [10..30]")
+
+	_, err = exec(t, "", "compact", "-chunk-size", "10", db, "term1")
+	require.NoError(t, err)
+	out, err = exec(t, "", "stat", "-chunk-size", "10", db, "term1")
+	require.NoError(t, err)
+	require.Contains(t, out, "chunks: 1\n")
+
+	out, err = exec(t, "", "validate", db, "term1")
+	require.NoError(t, err)
+	require.Equal(t, "ok\n", out)
+
+	out, err = exec(t, "", "query", db, "term1 OR term2 NOT term3 [5..20]")
+	require.NoError(t, err)
+	require.Equal(t, "5\n6\n7\n10\n20\n", out)
+	_, err = exec(t, "", "query", db, "term1 OR")
+	require.ErrorContains(t, err, "unexpected end of query\n  term1 OR\n          ^")
+
+	// a damaged chunk fails the query, not just cuts the output short
+	conn, err := sql.Open("sqlite3", db)
+	require.NoError(t, err)
+	_, err = conn.Exec("UPDATE sorted_array_chunks SET chunk = zeroblob(16) WHERE key = ?", []byte("term2_0")) // the chunk of term2
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+	_, err = exec(t, "", "query", db, "term1 OR term2 [5..20]")
+	require.ErrorAs(t, err, new(*sorted_array.ErrCorrupted))
+
+	_, err = exec(t, "", "add", db, "term1", "abc")
+	require.ErrorContains(t, err, "invalid item")
+	_, err = exec(t, "", "unknown", db, "term1")
+	require.ErrorContains(t, err, "unknown command")
+}
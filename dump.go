@@ -0,0 +1,180 @@
+package sorted_array
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+)
+
+// A dump is a self-describing stream of chunks, used for backups:
+//
+//	header:  magic "SADUMP" | version (1 byte) | uvarint maxChunkSize
+//	chunk:   1 (1 byte) | uvarint len(blob) | blob (a serialized chunk, compressed and framed with CRC32C)
+//	trailer: 0 (1 byte) | uvarint chunks count | uvarint items count
+//
+// Chunks follow in asc order, so a dump is written and restored one chunk at a time.
+const (
+	dumpVersion      = 1
+	dumpRecordEnd    = 0
+	dumpRecordChunk  = 1
+	dumpMaxBlobSize  = 1 << 30 // larger blobs mean a damaged dump
+	restoreBatchSize = 64      // chunks to flush at once while restoring
+)
+
+var dumpMagic = []byte("SADUMP")
+
+// Dump writes all items of the array (including pending changes) to w
+func (a *SortedArray) Dump(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	header := append([]byte(nil), dumpMagic...)
+	header = append(header, dumpVersion)
+	header = binary.AppendUvarint(header, uint64(a.maxChunkSize))
+	_, err := bw.Write(header)
+	if err != nil {
+		return errors.Wrap(err, "unable to write dump header")
+	}
+
+	chunks, items := 0, 0
+	err = a.eachChunk(func(chunk *Chunk) error {
+		blob, err := chunk.Serialize()
+		if err != nil {
+			return err
+		}
+		record := binary.AppendUvarint([]byte{dumpRecordChunk}, uint64(len(blob)))
+		_, err = bw.Write(append(record, blob...))
+		chunks, items = chunks+1, items+chunk.Len()
+		return err
+	})
+	if err != nil {
+		return errors.Wrap(err, "unable to dump chunks")
+	}
+
+	trailer := binary.AppendUvarint([]byte{dumpRecordEnd}, uint64(chunks))
+	trailer = binary.AppendUvarint(trailer, uint64(items))
+	_, err = bw.Write(trailer)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		return errors.Wrap(err, "unable to write dump trailer")
+	}
+	return nil
+}
+
+// Restore reads a dump into the storage which must not contain an array yet
+// chunks are flushed in batches, so the dump may be larger than memory
+// if restoring fails midway, the storage keeps the chunks restored so far
+func Restore(r io.Reader, storage ChunkStorage, opts ...ArrayOption) (*SortedArray, error) {
+	return RestoreWithChunkSize(r, 0, storage, opts...)
+}
+
+// RestoreWithChunkSize is Restore into an array of another max chunk size (0 keeps the dump's one),
+// larger chunks of the dump are split
+func RestoreWithChunkSize(r io.Reader, maxChunkSize uint32, storage ChunkStorage, opts ...ArrayOption) (*SortedArray, error) {
+	br := bufio.NewReader(r)
+
+	// 1. Read the header
+	header := make([]byte, len(dumpMagic)+1)
+	_, err := io.ReadFull(br, header)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read dump header")
+	}
+	if !bytes.Equal(header[:len(dumpMagic)], dumpMagic) {
+		return nil, fmt.Errorf("not a dump")
+	}
+	if header[len(dumpMagic)] != dumpVersion {
+		return nil, fmt.Errorf("unsupported dump version %d", header[len(dumpMagic)])
+	}
+	dumpChunkSize, err := binary.ReadUvarint(br)
+	if err != nil || dumpChunkSize == 0 || dumpChunkSize > 1<<32-1 {
+		return nil, fmt.Errorf("unexpected max chunk size")
+	}
+	if maxChunkSize == 0 {
+		maxChunkSize = uint32(dumpChunkSize)
+	}
+
+	arr := NewSortedArray(maxChunkSize, storage, opts...)
+	err = arr.initMeta()
+	if err == nil {
+		err = arr.meta.loadAll()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(arr.meta.chunks) > 0 {
+		return nil, fmt.Errorf("the storage already contains an array")
+	}
+
+	// 2. Read chunks, they are put to the array as is (split if larger than the array's chunks)
+	chunks, items := uint64(0), uint64(0)
+	for {
+		kind, err := br.ReadByte()
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to read dump record")
+		}
+		if kind == dumpRecordEnd {
+			break
+		}
+		if kind != dumpRecordChunk {
+			return nil, fmt.Errorf("unexpected dump record %d", kind)
+		}
+		size, err := binary.ReadUvarint(br)
+		if err != nil || size > dumpMaxBlobSize {
+			return nil, fmt.Errorf("unexpected chunk size")
+		}
+		blob := make([]byte, size)
+		_, err = io.ReadFull(br, blob)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to read chunk %d", chunks)
+		}
+		chunk, err := UnserializeChunk(blob)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to read chunk %d", chunks)
+		}
+		n := len(arr.meta.chunks)
+		if chunk.Len() == 0 || (n > 0 && arr.meta.chunks[n-1].max >= chunk.Min()) {
+			return nil, fmt.Errorf("chunk %d is out of order", chunks)
+		}
+		chunks, items = chunks+1, items+uint64(chunk.Len())
+
+		for chunk != nil {
+			var tail *Chunk
+			if uint32(chunk.Len()) > maxChunkSize {
+				tail = chunk.splitAt(int(maxChunkSize))
+			}
+			id := arr.meta.TakeNextId()
+			arr.meta.Add([]*ChunkMeta{{id, chunk.Min(), chunk.Max(), uint32(chunk.Len())}})
+			arr.loadedChunks[id] = chunk
+			arr.dirtyChunks[id] = struct{}{}
+			chunk = tail
+		}
+		arr.dirtyMeta = true
+		if len(arr.dirtyChunks) >= restoreBatchSize {
+			err = arr.Flush()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// 3. Verify the trailer
+	expectedChunks, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read dump trailer")
+	}
+	expectedItems, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read dump trailer")
+	}
+	if expectedChunks != chunks || expectedItems != items {
+		return nil, fmt.Errorf("dump has %d chunks (%d items), expected %d (%d items)", chunks, items, expectedChunks, expectedItems)
+	}
+	err = arr.Flush()
+	if err != nil {
+		return nil, err
+	}
+	return arr, nil
+}
@@ -0,0 +1,90 @@
+package sorted_array
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/exp/rand"
+	"golang.org/x/exp/slices"
+	"testing"
+)
+
+func TestDumpRestore(t *testing.T) {
+	items := make([]uint32, 0)
+	for i := 0; i < 10_000; i++ {
+		items = append(items, uint32(rand.Intn(1_000_000)))
+	}
+	items = append(items, sequence(2_000_000, 2_010_000, 1)...)
+	slices.Sort(items)
+	items = slices.Compact(items)
+
+	arr := NewSortedArray(100, NewInMemoryChunkStorage())
+	require.NoError(t, arr.Add(slices.Clone(items)))
+	require.NoError(t, arr.Flush())
+	require.NoError(t, arr.Delete([]uint32{2_000_000})) // pending changes are dumped too
+	pos, _ := slices.BinarySearch(items, 2_000_000)
+	items = slices.Delete(items, pos, pos+1)
+
+	var dump bytes.Buffer
+	require.NoError(t, arr.Dump(&dump))
+
+	storage := NewBlobChunkStorage(NewInMemoryBlobStorage())
+	restored, err := Restore(bytes.NewReader(dump.Bytes()), storage, WithChunkFilters(10))
+	require.NoError(t, err)
+	require.EqualValues(t, items, restored.ToSlice())
+	require.EqualValues(t, items, NewSortedArray(100, storage).ToSlice())
+	require.Len(t, restored.meta.filters, len(restored.meta.chunks))
+
+	// the storage is not empty anymore
+	_, err = Restore(bytes.NewReader(dump.Bytes()), storage)
+	require.ErrorContains(t, err, "already contains an array")
+}
+
+func TestDumpEmptyArray(t *testing.T) {
+	var dump bytes.Buffer
+	require.NoError(t, NewSortedArray(10, NewInMemoryChunkStorage()).Dump(&dump))
+
+	restored, err := Restore(&dump, NewInMemoryChunkStorage())
+	require.NoError(t, err)
+	require.Empty(t, restored.ToSlice())
+	require.EqualValues(t, 10, restored.maxChunkSize)
+}
+
+func TestRestoreDamagedDump(t *testing.T) {
+	arr := NewSortedArray(10, NewInMemoryChunkStorage())
+	require.NoError(t, arr.Add(sequence(0, 100, 3)))
+	var dump bytes.Buffer
+	require.NoError(t, arr.Dump(&dump))
+	data := dump.Bytes()
+
+	_, err := Restore(bytes.NewReader(data[:len(data)-3]), NewInMemoryChunkStorage())
+	require.Error(t, err)
+	_, err = Restore(bytes.NewReader([]byte("SQLite format 3")), NewInMemoryChunkStorage())
+	require.ErrorContains(t, err, "not a dump")
+
+	for i := range data { // any damage is detected
+		damaged := slices.Clone(data)
+		damaged[i] ^= 0xff
+		_, err = Restore(bytes.NewReader(damaged), NewInMemoryChunkStorage())
+		require.Error(t, err, "byte %d", i)
+	}
+}
+
+func TestRestoreWithSmallerChunks(t *testing.T) {
+	items := sequence(0, 1000, 2)
+	arr := NewSortedArray(100, NewInMemoryChunkStorage())
+	require.NoError(t, arr.Add(slices.Clone(items)))
+	var dump bytes.Buffer
+	require.NoError(t, arr.Dump(&dump))
+
+	storage := NewInMemoryChunkStorage()
+	restored, err := RestoreWithChunkSize(bytes.NewReader(dump.Bytes()), 30, storage)
+	require.NoError(t, err)
+	require.EqualValues(t, 30, restored.maxChunkSize)
+	require.EqualValues(t, items, restored.ToSlice())
+	for _, cm := range restored.meta.chunks {
+		require.LessOrEqual(t, cm.size, uint32(30))
+	}
+	problems, err := NewSortedArray(30, storage).Validate()
+	require.NoError(t, err)
+	require.Empty(t, problems)
+}
@@ -0,0 +1,119 @@
+package sorted_array
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+)
+
+// EncryptionKey is an AES key (16, 24 or 32 bytes long)
+// the id is written to every blob header, so blobs encrypted with older keys can still be read after rotation
+type EncryptionKey struct {
+	Id  uint32
+	Key []byte
+}
+
+// EncryptedBlobStorage encrypts blobs with AES-GCM before they reach the inner storage
+// blob layout: key id (4 bytes) | nonce | ciphertext+tag
+// the blob key is used as additional data, so a blob can't be moved to another key unnoticed
+type EncryptedBlobStorage struct {
+	inner   BlobStorage
+	current uint32                 // new blobs are encrypted with this key
+	ciphers map[uint32]cipher.AEAD // all known keys for decryption
+}
+
+func (s *EncryptedBlobStorage) ReadBlobs(keys []string) (map[string][]byte, error) {
+	blobs, err := s.inner.ReadBlobs(keys)
+	if err != nil {
+		return nil, err
+	}
+	plain := make(map[string][]byte, len(blobs))
+	for key, blob := range blobs {
+		plain[key], err = s.decrypt(key, blob)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return plain, nil
+}
+
+func (s *EncryptedBlobStorage) SaveBlobs(blobs map[string][]byte) error {
+	encrypted := make(map[string][]byte, len(blobs))
+	for key, blob := range blobs {
+		var err error
+		encrypted[key], err = s.encrypt(key, blob)
+		if err != nil {
+			return err
+		}
+	}
+	return s.inner.SaveBlobs(encrypted)
+}
+
+func (s *EncryptedBlobStorage) RemoveBlobs(keys []string) error { return s.inner.RemoveBlobs(keys) }
+
+func (s *EncryptedBlobStorage) encrypt(key string, blob []byte) ([]byte, error) {
+	aead := s.ciphers[s.current]
+	out := make([]byte, 4+aead.NonceSize(), 4+aead.NonceSize()+len(blob)+aead.Overhead())
+	binary.BigEndian.PutUint32(out, s.current)
+	nonce := out[4:]
+	_, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to make a nonce")
+	}
+	return aead.Seal(out, nonce, blob, []byte(key)), nil
+}
+
+func (s *EncryptedBlobStorage) decrypt(key string, blob []byte) ([]byte, error) {
+	if len(blob) < 4 {
+		return nil, &errCorruptedBlob{key, "encrypted blob is too short"}
+	}
+	keyId := binary.BigEndian.Uint32(blob)
+	aead, ok := s.ciphers[keyId]
+	if !ok {
+		return nil, fmt.Errorf("blob %q is encrypted with unknown key %d", key, keyId)
+	}
+	if len(blob) < 4+aead.NonceSize() {
+		return nil, &errCorruptedBlob{key, "encrypted blob is too short"}
+	}
+	nonce, ciphertext := blob[4:4+aead.NonceSize()], blob[4+aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, ciphertext, []byte(key))
+	if err != nil {
+		return nil, &errCorruptedBlob{key, fmt.Sprintf("unable to decrypt: %s", err)}
+	}
+	return plain, nil
+}
+
+// NewEncryptedBlobStorage encrypts new blobs with the current key
+// older keys are only used to decrypt blobs written before rotation
+func NewEncryptedBlobStorage(inner BlobStorage, current EncryptionKey, older ...EncryptionKey) (*EncryptedBlobStorage, error) {
+	s := &EncryptedBlobStorage{
+		inner:   inner,
+		current: current.Id,
+		ciphers: make(map[uint32]cipher.AEAD, len(older)+1),
+	}
+	keys := append(append([]EncryptionKey{}, older...), current) // current wins on id clash
+	for _, k := range keys {
+		block, err := aes.NewCipher(k.Key)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid key %d", k.Id)
+		}
+		s.ciphers[k.Id], err = cipher.NewGCM(block)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid key %d", k.Id)
+		}
+	}
+	return s, nil
+}
+
+// NewEncryptedChunkStorage makes a ChunkStorage that keeps chunks and meta encrypted in the inner storage
+func NewEncryptedChunkStorage(inner BlobStorage, current EncryptionKey, older ...EncryptionKey) (*BlobChunkStorage, error) {
+	blobs, err := NewEncryptedBlobStorage(inner, current, older...)
+	if err != nil {
+		return nil, err
+	}
+	return NewBlobChunkStorage(blobs), nil
+}
@@ -0,0 +1,76 @@
+package sorted_array
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestEncryptedStorage(t *testing.T) {
+	key1 := EncryptionKey{1, bytes.Repeat([]byte{1}, 32)}
+	blobs := NewInMemoryBlobStorage()
+	storage, err := NewEncryptedChunkStorage(blobs, key1)
+	require.NoError(t, err)
+
+	arr := NewSortedArray(2, storage)
+	require.NoError(t, arr.Add([]uint32{10, 20, 30, 40, 50}))
+	require.NoError(t, arr.Flush())
+	require.EqualValues(t, []uint32{10, 20, 30, 40, 50}, NewSortedArray(2, storage).ToSlice())
+
+	// nothing readable is left in the inner storage
+	plain := NewBlobChunkStorage(blobs)
+	_, err = plain.ReadMeta()
+	require.Error(t, err)
+	_, err = plain.Read([]uint32{0})
+	require.Error(t, err)
+}
+
+func TestEncryptedStorageKeyRotation(t *testing.T) {
+	key1 := EncryptionKey{1, bytes.Repeat([]byte{1}, 32)}
+	key2 := EncryptionKey{2, bytes.Repeat([]byte{2}, 16)}
+	blobs := NewInMemoryBlobStorage()
+
+	storage1, err := NewEncryptedChunkStorage(blobs, key1)
+	require.NoError(t, err)
+	arr := NewSortedArray(2, storage1)
+	require.NoError(t, arr.Add([]uint32{10, 20, 30}))
+	require.NoError(t, arr.Flush())
+
+	// the new key writes, the old one still reads untouched blobs
+	storage2, err := NewEncryptedChunkStorage(blobs, key2, key1)
+	require.NoError(t, err)
+	arr = NewSortedArray(2, storage2)
+	require.NoError(t, arr.Add([]uint32{40}))
+	require.NoError(t, arr.Flush())
+	require.EqualValues(t, []uint32{10, 20, 30, 40}, NewSortedArray(2, storage2).ToSlice())
+
+	// without the old key some blobs can't be read
+	storage3, err := NewEncryptedChunkStorage(blobs, key2)
+	require.NoError(t, err)
+	_, err = storage3.Read([]uint32{0})
+	require.ErrorContains(t, err, "unknown key 1")
+}
+
+func TestEncryptedStorageDetectsTampering(t *testing.T) {
+	key1 := EncryptionKey{1, bytes.Repeat([]byte{1}, 32)}
+	blobs := NewInMemoryBlobStorage()
+	storage, err := NewEncryptedChunkStorage(blobs, key1)
+	require.NoError(t, err)
+	require.NoError(t, storage.Save(map[uint32]*Chunk{1: NewChunk([]uint32{1}), 2: NewChunk([]uint32{2})}))
+
+	// a blob moved to another key is rejected
+	blobs.blobs[chunkBlobKey(2)] = blobs.blobs[chunkBlobKey(1)]
+	_, err = storage.Read([]uint32{2})
+	require.Error(t, err)
+
+	// a flipped bit is rejected
+	blob := blobs.blobs[chunkBlobKey(1)]
+	blob[len(blob)-1] ^= 1
+	_, err = storage.Read([]uint32{1})
+	require.Error(t, err)
+}
+
+func TestEncryptedStorageInvalidKey(t *testing.T) {
+	_, err := NewEncryptedChunkStorage(NewInMemoryBlobStorage(), EncryptionKey{1, []byte("short")})
+	require.Error(t, err)
+}
@@ -0,0 +1,80 @@
+package sorted_array
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+)
+
+// Serialized chunks and meta are framed to detect corruption (truncated or damaged blobs):
+// magic (2 bytes) | version (1 byte) | kind (1 byte) | CRC32C of the payload (4 bytes) | payload
+// Blobs without the magic were written before framing was introduced and are decoded as is.
+const (
+	frameVersion    = 1
+	frameHeaderSize = 8
+
+	frameKindChunk = 1
+	frameKindMeta  = 2
+	// frameKindMetaSummary is a list of meta pages, each page is framed as meta
+	frameKindMetaSummary = 3
+	// frameKindContainerChunk is a chunk in its container encoding, frameKindChunk is a legacy gob-encoded chunk
+	frameKindContainerChunk = 4
+)
+
+var (
+	frameMagic = []byte("SA")
+	crcTable   = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// ErrCorrupted is returned when a stored blob can't be trusted
+type ErrCorrupted struct {
+	ChunkId uint32 // the damaged chunk (if Meta is false)
+	Meta    bool   // the meta blob is damaged
+	Reason  string
+}
+
+func (e *ErrCorrupted) Error() string {
+	if e.Meta {
+		return fmt.Sprintf("meta is corrupted: %s", e.Reason)
+	}
+	return fmt.Sprintf("chunk %d is corrupted: %s", e.ChunkId, e.Reason)
+}
+
+func frame(kind byte, payload []byte) []byte {
+	out := make([]byte, frameHeaderSize, frameHeaderSize+len(payload))
+	copy(out, frameMagic)
+	out[2] = frameVersion
+	out[3] = kind
+	binary.BigEndian.PutUint32(out[4:], crc32.Checksum(payload, crcTable))
+	return append(out, payload...)
+}
+
+// frameKind returns the kind of the framed blob, 0 for legacy unframed blobs
+func frameKind(data []byte) byte {
+	if !bytes.HasPrefix(data, frameMagic) || len(data) < frameHeaderSize {
+		return 0
+	}
+	return data[3]
+}
+
+// unframe verifies the frame and returns its payload
+func unframe(kind byte, data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, frameMagic) {
+		return data, nil // legacy unframed blob
+	}
+	if len(data) < frameHeaderSize {
+		return nil, fmt.Errorf("frame header is truncated")
+	}
+	if data[2] != frameVersion {
+		return nil, fmt.Errorf("unsupported frame version %d", data[2])
+	}
+	if data[3] != kind {
+		return nil, fmt.Errorf("unexpected frame kind %d", data[3])
+	}
+	payload := data[frameHeaderSize:]
+	if binary.BigEndian.Uint32(data[4:]) != crc32.Checksum(payload, crcTable) {
+		return nil, fmt.Errorf("checksum mismatch")
+	}
+	return payload, nil
+}
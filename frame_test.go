@@ -0,0 +1,122 @@
+package sorted_array
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"github.com/ronanh/intcomp"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestCorruptedChunkDetection(t *testing.T) {
+	chunk := NewChunk([]uint32{1, 2, 3})
+	s, err := chunk.Serialize()
+	require.NoError(t, err)
+
+	type test struct {
+		name string
+		data []byte
+	}
+	flipped := append([]byte(nil), s...)
+	flipped[len(flipped)-1] ^= 1
+	tests := []test{
+		{"truncated payload", s[:len(s)-3]},
+		{"truncated header", s[:5]},
+		{"flipped bit", flipped},
+		{"empty", []byte{}},
+		{"garbage", []byte("garbage")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := UnserializeChunk(tt.data)
+			var corrupted *ErrCorrupted
+			require.True(t, errors.As(err, &corrupted))
+		})
+	}
+}
+
+func TestCorruptedMetaDetection(t *testing.T) {
+	meta := NewMeta()
+	meta.Add([]*ChunkMeta{{meta.TakeNextId(), 1, 10, 5}})
+	s, err := meta.Serialize()
+	require.NoError(t, err)
+
+	for _, data := range [][]byte{s[:len(s)-1], s[:3], {}} {
+		_, err = UnserializeMeta(data)
+		var corrupted *ErrCorrupted
+		require.True(t, errors.As(err, &corrupted))
+		require.True(t, corrupted.Meta)
+	}
+
+	// a chunk blob is not accepted as meta
+	chunkBlob, err := NewChunk([]uint32{1}).Serialize()
+	require.NoError(t, err)
+	_, err = UnserializeMeta(chunkBlob)
+	require.ErrorContains(t, err, "unexpected frame kind")
+}
+
+func TestDamagedMetaColumns(t *testing.T) {
+	two := intcomp.CompressUint32([]uint32{1, 2}, nil)
+	one := intcomp.CompressUint32([]uint32{1}, nil)
+	tests := []struct {
+		name  string
+		state [][]uint32
+	}{
+		{"broken block", [][]uint32{{1}, {5, 3, 0xdeadbeef}, {}, {}, {}}},
+		{"columns of different lengths", [][]uint32{{2}, two, one, two, two}},
+		{"chunks out of order", [][]uint32{{2}, two, intcomp.CompressUint32([]uint32{5, 1}, nil), two, two}},
+		{"filters of another length", [][]uint32{{2}, two, one, two, two, one, {1}}},
+		{"extra filter words", [][]uint32{{2}, two, intcomp.CompressUint32([]uint32{1, 3}, nil), two, two, intcomp.CompressUint32([]uint32{1, 0}, nil), {1, 2}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var legacy bytes.Buffer // unframed blobs are taken as legacy ones
+			require.NoError(t, gob.NewEncoder(&legacy).Encode(tt.state))
+			_, err := UnserializeMeta(legacy.Bytes())
+			var corrupted *ErrCorrupted
+			require.True(t, errors.As(err, &corrupted), "%v", err)
+			require.True(t, corrupted.Meta)
+		})
+	}
+}
+
+func TestDamagedSummaryColumns(t *testing.T) {
+	two := intcomp.CompressUint32([]uint32{1, 2}, nil)
+	one := intcomp.CompressUint32([]uint32{1}, nil)
+	for _, state := range [][][]uint32{
+		{{1, 1}, {5, 3, 0xdeadbeef}, {}, {}},
+		{{1, 1}, two, one, two},
+		{{1, 1}, two, two, two, two, two, two, two, two, one}, // fill of pages stats is too short
+	} {
+		var b bytes.Buffer
+		require.NoError(t, gob.NewEncoder(&b).Encode(state))
+		_, err := unserializeSummary(frame(frameKindMetaSummary, b.Bytes()))
+		var corrupted *ErrCorrupted
+		require.True(t, errors.As(err, &corrupted), "%v", err)
+	}
+}
+
+func TestLegacyUnframedChunk(t *testing.T) {
+	var legacy bytes.Buffer
+	require.NoError(t, gob.NewEncoder(&legacy).Encode(struct{ Items []uint32 }{[]uint32{1, 2, 3}})) // the layout before containers
+
+	chunk, err := UnserializeChunk(legacy.Bytes())
+	require.NoError(t, err)
+	require.EqualValues(t, []uint32{1, 2, 3}, chunk.ToSlice())
+}
+
+func TestCorruptedChunkCarriesId(t *testing.T) {
+	blobs := NewInMemoryBlobStorage()
+	storage := NewBlobChunkStorage(blobs)
+	require.NoError(t, storage.Save(map[uint32]*Chunk{7: NewChunk([]uint32{1, 2, 3})}))
+	blobs.blobs[chunkBlobKey(7)] = blobs.blobs[chunkBlobKey(7)][:10]
+
+	_, err := storage.Read([]uint32{7})
+	var corrupted *ErrCorrupted
+	require.True(t, errors.As(err, &corrupted))
+	require.EqualValues(t, 7, corrupted.ChunkId)
+	require.Equal(t, fmt.Sprintf("chunk 7 is corrupted: %s", corrupted.Reason), err.Error())
+}
@@ -8,3 +8,17 @@ func contains[T comparable](elems []T, v T) bool {
 	}
 	return false
 }
+
+// bounds returns min and max of a non-empty unsorted slice
+func bounds(items []uint32) (min, max uint32) {
+	min, max = items[0], items[0]
+	for _, item := range items[1:] {
+		if item < min {
+			min = item
+		}
+		if item > max {
+			max = item
+		}
+	}
+	return
+}
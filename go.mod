@@ -4,6 +4,8 @@ go 1.20
 
 require (
 	github.com/lezhnev74/SetOperationsOnSortedNumericStreams v0.0.0-20230619132843-6c92901e2494
+	github.com/mattn/go-sqlite3 v1.14.17
+	github.com/pkg/errors v0.9.1
 	github.com/ronanh/intcomp v1.1.0
 	github.com/stretchr/testify v1.8.4
 	golang.org/x/exp v0.0.0-20230522175609-2e198f4a06a1
@@ -11,8 +13,6 @@ require (
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
-	github.com/mattn/go-sqlite3 v1.14.17 // indirect
-	github.com/pkg/errors v0.9.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
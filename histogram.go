@@ -0,0 +1,52 @@
+package sorted_array
+
+import (
+	"fmt"
+)
+
+const maxHistogramBuckets = 1 << 24
+
+// Histogram counts items within [min,max] per bucket of bucketWidth values starting from min,
+// e.g. events per hour for unix timestamps: Histogram(from, to, 3600)
+// chunks that fall into one bucket are counted by meta, only chunks spanning bucket boundaries are read
+func (a *SortedArray) Histogram(min, max, bucketWidth uint32) ([]uint64, error) {
+	if bucketWidth == 0 || min > max {
+		return nil, fmt.Errorf("invalid histogram [%d,%d] by %d", min, max, bucketWidth)
+	}
+	n := uint64(max-min)/uint64(bucketWidth) + 1
+	if n > maxHistogramBuckets {
+		return nil, fmt.Errorf("too many buckets: %d", n)
+	}
+	err := a.initMeta()
+	if err == nil {
+		err = a.meta.load(min, max)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	buckets := make([]uint64, n)
+	bucket := func(item uint32) uint32 { return (item - min) / bucketWidth }
+	var items []uint32
+	for _, cm := range a.meta.FindRelevantForReadRange(min, max) {
+		// 1. The chunk is within one bucket
+		if cm.min >= min && cm.max <= max && bucket(cm.min) == bucket(cm.max) {
+			buckets[bucket(cm.min)] += uint64(cm.size)
+			continue
+		}
+		// 2. Count items one by one
+		chunk, err := a.readChunk(cm)
+		if err != nil {
+			return nil, err
+		}
+		if chunk == nil {
+			continue // skipped as corrupted
+		}
+		items = chunk.appendInRange(items[:0], min, max)
+		a.releaseChunks([]uint32{cm.id})
+		for _, item := range items {
+			buckets[bucket(item)]++
+		}
+	}
+	return buckets, nil
+}
@@ -0,0 +1,75 @@
+package sorted_array
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/exp/rand"
+	"math"
+	"testing"
+)
+
+func TestHistogram(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	arr := NewSortedArray(10, NewInMemoryChunkStorage())
+	items := make([]uint32, 0)
+	for i := 0; i < 1000; i++ {
+		items = append(items, uint32(rng.Intn(10_000)))
+	}
+	require.NoError(t, arr.Add(items))
+	all := arr.ToSlice()
+
+	for i := 0; i < 50; i++ {
+		min := uint32(rng.Intn(10_000))
+		max := min + uint32(rng.Intn(5_000))
+		width := uint32(rng.Intn(2_000) + 1)
+		t.Run(fmt.Sprintf("[%d,%d] by %d", min, max, width), func(t *testing.T) {
+			expected := make([]uint64, (max-min)/width+1)
+			for _, item := range all {
+				if item >= min && item <= max {
+					expected[(item-min)/width]++
+				}
+			}
+			buckets, err := arr.Histogram(min, max, width)
+			require.NoError(t, err)
+			require.Equal(t, expected, buckets)
+		})
+	}
+}
+
+func TestHistogramReadsBoundaryChunksOnly(t *testing.T) {
+	storage := &recordingStorage{ChunkStorage: NewInMemoryChunkStorage()}
+	arr := NewSortedArray(100, storage)
+	require.NoError(t, arr.Add(sequence(0, 10_000, 1)))
+	require.NoError(t, arr.Flush())
+	chunks, err := arr.Chunks()
+	require.NoError(t, err)
+	spanning := make([]uint32, 0) // chunks crossing bucket boundaries
+	for _, cm := range chunks {
+		if cm.min/1_000 != cm.max/1_000 {
+			spanning = append(spanning, cm.id)
+		}
+	}
+	require.Less(t, len(spanning), len(chunks)/2)
+
+	storage.takeReads()
+	buckets, err := arr.Histogram(0, 9_999, 1_000)
+	require.NoError(t, err)
+	require.Len(t, buckets, 10)
+	for _, count := range buckets {
+		require.EqualValues(t, 1_000, count)
+	}
+	require.Equal(t, spanning, storage.takeReads())
+}
+
+func TestHistogramInvalidArguments(t *testing.T) {
+	arr := NewSortedArray(10, NewInMemoryChunkStorage())
+	_, err := arr.Histogram(0, 10, 0)
+	require.Error(t, err)
+	_, err = arr.Histogram(10, 0, 1)
+	require.Error(t, err)
+	_, err = arr.Histogram(0, math.MaxUint32, 1)
+	require.Error(t, err)
+	buckets, err := arr.Histogram(0, 10, 5) // empty array
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0, 0, 0}, buckets)
+}
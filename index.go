@@ -0,0 +1,62 @@
+package sorted_array
+
+import (
+	sorted_numeric_streams "github.com/lezhnev74/SetOperationsOnSortedNumericStreams"
+)
+
+// Index is an inverted index: every term has a posting list (a sorted array of ids)
+// all posting lists live in one storage backend, e.g. a SQLite table with a key per term
+// arrays are loaded lazily, modified terms are kept in memory until Flush
+type Index struct {
+	maxChunkSize   uint32
+	storageFactory func(term string) ChunkStorage
+	touched        *ArrayGroup // terms modified since the last flush
+}
+
+// Index adds ids to the posting list of the term
+func (x *Index) Index(term string, ids []uint32) error {
+	return x.touched.Get([]byte(term)).Add(ids)
+}
+
+// Unindex removes ids from the posting list of the term
+func (x *Index) Unindex(term string, ids []uint32) error {
+	return x.touched.Get([]byte(term)).Delete(ids)
+}
+
+// Postings returns the posting list of the term (including not flushed changes)
+// the array is for reading, modifications must go through Index/Unindex to be flushed
+func (x *Index) Postings(term string) *SortedArray {
+	arr, ok := x.touched.arrays[term]
+	if !ok {
+		arr = NewSortedArray(x.maxChunkSize, x.storageFactory(term)) // nothing is read until used
+	}
+	return arr
+}
+
+// Search returns ids within [min,max] matching the query (see Evaluate)
+func (x *Index) Search(q *Query, min, max uint32) (sorted_numeric_streams.SortedNumbersStream[uint32], error) {
+	return Evaluate(q, x.Postings, min, max)
+}
+
+// Flush writes all modified terms at once (see ArrayGroup.Flush)
+// on error nothing is written and modified terms keep pending changes
+func (x *Index) Flush() error {
+	err := x.touched.Flush()
+	if err != nil {
+		return err
+	}
+	x.touched.reset() // flushed arrays are released, so memory does not grow with the number of terms
+	return nil
+}
+
+// NewIndex makes an index, the storage factory returns a storage for the term's posting list
+// tx makes flushes of several terms atomic, it can be nil for storages that can't fail mid-way (in-memory)
+func NewIndex(maxChunkSize uint32, tx GroupTx, storageFactory func(term string) ChunkStorage) *Index {
+	return &Index{
+		maxChunkSize:   maxChunkSize,
+		storageFactory: storageFactory,
+		touched: NewArrayGroup(maxChunkSize, tx, func(key []byte) ChunkStorage {
+			return storageFactory(string(key))
+		}),
+	}
+}
@@ -0,0 +1,75 @@
+package sorted_array
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestIndex(t *testing.T) {
+	db := MakeSqliteDb()
+	defer db.Close()
+
+	tx, err := db.Begin()
+	require.NoError(t, err)
+	index := NewIndex(2, NewSqliteSavepoint(tx, "index"), func(term string) ChunkStorage {
+		return NewSqliteTxSortedArrayStorage(tx, []byte("term:"+term))
+	})
+	require.NoError(t, index.Index("error", []uint32{1, 2, 3, 4}))
+	require.NoError(t, index.Index("api", []uint32{2, 4, 6}))
+	require.NoError(t, index.Unindex("error", []uint32{2}))
+	require.EqualValues(t, []uint32{1, 3, 4}, index.Postings("error").ToSlice()) // pending changes are visible
+	require.Empty(t, index.Postings("debug").ToSlice())
+	require.NoError(t, index.Flush())
+	require.NoError(t, tx.Commit())
+
+	tx, err = db.Begin()
+	require.NoError(t, err)
+	index = NewIndex(2, NewSqliteSavepoint(tx, "index"), func(term string) ChunkStorage {
+		return NewSqliteTxSortedArrayStorage(tx, []byte("term:"+term))
+	})
+	require.EqualValues(t, []uint32{1, 3, 4}, index.Postings("error").ToSlice())
+	require.EqualValues(t, []uint32{2, 4, 6}, index.Postings("api").ToSlice())
+	require.NoError(t, tx.Commit())
+}
+
+func TestIndexFlushesTouchedTermsOnly(t *testing.T) {
+	storages := make(map[string]*InstrumentedStorage)
+	index := NewIndex(2, nil, func(term string) ChunkStorage {
+		if storages[term] == nil {
+			storages[term] = NewInstrumentedStorage(NewInMemoryChunkStorage())
+		}
+		return storages[term]
+	})
+	require.NoError(t, index.Index("a", []uint32{1}))
+	require.NoError(t, index.Index("b", []uint32{2}))
+	require.NoError(t, index.Flush())
+
+	// arrays are loaded lazily
+	storages["a"].Reset()
+	postings := index.Postings("a")
+	require.Zero(t, storages["a"].Stats(StorageReadMeta).Calls)
+	require.EqualValues(t, []uint32{1}, postings.ToSlice())
+	require.EqualValues(t, 1, storages["a"].Stats(StorageReadMeta).Calls)
+
+	// only modified terms are written
+	storages["a"].Reset()
+	storages["b"].Reset()
+	require.NoError(t, index.Index("b", []uint32{3}))
+	require.NoError(t, index.Flush())
+	require.Zero(t, storages["a"].Stats(StorageSave).Calls)
+	require.Zero(t, storages["a"].Stats(StorageSaveMeta).Calls)
+	require.EqualValues(t, 1, storages["b"].Stats(StorageSaveMeta).Calls)
+	require.EqualValues(t, []uint32{2, 3}, index.Postings("b").ToSlice())
+}
+
+func TestIndexFlushFailure(t *testing.T) {
+	broken := &failingStorage{NewInMemoryChunkStorage(), true}
+	index := NewIndex(2, nil, func(term string) ChunkStorage { return broken })
+	require.NoError(t, index.Index("a", []uint32{1, 2}))
+	require.Error(t, index.Flush())
+
+	// pending changes survive the failure
+	broken.fail = false
+	require.NoError(t, index.Flush())
+	require.EqualValues(t, []uint32{1, 2}, NewSortedArray(2, broken).ToSlice())
+}
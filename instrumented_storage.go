@@ -0,0 +1,153 @@
+package sorted_array
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// StorageOpStats accounts calls of one ChunkStorage method
+type StorageOpStats struct {
+	Calls    int
+	ChunkIds int // chunk ids passed (requested ones for Read)
+	Chunks   int // chunks actually read or saved
+	Bytes    int // size of blobs read or written (meta pages loaded lazily count to ReadMeta), see NewInstrumentedStorageOnBlobs
+	Errors   int
+	Latency  time.Duration // total
+}
+
+// InstrumentedStorage is a ChunkStorage decorator which accounts calls, chunk ids, bytes and latency,
+// e.g. to assert in tests how many chunks a query touches
+type InstrumentedStorage struct {
+	ChunkStorage
+	mu    sync.Mutex
+	stats map[StorageOp]*StorageOpStats
+}
+
+func (s *InstrumentedStorage) Read(chunkIds []uint32) (chunks map[uint32]*Chunk, err error) {
+	start := time.Now()
+	chunks, err = s.ChunkStorage.Read(chunkIds)
+	s.account(StorageRead, start, len(chunkIds), chunks, err)
+	return
+}
+func (s *InstrumentedStorage) Save(chunks map[uint32]*Chunk) (err error) {
+	start := time.Now()
+	err = s.ChunkStorage.Save(chunks)
+	s.account(StorageSave, start, len(chunks), chunks, err)
+	return
+}
+func (s *InstrumentedStorage) Remove(chunkIds []uint32) (err error) {
+	start := time.Now()
+	err = s.ChunkStorage.Remove(chunkIds)
+	s.account(StorageRemove, start, len(chunkIds), nil, err)
+	return
+}
+func (s *InstrumentedStorage) ReadMeta() (meta *Meta, err error) {
+	start := time.Now()
+	meta, err = s.ChunkStorage.ReadMeta()
+	s.account(StorageReadMeta, start, 0, nil, err)
+	return
+}
+func (s *InstrumentedStorage) SaveMeta(meta *Meta) (err error) {
+	start := time.Now()
+	err = s.ChunkStorage.SaveMeta(meta)
+	s.account(StorageSaveMeta, start, 0, nil, err)
+	return
+}
+
+func (s *InstrumentedStorage) account(op StorageOp, start time.Time, ids int, chunks map[uint32]*Chunk, err error) {
+	latency := time.Since(start)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.opStats(op)
+	st.Calls++
+	st.ChunkIds += ids
+	for _, chunk := range chunks {
+		if chunk != nil {
+			st.Chunks++
+		}
+	}
+	st.Latency += latency
+	if err != nil {
+		st.Errors++
+	}
+}
+
+func (s *InstrumentedStorage) accountBytes(op StorageOp, bytes int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.opStats(op).Bytes += bytes
+}
+
+// opStats must be called under the lock
+func (s *InstrumentedStorage) opStats(op StorageOp) *StorageOpStats {
+	st, ok := s.stats[op]
+	if !ok {
+		st = &StorageOpStats{}
+		s.stats[op] = st
+	}
+	return st
+}
+
+// Stats returns accounting of the method so far
+func (s *InstrumentedStorage) Stats(op StorageOp) StorageOpStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if st, ok := s.stats[op]; ok {
+		return *st
+	}
+	return StorageOpStats{}
+}
+
+// Reset forgets all accounting
+func (s *InstrumentedStorage) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats = make(map[StorageOp]*StorageOpStats)
+}
+
+func (s *InstrumentedStorage) Unwrap() ChunkStorage { return s.ChunkStorage }
+
+// NewInstrumentedStorage decorates the storage, all calls go to it, bytes are not counted
+func NewInstrumentedStorage(s ChunkStorage) *InstrumentedStorage {
+	return &InstrumentedStorage{ChunkStorage: s, stats: make(map[StorageOp]*StorageOpStats)}
+}
+
+// NewInstrumentedStorageOnBlobs counts bytes too: the blobs are wrapped before build makes a storage over them,
+// e.g. NewInstrumentedStorageOnBlobs(blobs, func(b BlobStorage) ChunkStorage { return NewBlobChunkStorage(b) })
+func NewInstrumentedStorageOnBlobs(blobs BlobStorage, build func(BlobStorage) ChunkStorage) *InstrumentedStorage {
+	is := NewInstrumentedStorage(nil)
+	is.ChunkStorage = build(&accountedBlobs{BlobStorage: blobs, storage: is})
+	return is
+}
+
+// accountedBlobs counts bytes of blobs for an InstrumentedStorage, ops are told by keys
+type accountedBlobs struct {
+	BlobStorage
+	storage *InstrumentedStorage
+}
+
+func (b *accountedBlobs) ReadBlobs(keys []string) (map[string][]byte, error) {
+	blobs, err := b.BlobStorage.ReadBlobs(keys)
+	for key, blob := range blobs {
+		b.storage.accountBytes(blobOp(key, StorageRead, StorageReadMeta), len(blob))
+	}
+	return blobs, err
+}
+
+func (b *accountedBlobs) SaveBlobs(blobs map[string][]byte) error {
+	err := b.BlobStorage.SaveBlobs(blobs)
+	if err == nil {
+		for key, blob := range blobs {
+			b.storage.accountBytes(blobOp(key, StorageSave, StorageSaveMeta), len(blob))
+		}
+	}
+	return err
+}
+
+func blobOp(key string, chunkOp, metaOp StorageOp) StorageOp {
+	if key == metaBlobKey || strings.HasPrefix(key, metaPageBlobKey(0)[:2]) {
+		return metaOp
+	}
+	return chunkOp
+}
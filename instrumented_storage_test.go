@@ -0,0 +1,128 @@
+package sorted_array
+
+import (
+	"fmt"
+	sorted_numeric_streams "github.com/lezhnev74/SetOperationsOnSortedNumericStreams"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+)
+
+// recordingStorage remembers ids of read chunks in the order of reads, so tests can assert exactly what is read
+type recordingStorage struct {
+	ChunkStorage
+	mu    sync.Mutex
+	reads []uint32
+}
+
+func (s *recordingStorage) Read(chunkIds []uint32) (map[uint32]*Chunk, error) {
+	s.mu.Lock()
+	s.reads = append(s.reads, chunkIds...)
+	s.mu.Unlock()
+	return s.ChunkStorage.Read(chunkIds)
+}
+
+// takeReads returns ids read so far and forgets them
+func (s *recordingStorage) takeReads() []uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reads := s.reads
+	s.reads = nil
+	return reads
+}
+
+func TestInstrumentedStorage(t *testing.T) {
+	db := MakeSqliteDb()
+	defer db.Close()
+	tx, err := db.Begin()
+	require.NoError(t, err)
+	defer tx.Rollback()
+
+	sqlite := NewSqliteTxSortedArrayStorage(tx, []byte("term"))
+	storages := map[string]func() (inner ChunkStorage, storage *InstrumentedStorage){
+		"memory": func() (ChunkStorage, *InstrumentedStorage) {
+			inner := NewInMemoryChunkStorage()
+			return inner, NewInstrumentedStorage(inner)
+		},
+		"sqlite": func() (ChunkStorage, *InstrumentedStorage) {
+			inner := NewSqliteTxSortedArrayStorage(tx, []byte("term2"))
+			return inner, NewInstrumentedStorage(inner)
+		},
+		"sqlite blobs": func() (ChunkStorage, *InstrumentedStorage) { // bytes are counted by blobs
+			return sqlite, NewInstrumentedStorageOnBlobs(sqlite, func(b BlobStorage) ChunkStorage { return NewBlobChunkStorage(b) })
+		},
+	}
+	for name, makeStorage := range storages {
+		t.Run(name, func(t *testing.T) {
+			inner, storage := makeStorage()
+			arr := NewSortedArray(10, storage)
+			require.NoError(t, arr.Add(sequence(0, 100, 1)))
+			require.NoError(t, arr.Flush())
+
+			saves := storage.Stats(StorageSave)
+			require.Equal(t, 1, saves.Calls)
+			require.Equal(t, saves.ChunkIds, saves.Chunks)
+			require.Equal(t, 1, storage.Stats(StorageSaveMeta).Calls)
+			if name == "sqlite blobs" {
+				stats, err := NewSortedArray(10, inner).Stats()
+				require.NoError(t, err)
+				require.Equal(t, stats.TotalBytes, saves.Bytes)
+				require.Greater(t, storage.Stats(StorageSaveMeta).Bytes, 0)
+			} else {
+				require.Zero(t, saves.Bytes)
+			}
+
+			// a query within two chunks reads exactly them
+			storage.Reset()
+			chunks, err := NewSortedArray(10, storage).Chunks()
+			require.NoError(t, err)
+			from, to := chunks[2].Max(), chunks[3].Min()
+			items, err := NewSortedArray(10, storage).GetInRange(from, to)
+			require.NoError(t, err)
+			require.EqualValues(t, []uint32{from, to}, sorted_numeric_streams.ToSlice(items))
+
+			reads := storage.Stats(StorageRead)
+			require.Equal(t, 2, reads.ChunkIds)
+			require.Equal(t, 2, reads.Chunks)
+			if name == "sqlite blobs" {
+				stats, err := NewSortedArray(10, inner).Stats()
+				require.NoError(t, err)
+				require.Equal(t, stats.ChunkBytes[chunks[2].id]+stats.ChunkBytes[chunks[3].id], reads.Bytes)
+			} else {
+				require.Zero(t, reads.Bytes)
+			}
+			require.Equal(t, 0, reads.Errors)
+			require.Equal(t, 2, storage.Stats(StorageReadMeta).Calls)
+			require.Equal(t, StorageOpStats{}, storage.Stats(StorageRemove))
+
+			// decorated storages still report sizes
+			stats, err := NewSortedArray(10, storage).Stats()
+			require.NoError(t, err)
+			require.Equal(t, name == "sqlite", stats.ChunkBytes != nil, fmt.Sprint(stats.ChunkBytes))
+		})
+	}
+}
+
+// overridingStorage is a storage on blobs with its own Read
+type overridingStorage struct {
+	*BlobChunkStorage
+	reads int
+}
+
+func (s *overridingStorage) Read(chunkIds []uint32) (map[uint32]*Chunk, error) {
+	s.reads++
+	return s.BlobChunkStorage.Read(chunkIds)
+}
+
+func TestInstrumentedStorageForwardsCalls(t *testing.T) {
+	inner := &overridingStorage{BlobChunkStorage: NewBlobChunkStorage(NewInMemoryBlobStorage())}
+	storage := NewInstrumentedStorage(inner)
+	arr := NewSortedArray(10, storage)
+	require.NoError(t, arr.Add(sequence(0, 100, 1)))
+	require.NoError(t, arr.Flush())
+
+	_, err := NewSortedArray(10, storage).Contains(50)
+	require.NoError(t, err)
+	require.Equal(t, 1, inner.reads)
+	require.Equal(t, 1, storage.Stats(StorageRead).Calls)
+}
@@ -0,0 +1,113 @@
+package sorted_array
+
+import (
+	sorted_numeric_streams "github.com/lezhnev74/SetOperationsOnSortedNumericStreams"
+)
+
+const gallopRatio = 16 // the bigger side is probed instead of streamed if it is this many times bigger
+
+// Intersect returns items within [min,max] found in both arrays
+// the smaller side (estimated by meta) is streamed, every its item is looked up in the bigger one:
+// only chunks of the bigger side that may contain those items are loaded (see WithChunkFilters to skip even more)
+func (a *SortedArray) Intersect(other *SortedArray, min, max uint32) (sorted_numeric_streams.SortedNumbersStream[uint32], error) {
+	small, big := &queryPlan{}, &queryPlan{}
+	err := a.estimate(small, min, max)
+	if err == nil {
+		err = other.estimate(big, min, max)
+	}
+	if err != nil {
+		return nil, err
+	}
+	smallArr, bigArr := a, other
+	if big.card < small.card {
+		small, big = big, small
+		smallArr, bigArr = bigArr, smallArr
+	}
+	if small.card == 0 || big.card == 0 || small.min > big.max || big.min > small.max {
+		return sorted_numeric_streams.NewSliceStream[uint32](nil), nil
+	}
+	candidates, err := smallArr.GetInRange(min, max)
+	if err != nil {
+		return nil, err
+	}
+	return bigArr.probe(candidates), nil
+}
+
+// probe returns a stream of candidates found in the array, candidates must be in asc order
+func (a *SortedArray) probe(candidates sorted_numeric_streams.SortedNumbersStream[uint32]) *probeStream {
+	return &probeStream{arr: a, candidates: candidates}
+}
+
+// probeStream looks up candidates chunk by chunk, one chunk is loaded at a time
+type probeStream struct {
+	arr        *SortedArray
+	candidates sorted_numeric_streams.SortedNumbersStream[uint32]
+	cm         *ChunkMeta // the chunk of the last candidate, nil if none
+	chunk      *Chunk     // nil if the chunk is skipped as corrupted
+	hint       int        // position of the last candidate in the chunk
+	err        error
+}
+
+// Next returns ok=false at the end or if a chunk can't be read, see Err
+func (s *probeStream) Next() (item uint32, ok bool) {
+	for s.err == nil {
+		item, ok = s.candidates.Next()
+		if !ok {
+			s.release()
+			s.err = StreamErr(s.candidates)
+			return 0, false
+		}
+		if s.cm == nil || !s.cm.contains(item) {
+			s.release()
+			err := s.arr.initMeta()
+			if err == nil {
+				err = s.arr.meta.load(item, item)
+			}
+			if err != nil {
+				s.fail(err)
+				break
+			}
+			s.cm = s.arr.meta.FindRelevantForRead(item)
+			if s.cm == nil {
+				continue
+			}
+		}
+		if s.chunk == nil {
+			if !s.arr.meta.mayContain(s.cm.id, item) {
+				continue // the filter allows not to load the chunk
+			}
+			chunk, err := s.arr.readChunk(s.cm)
+			if err != nil {
+				s.fail(err)
+				break
+			}
+			s.chunk, s.hint = chunk, 0
+			if s.chunk == nil {
+				continue // skipped as corrupted
+			}
+		}
+		var found bool
+		found, s.hint = s.chunk.seek(item, s.hint)
+		if found {
+			return item, true
+		}
+	}
+	return 0, false
+}
+
+// Err returns the error the stream ended with, call it once Next returned ok=false
+func (s *probeStream) Err() error { return s.err }
+
+// fail stops the stream with the error, candidates are drained to stop their producer
+func (s *probeStream) fail(err error) {
+	s.release()
+	s.err = err
+	drain(s.candidates)
+}
+
+func (s *probeStream) release() {
+	if s.chunk != nil {
+		s.arr.releaseChunks([]uint32{s.cm.id})
+	}
+	s.cm, s.chunk = nil, nil
+}
@@ -0,0 +1,120 @@
+package sorted_array
+
+import (
+	"fmt"
+	SortedArrayStream "github.com/lezhnev74/SetOperationsOnSortedNumericStreams"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/exp/rand"
+	"testing"
+)
+
+func TestChunkSeek(t *testing.T) {
+	for _, items := range [][]uint32{
+		sequence(0, 1000, 7), // array
+		sequence(0, 1000, 2), // bitmap
+		append(sequence(0, 300, 1), sequence(500, 800, 1)...), // runs
+	} {
+		chunk := NewChunk(items)
+		t.Run(fmt.Sprintf("kind %d", chunk.kind), func(t *testing.T) {
+			hint := 0
+			for item := uint32(0); item <= 1001; item++ {
+				var found bool
+				found, hint = chunk.seek(item, hint)
+				require.Equal(t, chunk.Contains(item), found, "item %d", item)
+			}
+		})
+	}
+}
+
+func TestIntersect(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	randomArray := func(n int, span int) (*SortedArray, map[uint32]bool) {
+		arr := NewSortedArray(8, NewInMemoryChunkStorage())
+		set := make(map[uint32]bool)
+		items := make([]uint32, 0, n)
+		for i := 0; i < n; i++ {
+			item := uint32(rng.Intn(span))
+			items = append(items, item)
+			set[item] = true
+		}
+		require.NoError(t, arr.Add(items))
+		return arr, set
+	}
+	for _, sizes := range [][2]int{{0, 10}, {10, 10}, {5, 1000}, {1000, 5}, {50, 5000}} {
+		a, setA := randomArray(sizes[0], 3000)
+		b, setB := randomArray(sizes[1], 3000)
+		for i := 0; i < 10; i++ {
+			min := uint32(rng.Intn(3000))
+			max := min + uint32(rng.Intn(2000))
+			expected := make([]uint32, 0)
+			for item := min; item <= max; item++ {
+				if setA[item] && setB[item] {
+					expected = append(expected, item)
+				}
+			}
+			items, err := a.Intersect(b, min, max)
+			require.NoError(t, err)
+			require.EqualValues(t, expected, SortedArrayStream.ToSlice(items), "sizes %v, [%d,%d]", sizes, min, max)
+		}
+	}
+}
+
+func TestIntersectLoadsNeededChunksOnly(t *testing.T) {
+	storage := &recordingStorage{ChunkStorage: NewInMemoryChunkStorage()}
+	big := NewSortedArray(100, storage, WithChunkFilters(10))
+	require.NoError(t, big.Add(sequence(0, 9998, 2))) // even numbers, 100 chunks
+	require.NoError(t, big.Flush())
+	big = NewSortedArray(100, storage, WithChunkFilters(10))
+	chunks, err := big.Chunks()
+	require.NoError(t, err)
+	expected := make([]uint32, 0)
+	for _, cm := range chunks {
+		if cm.contains(4) || cm.contains(5004) || cm.contains(9004) {
+			expected = append(expected, cm.id)
+		}
+	}
+	require.Len(t, expected, 3)
+
+	small := NewSortedArray(100, NewInMemoryChunkStorage())
+	require.NoError(t, small.Add([]uint32{4, 5004, 9004}))
+
+	storage.takeReads()
+	items, err := small.Intersect(big, 0, 10000)
+	require.NoError(t, err)
+	require.EqualValues(t, []uint32{4, 5004, 9004}, SortedArrayStream.ToSlice(items))
+	require.Equal(t, expected, storage.takeReads()) // the chunk of every item
+	require.Empty(t, big.loadedChunks)              // chunks are released
+
+	// absent items are rejected by chunk filters, chunks are not loaded at all
+	small = NewSortedArray(100, NewInMemoryChunkStorage())
+	require.NoError(t, small.Add(sequence(1, 9999, 500))) // odd numbers
+	items, err = big.Intersect(small, 0, 10000)
+	require.NoError(t, err)
+	require.Empty(t, SortedArrayStream.ToSlice(items))
+	require.Empty(t, storage.takeReads())
+}
+
+func BenchmarkIntersect(b *testing.B) {
+	big := NewSortedArray(1000, NewInMemoryChunkStorage())
+	for i := uint32(0); i < 1_000_000; i += 1000 {
+		_ = big.Add(sequence(i*3, i*3+2997, 3)) // 1M sparse items
+	}
+	for _, ratio := range []int{10, 1000, 100_000} {
+		small := NewSortedArray(1000, NewInMemoryChunkStorage())
+		_ = small.Add(sequence(0, 3_000_000, uint32(3*ratio)))
+
+		b.Run(fmt.Sprintf("1:%d/gallop", ratio), func(b *testing.B) {
+			for n := 0; n < b.N; n++ {
+				items, _ := small.Intersect(big, 0, 3_000_000)
+				SortedArrayStream.ToSlice(items)
+			}
+		})
+		b.Run(fmt.Sprintf("1:%d/stream", ratio), func(b *testing.B) {
+			for n := 0; n < b.N; n++ {
+				s1, _ := small.GetInRange(0, 3_000_000)
+				s2, _ := big.GetInRange(0, 3_000_000)
+				SortedArrayStream.ToSlice[uint32](&setOperation{op: QueryAnd, left: s1, right: s2})
+			}
+		})
+	}
+}
@@ -0,0 +1,304 @@
+package sorted_array
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"golang.org/x/exp/slices"
+	"io"
+	"sort"
+	"sync"
+)
+
+// A key-value array is a sorted map: every item (key) carries a value of a fixed number of bytes,
+// e.g. a term frequency or an offset in a posting list. Values are kept in chunks as a column
+// parallel to items (see Chunk.values), the meta, filters and GetInRange see keys only.
+
+const maxValueWidth = 1 << 16
+
+// KeyValue is an item of a key-value array with its value
+type KeyValue struct {
+	Key   uint32
+	Value []byte
+}
+
+// WithValues makes the array a sorted map with values of width bytes (see Put),
+// it must be used every time the storage is opened and can't be combined with WithCounts
+// (chunks written without values are read as keys with zero values)
+func WithValues(width int) ArrayOption {
+	if width <= 0 || width > maxValueWidth {
+		panic(fmt.Sprintf("value width must be within [1,%d]", maxValueWidth))
+	}
+	return func(a *SortedArray) { a.valueWidth = width }
+}
+
+// Put inserts keys with their values or replaces values of existing keys (the last one wins for repeated keys)
+// Add inserts keys with zero values and keeps values of existing keys
+func (a *SortedArray) Put(keys []uint32, values [][]byte) error {
+	if a.valueWidth == 0 {
+		return fmt.Errorf("the array has no values, see WithValues")
+	}
+	if len(keys) != len(values) {
+		return fmt.Errorf("got %d keys and %d values", len(keys), len(values))
+	}
+	byKey := make(map[uint32][]byte, len(keys))
+	for i, key := range keys {
+		if len(values[i]) != a.valueWidth {
+			return fmt.Errorf("value of key %d has %d bytes, expected %d", key, len(values[i]), a.valueWidth)
+		}
+		byKey[key] = values[i]
+	}
+	return a.add(keys, byKey)
+}
+
+// Value returns the value of the key, at most one chunk is loaded
+func (a *SortedArray) Value(key uint32) (value []byte, found bool, err error) {
+	err = a.initMeta()
+	if err == nil {
+		err = a.meta.load(key, key)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	cm := a.meta.FindRelevantForRead(key)
+	if cm == nil {
+		return nil, false, nil
+	}
+	if _, ok := a.loadedChunks[cm.id]; !ok && !a.meta.mayContain(cm.id, key) {
+		return nil, false, nil
+	}
+	chunk, err := a.readChunk(cm)
+	if err != nil || chunk == nil {
+		return nil, false, err // nil if skipped as corrupted
+	}
+	defer a.releaseChunks([]uint32{cm.id})
+	value, found = chunk.Value(key)
+	return slices.Clone(value), found, nil
+}
+
+// GetPairsInRange returns a stream of keys within [min,max] (INCLUDED) with their values
+func (a *SortedArray) GetPairsInRange(min, max uint32) (*PairStream, error) {
+	err := a.initMeta()
+	if err == nil {
+		err = a.meta.load(min, max)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &PairStream{arr: a, chunks: a.meta.FindRelevantForReadRange(min, max), min: min, max: max}, nil
+}
+
+// PairStream returns pairs in asc order of keys, one chunk is loaded at a time
+type PairStream struct {
+	arr      *SortedArray
+	chunks   []*ChunkMeta // not read yet
+	min, max uint32
+	pairs    []KeyValue // left from the last read chunk
+	err      error
+}
+
+// Next returns ok=false at the end or if a chunk can't be read, see Err
+func (s *PairStream) Next() (pair KeyValue, ok bool) {
+	for len(s.pairs) == 0 {
+		if len(s.chunks) == 0 || s.err != nil {
+			return pair, false
+		}
+		cm := s.chunks[0]
+		s.chunks = s.chunks[1:]
+		chunk, err := s.arr.readChunk(cm)
+		if err != nil {
+			s.err = err
+			return pair, false
+		}
+		if chunk == nil {
+			continue // skipped as corrupted
+		}
+		s.pairs = chunk.appendPairsInRange(nil, s.min, s.max)
+		s.arr.releaseChunks([]uint32{cm.id})
+	}
+	pair, s.pairs = s.pairs[0], s.pairs[1:]
+	return pair, true
+}
+
+// Err returns the error the stream ended with, call it once Next returned ok=false
+func (s *PairStream) Err() error { return s.err }
+
+// NewValueChunk makes a key-value chunk, keys get zero values
+func NewValueChunk(width int, keys []uint32) *Chunk {
+	c := &Chunk{valueWidth: width, values: make([]byte, 0)}
+	c.setItems(nil, arrayContainer)
+	c.putValues(keys, nil)
+	return c
+}
+
+// Put inserts keys with values (of the chunk's width) or replaces values of existing keys
+// returns the number of NEW keys
+func (c *Chunk) Put(keys []uint32, values [][]byte) (added int) {
+	if len(keys) != len(values) {
+		panic("keys and values do not match")
+	}
+	for _, v := range values {
+		if len(v) != c.valueWidth {
+			panic("unexpected value width")
+		}
+	}
+	return c.putValues(keys, values)
+}
+
+// Value returns the value of the key, it is a part of the chunk (not a copy)
+func (c *Chunk) Value(key uint32) (value []byte, found bool) {
+	if c.valueWidth == 0 {
+		return nil, c.Contains(key)
+	}
+	pos, found := slices.BinarySearch(c.ToSlice(), key)
+	if !found {
+		return nil, false
+	}
+	return c.values[pos*c.valueWidth : (pos+1)*c.valueWidth : (pos+1)*c.valueWidth], true
+}
+
+// appendPairsInRange appends keys within [from,to] with copies of their values to dst in asc order
+func (c *Chunk) appendPairsInRange(dst []KeyValue, from, to uint32) []KeyValue {
+	keys := c.ToSlice()
+	lo, _ := slices.BinarySearch(keys, from)
+	hi, found := slices.BinarySearch(keys, to)
+	if found {
+		hi++
+	}
+	if lo >= hi {
+		return dst
+	}
+	w := c.valueWidth
+	values := slices.Clone(c.values[lo*w : hi*w])
+	for i, key := range keys[lo:hi] {
+		pair := KeyValue{Key: key}
+		if w > 0 {
+			pair.Value = values[i*w : (i+1)*w : (i+1)*w]
+		}
+		dst = append(dst, pair)
+	}
+	return dst
+}
+
+// putValues merges keys into a key-value chunk, values of new keys are zero if values is nil
+// (values of existing keys are kept then), returns the number of NEW keys
+func (c *Chunk) putValues(keys []uint32, values [][]byte) (added int) {
+	if len(keys) == 0 {
+		return
+	}
+	order := make([]int, len(keys))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return keys[order[i]] < keys[order[j]] })
+	w := c.valueWidth
+	existing := c.ToSlice()
+	merged := make([]uint32, 0, len(existing)+len(keys))
+	mergedValues := make([]byte, 0, cap(merged)*w)
+	i := 0
+	for j := 0; j < len(order); {
+		key := keys[order[j]]
+		k := j + 1
+		for k < len(order) && keys[order[k]] == key {
+			k++
+		}
+		// 1. copy smaller existing keys as is
+		for i < len(existing) && existing[i] < key {
+			merged, mergedValues = append(merged, existing[i]), append(mergedValues, c.values[i*w:(i+1)*w]...)
+			i++
+		}
+		// 2. replace or insert
+		var value []byte
+		if i < len(existing) && existing[i] == key {
+			value = c.values[i*w : (i+1)*w]
+			i++
+		} else {
+			value = make([]byte, w)
+			added++
+		}
+		if values != nil {
+			value = values[order[k-1]] // the last one wins
+		}
+		merged, mergedValues = append(merged, key), append(mergedValues, value...)
+		j = k
+	}
+	merged = append(merged, existing[i:]...)
+	mergedValues = append(mergedValues, c.values[i*w:]...)
+	c.setItems(merged, arrayContainer)
+	c.values = mergedValues
+	c.optimize()
+	return
+}
+
+// removeValues removes keys with their values from a key-value chunk, returns the number of removed keys
+func (c *Chunk) removeValues(keys []uint32) (removed int) {
+	if len(keys) == 0 {
+		return
+	}
+	keys = slices.Clone(keys)
+	slices.Sort(keys)
+	w := c.valueWidth
+	existing := c.ToSlice()
+	kept, values := existing[:0], c.values[:0] // in place, the write position never passes the read one
+	for i, key := range existing {
+		if _, found := slices.BinarySearch(keys, key); found {
+			removed++
+			continue
+		}
+		kept, values = append(kept, key), append(values, c.values[i*w:(i+1)*w]...)
+	}
+	if removed == 0 {
+		return
+	}
+	c.setItems(kept, arrayContainer)
+	c.values = values
+	c.optimize()
+	return
+}
+
+var flateWriters = sync.Pool{New: func() any {
+	w, _ := flate.NewWriter(nil, flate.BestSpeed)
+	return w
+}}
+
+// compressValues deflates the value column transposed to byte planes (the 1st bytes of all values, then the 2nd...),
+// so small numbers in wide values compress to almost nothing
+func compressValues(values []byte, width int) []byte {
+	n := len(values) / width
+	planes := make([]byte, len(values))
+	for i := 0; i < n; i++ {
+		for p := 0; p < width; p++ {
+			planes[p*n+i] = values[i*width+p]
+		}
+	}
+	var buf bytes.Buffer
+	w := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(w)
+	w.Reset(&buf)
+	_, _ = w.Write(planes) // writes to a buffer don't fail
+	_ = w.Close()
+	return buf.Bytes()
+}
+
+// uncompressValues restores n values of width bytes, see compressValues
+func uncompressValues(compressed []byte, n, width int) ([]byte, error) {
+	if uint64(n)*uint64(width) > 1100*uint64(len(compressed))+64 { // deflate can't do better than ~1032:1
+		return nil, fmt.Errorf("too many values for %d bytes", len(compressed))
+	}
+	r := flate.NewReader(bytes.NewReader(compressed))
+	planes := make([]byte, n*width)
+	_, err := io.ReadFull(r, planes)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = r.Read(make([]byte, 1)); err != io.EOF {
+		return nil, fmt.Errorf("unexpected trailing values")
+	}
+	values := make([]byte, len(planes))
+	for i := 0; i < n; i++ {
+		for p := 0; p < width; p++ {
+			values[i*width+p] = planes[p*n+i]
+		}
+	}
+	return values, nil
+}
@@ -0,0 +1,186 @@
+package sorted_array
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/exp/rand"
+	"testing"
+)
+
+func TestValueChunk(t *testing.T) {
+	c := NewValueChunk(2, []uint32{30, 10})
+	require.EqualValues(t, []uint32{10, 30}, c.ToSlice())
+	v, found := c.Value(10)
+	require.True(t, found)
+	require.Equal(t, []byte{0, 0}, v)
+
+	require.Equal(t, 1, c.Put([]uint32{20, 10, 20}, [][]byte{{2, 0}, {1, 0}, {2, 2}})) // the last one wins
+	require.Equal(t, 0, c.Add([]uint32{10, 30}))                                       // values are kept
+	require.Equal(t, []KeyValue{{10, []byte{1, 0}}, {20, []byte{2, 2}}, {30, []byte{0, 0}}}, c.appendPairsInRange(nil, 0, 100))
+	require.Equal(t, []KeyValue{{20, []byte{2, 2}}}, c.appendPairsInRange(nil, 11, 29))
+	require.Empty(t, c.appendPairsInRange(nil, 21, 29))
+
+	require.Equal(t, 2, c.Remove([]uint32{10, 30, 40}))
+	require.Equal(t, []KeyValue{{20, []byte{2, 2}}}, c.appendPairsInRange(nil, 0, 100))
+	_, found = c.Value(10)
+	require.False(t, found)
+
+	require.Panics(t, func() { c.Put([]uint32{1}, [][]byte{{1}}) })
+}
+
+func TestValueChunkContainers(t *testing.T) {
+	tests := []struct {
+		keys []uint32
+		kind containerKind
+	}{
+		{[]uint32{1, 100, 10_000}, arrayContainer},
+		{sequence(0, 1000, 3), bitmapContainer},
+		{sequence(0, 1000, 1), runContainer},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d", tt.kind), func(t *testing.T) {
+			c := NewValueChunk(4, nil)
+			values := make([][]byte, len(tt.keys))
+			for i, key := range tt.keys {
+				values[i] = binary.LittleEndian.AppendUint32(nil, key*7)
+			}
+			c.Put(tt.keys, values)
+			require.Equal(t, tt.kind, c.kind)
+
+			b, err := c.Serialize()
+			require.NoError(t, err)
+			c2, err := UnserializeChunk(b)
+			require.NoError(t, err)
+			expected := c.appendPairsInRange(nil, 0, 1<<32-1)
+			require.Equal(t, expected, c2.appendPairsInRange(nil, 0, 1<<32-1))
+
+			// split and merge keep values along with keys
+			tail := c2.splitAt(2)
+			require.Equal(t, expected[:2], c2.appendPairsInRange(nil, 0, 1<<32-1))
+			require.Equal(t, expected[2:], tail.appendPairsInRange(nil, 0, 1<<32-1))
+			c2.absorb(tail)
+			require.Equal(t, expected, c2.appendPairsInRange(nil, 0, 1<<32-1))
+		})
+	}
+}
+
+func TestCompressValues(t *testing.T) {
+	values := make([]byte, 0)
+	for i := 0; i < 10_000; i++ {
+		values = binary.LittleEndian.AppendUint32(values, uint32(i%16)) // e.g. term frequencies
+	}
+	compressed := compressValues(values, 4)
+	require.Less(t, len(compressed), len(values)/10)
+	restored, err := uncompressValues(compressed, 10_000, 4)
+	require.NoError(t, err)
+	require.Equal(t, values, restored)
+
+	_, err = uncompressValues(compressed, 9_999, 4)
+	require.Error(t, err)
+	_, err = uncompressValues(compressed, 10_001, 4)
+	require.Error(t, err)
+}
+
+func TestKeyValueArray(t *testing.T) {
+	for _, chunkSize := range []uint32{1, 3, 16} {
+		t.Run(fmt.Sprintf("%d", chunkSize), func(t *testing.T) {
+			storage := NewBlobChunkStorage(NewInMemoryBlobStorage())
+			rnd := rand.New(rand.NewSource(1))
+			model := make(map[uint32][]byte)
+			arr := NewSortedArray(chunkSize, storage, WithValues(2))
+			for step := 0; step < 200; step++ {
+				keys := make([]uint32, 1+rnd.Intn(10))
+				values := make([][]byte, len(keys))
+				for i := range keys {
+					keys[i] = uint32(rnd.Intn(50))
+					values[i] = []byte{byte(step), byte(i)}
+				}
+				switch rnd.Intn(4) {
+				case 0:
+					require.NoError(t, arr.Delete(keys))
+					for _, key := range keys {
+						delete(model, key)
+					}
+				case 1:
+					require.NoError(t, arr.Add(keys))
+					for _, key := range keys {
+						if _, ok := model[key]; !ok {
+							model[key] = []byte{0, 0}
+						}
+					}
+				default:
+					require.NoError(t, arr.Put(keys, values))
+					for i, key := range keys {
+						model[key] = values[i]
+					}
+				}
+				if step%20 == 0 {
+					require.NoError(t, arr.Flush())
+					arr = NewSortedArray(chunkSize, storage, WithValues(2))
+				}
+
+				min := uint32(rnd.Intn(50))
+				max := min + uint32(rnd.Intn(20))
+				expected := make([]KeyValue, 0)
+				for key := min; key <= max; key++ {
+					if v, ok := model[key]; ok {
+						expected = append(expected, KeyValue{key, v})
+					}
+				}
+				s, err := arr.GetPairsInRange(min, max)
+				require.NoError(t, err)
+				actual := make([]KeyValue, 0)
+				for pair, ok := s.Next(); ok; pair, ok = s.Next() {
+					actual = append(actual, pair)
+				}
+				require.Equal(t, expected, actual, "step %d [%d,%d]", step, min, max)
+
+				key := uint32(rnd.Intn(50))
+				v, found, err := arr.Value(key)
+				require.NoError(t, err)
+				require.Equal(t, model[key], v)
+				require.Equal(t, model[key] != nil, found)
+			}
+			require.NoError(t, arr.Flush())
+			problems, err := arr.Validate()
+			require.NoError(t, err)
+			require.Empty(t, problems)
+		})
+	}
+}
+
+func TestKeyValueArrayErrors(t *testing.T) {
+	storage := NewInMemoryChunkStorage()
+	arr := NewSortedArray(4, storage)
+	require.Error(t, arr.Put([]uint32{1}, [][]byte{{1}})) // no values
+	require.NoError(t, arr.Add([]uint32{1, 2}))
+	require.NoError(t, arr.Flush())
+
+	// chunks without values are read with zero values
+	arr = NewSortedArray(4, storage, WithValues(1))
+	require.Error(t, arr.Put([]uint32{1}, [][]byte{{1, 2}}))
+	require.Error(t, arr.Put([]uint32{1}, nil))
+	require.NoError(t, arr.Put([]uint32{2}, [][]byte{{5}}))
+	require.NoError(t, arr.Flush())
+	s, err := arr.GetPairsInRange(0, 10)
+	require.NoError(t, err)
+	pair, _ := s.Next()
+	require.Equal(t, KeyValue{1, []byte{0}}, pair)
+	pair, _ = s.Next()
+	require.Equal(t, KeyValue{2, []byte{5}}, pair)
+
+	// values of another width are not accepted
+	arr = NewSortedArray(4, storage, WithValues(2))
+	_, _, err = arr.Value(1)
+	require.Error(t, err)
+
+	require.Panics(t, func() { WithValues(0) })
+
+	// a multiset can't have values
+	arr = NewSortedArray(4, NewInMemoryChunkStorage(), WithCounts(), WithValues(1))
+	require.Error(t, arr.Add([]uint32{1}))
+	require.Error(t, arr.Put([]uint32{1}, [][]byte{{1}}))
+	_, err = arr.CountInRange(0, 10)
+	require.Error(t, err)
+}
@@ -0,0 +1,119 @@
+package sorted_array
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"sort"
+)
+
+const compactBatchSize = 64 // merged chunks to flush at once while compacting
+
+// Chunks returns descriptions of all chunks in asc order (the whole meta is loaded)
+func (a *SortedArray) Chunks() ([]*ChunkMeta, error) {
+	err := a.initMeta()
+	if err == nil {
+		err = a.meta.loadAll()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return append([]*ChunkMeta(nil), a.meta.chunks...), nil
+}
+
+// Validate checks that the meta is consistent and matches chunks in the storage
+// chunks are read one at a time, found problems are returned as text,
+// err is only returned if the storage can't be read at all
+func (a *SortedArray) Validate() (problems []string, err error) {
+	chunks, err := a.Chunks()
+	var corrupted *ErrCorrupted
+	if errors.As(err, &corrupted) {
+		return []string{err.Error()}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	for i, cm := range chunks {
+		// 1. Meta itself
+		if cm.size == 0 || cm.min > cm.max {
+			problems = append(problems, fmt.Sprintf("chunk %d has invalid description [%d,%d] of size %d", cm.id, cm.min, cm.max, cm.size))
+		}
+		if i > 0 && chunks[i-1].max >= cm.min {
+			problems = append(problems, fmt.Sprintf("chunk %d overlaps chunk %d", cm.id, chunks[i-1].id))
+		}
+
+		// 2. The chunk against its description
+		chunk, ok := a.loadedChunks[cm.id]
+		if !ok {
+			chunk, err = a.readChunk(cm)
+			if errors.As(err, &corrupted) {
+				problems = append(problems, err.Error())
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			a.releaseChunks([]uint32{cm.id}) // the chunk is still checked below
+		}
+		if chunk == nil && a.skipCorrupted {
+			problems = append(problems, fmt.Sprintf("chunk %d is missing or corrupted", cm.id))
+			continue
+		} else if chunk == nil {
+			problems = append(problems, fmt.Sprintf("chunk %d is missing", cm.id))
+			continue
+		}
+		if chunk.Len() == 0 {
+			problems = append(problems, fmt.Sprintf("chunk %d is empty", cm.id))
+			continue
+		}
+		if chunk.Min() != cm.min || chunk.Max() != cm.max || uint32(chunk.Len()) != cm.size {
+			problems = append(problems, fmt.Sprintf(
+				"chunk %d holds [%d,%d] of size %d, meta says [%d,%d] of size %d",
+				cm.id, chunk.Min(), chunk.Max(), chunk.Len(), cm.min, cm.max, cm.size,
+			))
+		}
+		if _, dirty := a.dirtyChunks[cm.id]; !dirty { // filters of dirty chunks are rebuilt on flush
+			for _, item := range chunk.ToSlice() {
+				if !a.meta.mayContain(cm.id, item) {
+					problems = append(problems, fmt.Sprintf("filter of chunk %d misses %d", cm.id, item))
+					break
+				}
+			}
+		}
+	}
+	return problems, nil
+}
+
+// Compact merges neighbour chunks while they fit into maxChunkSize, so the array has fewer and fuller chunks
+// changes are flushed in batches
+func (a *SortedArray) Compact() error {
+	err := a.initMeta()
+	if err == nil {
+		err = a.meta.loadAll()
+	}
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(a.meta.chunks)-1; i++ {
+		cm := a.meta.chunks[i]
+		for i+1 < len(a.meta.chunks) && cm.size+a.meta.chunks[i+1].size <= a.maxChunkSize {
+			next := a.meta.chunks[i+1]
+			err = a.loadChunks([]uint32{cm.id, next.id})
+			if err != nil {
+				return errors.Wrapf(err, "unable to load chunks %d, %d", cm.id, next.id)
+			}
+			if a.loadedChunks[cm.id] == nil || a.loadedChunks[next.id] == nil {
+				return fmt.Errorf("chunk %d or %d is missing", cm.id, next.id)
+			}
+			a.mergePair(cm, next)
+		}
+		if len(a.dirtyChunks) >= compactBatchSize {
+			done := cm.max
+			err = a.Flush()
+			if err != nil {
+				return err
+			}
+			// Flush trims the array (see Trim), leading chunks may be gone, so the position is found again
+			i = sort.Search(len(a.meta.chunks), func(j int) bool { return a.meta.chunks[j].max > done }) - 1
+		}
+	}
+	return a.Flush()
+}
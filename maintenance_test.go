@@ -0,0 +1,89 @@
+package sorted_array
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestCompact(t *testing.T) {
+	storage := NewBlobChunkStorage(NewInMemoryBlobStorage())
+	arr := NewSortedArray(10, storage)
+	items := sequence(0, 100, 1)
+	for _, item := range items { // one by one, so chunks are split in halves
+		require.NoError(t, arr.Add([]uint32{item}))
+	}
+	require.NoError(t, arr.Flush())
+	before, err := arr.Chunks()
+	require.NoError(t, err)
+
+	// chunks are half full, a bigger chunk size makes it even worse
+	arr = NewSortedArray(30, storage)
+	require.NoError(t, arr.Compact())
+	after, err := arr.Chunks()
+	require.NoError(t, err)
+	require.Less(t, len(after), len(before)/3)
+	for _, cm := range after {
+		require.LessOrEqual(t, cm.Size(), uint32(30))
+	}
+
+	arr = NewSortedArray(30, storage)
+	require.EqualValues(t, items, arr.ToSlice())
+	problems, err := arr.Validate()
+	require.NoError(t, err)
+	require.Empty(t, problems)
+}
+
+func TestCompactWithRetention(t *testing.T) {
+	storage := NewBlobChunkStorage(NewInMemoryBlobStorage())
+	arr := NewSortedArray(10, storage)
+	for _, item := range sequence(0, 2000, 1) {
+		require.NoError(t, arr.Add([]uint32{item}))
+	}
+	require.NoError(t, arr.Flush())
+
+	// flushes of compacted batches drop leading chunks
+	arr = NewSortedArray(30, storage, WithRetention(RetentionPolicy{MaxCount: 1500}))
+	require.NoError(t, arr.Compact())
+	after, err := arr.Chunks()
+	require.NoError(t, err)
+	for i := 1; i < len(after); i++ {
+		require.Greater(t, after[i-1].Size()+after[i].Size(), uint32(30), "chunks %d and %d are not merged", i-1, i)
+	}
+
+	arr = NewSortedArray(30, storage)
+	require.EqualValues(t, sequence(500, 2000, 1), arr.ToSlice())
+	problems, err := arr.Validate()
+	require.NoError(t, err)
+	require.Empty(t, problems)
+}
+
+func TestValidate(t *testing.T) {
+	blobs := NewInMemoryBlobStorage()
+	storage := NewBlobChunkStorage(blobs)
+	arr := NewSortedArray(10, storage, WithChunkFilters(10))
+	require.NoError(t, arr.Add(sequence(0, 50, 1)))
+	require.NoError(t, arr.Flush())
+
+	o := &recordingObserver{}
+	arr = NewSortedArray(10, storage, WithChunkFilters(10), WithObserver(o))
+	problems, err := arr.Validate()
+	require.NoError(t, err)
+	require.Empty(t, problems)
+	require.Contains(t, o.events, "loaded [0]") // chunks are read like any other read
+	require.Empty(t, arr.loadedChunks)
+
+	// damage the storage
+	chunks, err := arr.Chunks()
+	require.NoError(t, err)
+	require.NoError(t, storage.Remove([]uint32{chunks[0].Id()}))
+	blobs.blobs[chunkBlobKey(chunks[1].Id())][frameHeaderSize] ^= 0xff
+	require.NoError(t, storage.Save(map[uint32]*Chunk{chunks[2].Id(): NewChunk([]uint32{chunks[2].Min(), 1000})}))
+
+	problems, err = NewSortedArray(10, storage).Validate()
+	require.NoError(t, err)
+	require.Len(t, problems, 4)
+	require.Contains(t, problems[0], "is missing")
+	require.Contains(t, problems[1], "is corrupted")
+	require.Contains(t, problems[2], "meta says")
+	require.Contains(t, problems[3], "filter")
+}
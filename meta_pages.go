@@ -0,0 +1,409 @@
+package sorted_array
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"github.com/ronanh/intcomp"
+	"hash/crc32"
+	"math"
+	"sort"
+)
+
+// Meta of a huge array is persisted in pages, so it does not have to be read (and written) at once.
+// Pages split the value space: a page holds chunks with min in [page.from, next page.from).
+// A small summary (pages list) is always loaded, pages themselves are loaded on demand.
+//
+//	summary:  [page 0: from 0] [page 3: from 1000] [page 1: from 5000]
+//	pages:     chunks 0..999    chunks 1000..4999   chunks 5000...
+
+const defaultMetaPageSize = 1024 // chunks per page
+
+// metaPage is a summary of a persisted page of chunk descriptions
+type metaPage struct {
+	id     uint32
+	from   uint32 // min value of chunks in this page
+	size   uint32 // number of chunks as of the last save
+	loaded bool
+	crc    uint32     // checksum of the persisted page, unchanged pages are not written again
+	stats  *pageStats // chunk sizes as of the last save, nil if unknown (summaries of older versions)
+}
+
+// pageStats describes sizes of chunks in a page, so Stats does not have to load pages
+type pageStats struct {
+	chunks           uint32
+	items            uint64
+	minSize, maxSize uint32
+	chunkSize        uint32 // max chunk size of the array the fill is computed for
+	fill             [fillHistogramBuckets]uint32
+}
+
+func newPageStats(chunks []*ChunkMeta, chunkSize uint32) *pageStats {
+	ps := &pageStats{chunks: uint32(len(chunks)), chunkSize: chunkSize}
+	for _, cm := range chunks {
+		ps.items += uint64(cm.size)
+		if ps.minSize == 0 || cm.size < ps.minSize {
+			ps.minSize = cm.size
+		}
+		if cm.size > ps.maxSize {
+			ps.maxSize = cm.size
+		}
+		bucket := uint64(fillHistogramBuckets - 1)
+		if chunkSize > 0 && uint64(cm.size)*fillHistogramBuckets/uint64(chunkSize) < bucket {
+			bucket = uint64(cm.size) * fillHistogramBuckets / uint64(chunkSize)
+		}
+		ps.fill[bucket]++
+	}
+	return ps
+}
+
+// metaChanges is what must be written to make the storage match the meta
+type metaChanges struct {
+	pages      map[uint32][]byte // serialized pages that changed
+	crcs       map[uint32]uint32 // checksums of changed pages
+	dropped    []uint32          // pages to remove
+	summary    []byte            // nil if the summary did not change
+	summaryCrc uint32
+}
+
+// pagePos returns the position of the page where a chunk starting with the item belongs
+func (m *Meta) pagePos(item uint32) int {
+	return sort.Search(len(m.pages), func(i int) bool { return m.pages[i].from > item }) - 1
+}
+
+// pageChunks returns loaded chunks which belong to the page at the position
+func (m *Meta) pageChunks(pos int) []*ChunkMeta {
+	start := findPosForMin(m.chunks, m.pages[pos].from)
+	end := len(m.chunks)
+	if pos+1 < len(m.pages) {
+		end = findPosForMin(m.chunks, m.pages[pos+1].from)
+	}
+	return m.chunks[start:end]
+}
+
+// load makes sure that descriptions of chunks relevant to [min,max] are in memory,
+// including the chunks right before min and after max (those are used to select chunks for insertion)
+func (m *Meta) load(min, max uint32) error {
+	if m.pages == nil {
+		return nil // flat meta is always loaded
+	}
+	lo, hi := m.pagePos(min), m.pagePos(max)
+	err := m.loadPages(lo, hi)
+	if err != nil {
+		return err
+	}
+	// the chunk before min may live in previous pages
+	for lo > 0 {
+		chunks := m.pageChunks(lo)
+		if len(chunks) > 0 && chunks[0].min <= min {
+			break
+		}
+		lo--
+		err = m.loadPages(lo, lo)
+		if err != nil {
+			return err
+		}
+	}
+	// the chunk after max may live in next pages
+	for hi < len(m.pages)-1 {
+		chunks := m.pageChunks(hi)
+		if len(chunks) > 0 && chunks[len(chunks)-1].min > max {
+			break
+		}
+		hi++
+		err = m.loadPages(hi, hi)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Meta) loadAll() error { return m.load(0, math.MaxUint32) }
+
+// loadPages loads pages at positions [lo,hi] that are not in memory yet
+func (m *Meta) loadPages(lo, hi int) error {
+	ids := make([]uint32, 0)
+	for _, p := range m.pages[lo : hi+1] {
+		if !p.loaded {
+			ids = append(ids, p.id)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	blobs, err := m.pageLoader(ids)
+	if err != nil {
+		return err
+	}
+	for _, p := range m.pages[lo : hi+1] {
+		if p.loaded {
+			continue
+		}
+		blob, ok := blobs[p.id]
+		if !ok {
+			return &ErrCorrupted{Meta: true, Reason: fmt.Sprintf("meta page %d is missing", p.id)}
+		}
+		page, err := UnserializeMeta(blob)
+		if err != nil {
+			return err
+		}
+		p.crc = crc32.Checksum(blob, crcTable)
+		m.Add(page.chunks)
+		for id, f := range page.filters {
+			m.setFilter(id, f)
+		}
+		p.loaded = true
+	}
+	return nil
+}
+
+// adjacent tells if there is no unloaded chunk in between two loaded chunks (a before b)
+func (m *Meta) adjacent(a, b *ChunkMeta) bool {
+	if m.pages == nil {
+		return true
+	}
+	for _, p := range m.pages[m.pagePos(a.min) : m.pagePos(b.min)+1] {
+		if !p.loaded {
+			return false
+		}
+	}
+	return true
+}
+
+// paginate distributes loaded chunks over pages, splits big pages and drops empty ones
+// returns loaded pages (to be saved) and ids of dropped pages (to be removed)
+func (m *Meta) paginate(pageSize int) (pages map[uint32]*Meta, dropped []uint32, err error) {
+	if m.pages == nil { // a flat meta becomes a single page
+		m.pages = []*metaPage{{id: m.takeNextPageId(), from: 0, loaded: true}}
+	}
+	// chunks could move to pages which are not loaded yet (e.g. min changed after deletion)
+	for _, cm := range m.chunks {
+		if !m.pages[m.pagePos(cm.min)].loaded {
+			err = m.load(cm.min, cm.min)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	pages = make(map[uint32]*Meta)
+	newPages := make([]*metaPage, 0, len(m.pages))
+	for i, p := range m.pages {
+		if !p.loaded {
+			newPages = append(newPages, p)
+			continue
+		}
+		chunks := m.pageChunks(i)
+		if len(chunks) == 0 && len(m.pages) > 1 {
+			dropped = append(dropped, p.id) // its range is taken by the previous page
+			continue
+		}
+		// split overflown pages in pieces of pageSize
+		for len(chunks) > 0 || p != nil {
+			if p == nil {
+				p = &metaPage{id: m.takeNextPageId(), from: chunks[0].min, loaded: true}
+			}
+			piece := chunks
+			if len(piece) > 2*pageSize {
+				piece = chunks[:pageSize]
+			}
+			chunks = chunks[len(piece):]
+			p.size = uint32(len(piece))
+			p.stats = newPageStats(piece, m.chunkSize)
+			pages[p.id] = m.subMeta(piece)
+			newPages = append(newPages, p)
+			p = nil
+		}
+	}
+	if len(newPages) == 0 { // all pages are empty, keep one
+		id := dropped[len(dropped)-1]
+		dropped = dropped[:len(dropped)-1]
+		newPages = append(newPages, &metaPage{id: id, loaded: true})
+		pages[id] = &Meta{}
+	}
+	newPages[0].from = 0 // the first page always covers the beginning of the value space
+	m.pages = newPages
+	return pages, dropped, nil
+}
+
+// changes serializes pages and the summary which differ from the persisted ones
+func (m *Meta) changes(pageSize int) (*metaChanges, error) {
+	pages, dropped, err := m.paginate(pageSize)
+	if err != nil {
+		return nil, err
+	}
+	c := &metaChanges{
+		pages:   make(map[uint32][]byte),
+		crcs:    make(map[uint32]uint32),
+		dropped: dropped,
+	}
+	for _, p := range m.pages {
+		page, ok := pages[p.id]
+		if !ok {
+			continue // not loaded, so not changed
+		}
+		blob, err := page.Serialize()
+		if err != nil {
+			return nil, err
+		}
+		crc := crc32.Checksum(blob, crcTable)
+		if p.crc == crc {
+			continue
+		}
+		c.pages[p.id], c.crcs[p.id] = blob, crc
+	}
+	summary, err := m.serializeSummary()
+	if err != nil {
+		return nil, err
+	}
+	c.summaryCrc = crc32.Checksum(summary, crcTable)
+	if c.summaryCrc != m.summaryCrc {
+		c.summary = summary
+	}
+	return c, nil
+}
+
+// persisted remembers checksums of the written changes
+func (m *Meta) persisted(c *metaChanges) {
+	for _, p := range m.pages {
+		if crc, ok := c.crcs[p.id]; ok {
+			p.crc = crc
+		}
+	}
+	m.summaryCrc = c.summaryCrc
+}
+
+// forgetPersisted makes the next save write all loaded pages,
+// used when written changes were rolled back by the caller
+func (m *Meta) forgetPersisted() {
+	for _, p := range m.pages {
+		p.crc = 0
+	}
+	m.summaryCrc = 0
+}
+
+// subMeta makes a meta of the given chunks (with their filters) to be stored as a page
+func (m *Meta) subMeta(chunks []*ChunkMeta) *Meta {
+	page := &Meta{chunks: chunks}
+	for _, cm := range chunks {
+		if f, ok := m.filters[cm.id]; ok {
+			page.setFilter(cm.id, f)
+		}
+	}
+	return page
+}
+
+func (m *Meta) takeNextPageId() (id uint32) {
+	id = m.nextPageId
+	m.nextPageId++
+	return
+}
+
+// serializeSummary makes a blob of pages summary (not the pages themselves)
+func (m *Meta) serializeSummary() ([]byte, error) {
+	ids := make([]uint32, 0, len(m.pages))
+	froms := make([]uint32, 0, len(m.pages))
+	sizes := make([]uint32, 0, len(m.pages))
+	// page stats: items (low and high bits), min and max chunk sizes, max chunk size (0 if unknown), fill histograms
+	stats := make([][]uint32, 6)
+	for _, p := range m.pages {
+		ids = append(ids, p.id)
+		froms = append(froms, p.from)
+		sizes = append(sizes, p.size)
+		ps := p.stats
+		if ps == nil {
+			ps = &pageStats{}
+		}
+		stats[0] = append(stats[0], uint32(ps.items))
+		stats[1] = append(stats[1], uint32(ps.items>>32))
+		stats[2] = append(stats[2], ps.minSize)
+		stats[3] = append(stats[3], ps.maxSize)
+		stats[4] = append(stats[4], ps.chunkSize)
+		stats[5] = append(stats[5], ps.fill[:]...)
+	}
+	serializedState := [][]uint32{
+		{m.nextId, m.nextPageId},
+		intcomp.CompressUint32(ids, nil),
+		intcomp.CompressUint32(froms, nil),
+		intcomp.CompressUint32(sizes, nil),
+	}
+	for _, column := range stats {
+		serializedState = append(serializedState, intcomp.CompressUint32(column, nil))
+	}
+	var gobBuf bytes.Buffer
+	err := gob.NewEncoder(&gobBuf).Encode(serializedState)
+	if err != nil {
+		return nil, err
+	}
+	return frame(frameKindMetaSummary, gobBuf.Bytes()), nil
+}
+
+// unserializeSummary makes a meta with all pages not loaded
+func unserializeSummary(data []byte) (*Meta, error) {
+	data, err := unframe(frameKindMetaSummary, data)
+	if err != nil {
+		return nil, &ErrCorrupted{Meta: true, Reason: err.Error()}
+	}
+	var serializedState [][]uint32
+	err = gob.NewDecoder(bytes.NewBuffer(data)).Decode(&serializedState)
+	if err != nil {
+		return nil, &ErrCorrupted{Meta: true, Reason: fmt.Sprintf("unable to decode: %s", err)}
+	}
+	if len(serializedState) < 4 || len(serializedState[0]) != 2 {
+		return nil, &ErrCorrupted{Meta: true, Reason: "unexpected summary layout"}
+	}
+	// columns are decoded through uncompressUint32, it checks they hold as many items as the ids one
+	n, err := uncompressedLen(serializedState[1])
+	if err != nil || n == 0 {
+		return nil, &ErrCorrupted{Meta: true, Reason: "summary has no pages"}
+	}
+	columns := make([][]uint32, 3)
+	for i := range columns {
+		columns[i], err = uncompressUint32(serializedState[1+i], n)
+		if err != nil {
+			return nil, &ErrCorrupted{Meta: true, Reason: fmt.Sprintf("summary columns: %s", err)}
+		}
+	}
+	ids, froms, sizes := columns[0], columns[1], columns[2]
+
+	// page stats are missing in summaries of older versions
+	var stats [][]uint32
+	if len(serializedState) >= 10 {
+		for i, column := range serializedState[4:10] {
+			expected := n
+			if i == 5 {
+				expected *= fillHistogramBuckets
+			}
+			column, err := uncompressUint32(column, expected)
+			if err != nil {
+				return nil, &ErrCorrupted{Meta: true, Reason: fmt.Sprintf("summary columns: %s", err)}
+			}
+			stats = append(stats, column)
+		}
+	}
+
+	meta := NewMeta()
+	meta.nextId, meta.nextPageId = serializedState[0][0], serializedState[0][1]
+	meta.pages = make([]*metaPage, len(ids))
+	for i := range ids {
+		meta.pages[i] = &metaPage{id: ids[i], from: froms[i], size: sizes[i]}
+		if stats != nil && stats[4][i] > 0 {
+			ps := &pageStats{
+				chunks:    sizes[i],
+				items:     uint64(stats[0][i]) | uint64(stats[1][i])<<32,
+				minSize:   stats[2][i],
+				maxSize:   stats[3][i],
+				chunkSize: stats[4][i],
+			}
+			copy(ps.fill[:], stats[5][i*fillHistogramBuckets:])
+			meta.pages[i].stats = ps
+		}
+	}
+	return meta, nil
+}
+
+// findPosForMin returns the position of the first chunk with min >= item
+func findPosForMin(s []*ChunkMeta, item uint32) int {
+	return sort.Search(len(s), func(i int) bool { return s[i].min >= item })
+}
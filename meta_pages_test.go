@@ -0,0 +1,218 @@
+package sorted_array
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/exp/rand"
+	"golang.org/x/exp/slices"
+	"strings"
+	"testing"
+)
+
+// countingBlobStorage counts reads of meta pages (and fails saves of the meta if asked)
+type countingBlobStorage struct {
+	BlobStorage
+	pageReads     int
+	failMetaSaves bool
+}
+
+func (s *countingBlobStorage) SaveBlobs(blobs map[string][]byte) error {
+	if _, ok := blobs[metaBlobKey]; ok && s.failMetaSaves {
+		return fmt.Errorf("no space left")
+	}
+	return s.BlobStorage.SaveBlobs(blobs)
+}
+
+func (s *countingBlobStorage) ReadBlobs(keys []string) (map[string][]byte, error) {
+	for _, key := range keys {
+		if strings.HasPrefix(key, "_m") {
+			s.pageReads++
+		}
+	}
+	return s.BlobStorage.ReadBlobs(keys)
+}
+
+func TestMetaPagesLazyLoading(t *testing.T) {
+	blobs := &countingBlobStorage{BlobStorage: NewInMemoryBlobStorage()}
+	storage := NewBlobChunkStorage(blobs)
+	storage.metaPageSize = 2
+
+	arr := NewSortedArray(2, storage)
+	items := make([]uint32, 0, 200)
+	for i := uint32(0); i < 200; i++ {
+		items = append(items, i)
+	}
+	require.NoError(t, arr.Add(items))
+	require.NoError(t, arr.Flush())
+
+	meta, err := storage.ReadMeta()
+	require.NoError(t, err)
+	require.Greater(t, len(meta.pages), 10)
+
+	// a point query only touches a few pages
+	blobs.pageReads = 0
+	arr = NewSortedArray(2, storage)
+	exists, err := arr.Contains(150)
+	require.NoError(t, err)
+	require.True(t, exists)
+	require.LessOrEqual(t, blobs.pageReads, 3)
+
+	// a modification too
+	require.NoError(t, arr.Add([]uint32{1000}))
+	require.NoError(t, arr.Flush())
+	require.LessOrEqual(t, blobs.pageReads, 6)
+
+	require.EqualValues(t, append(items, 1000), NewSortedArray(2, storage).ToSlice())
+}
+
+func TestMetaPagesSurviveFailedSave(t *testing.T) {
+	blobs := &countingBlobStorage{BlobStorage: NewInMemoryBlobStorage()}
+	storage := NewBlobChunkStorage(blobs)
+	storage.metaPageSize = 2
+	arr := NewSortedArray(2, storage)
+	require.NoError(t, arr.Add(sequence(0, 200, 1)))
+	require.NoError(t, arr.Flush())
+	pages := len(arr.meta.pages)
+
+	// leading pages become empty and are dropped, but the new summary can't be saved
+	require.NoError(t, arr.Delete(sequence(0, 100, 1)))
+	blobs.failMetaSaves = true
+	require.ErrorContains(t, arr.Flush(), "no space left")
+
+	// the old summary still finds all its pages
+	blobs.failMetaSaves = false
+	meta, err := storage.ReadMeta()
+	require.NoError(t, err)
+	require.Len(t, meta.pages, pages)
+	require.NoError(t, meta.loadAll())
+}
+
+func TestMetaPagesRandomized(t *testing.T) {
+	storage := NewBlobChunkStorage(NewInMemoryBlobStorage())
+	storage.metaPageSize = 2
+	model := make(map[uint32]struct{})
+
+	for i := 0; i < 300; i++ {
+		arr := NewSortedArray(3, storage) // reopen from the storage every time
+		items := make([]uint32, 0)
+		for j := rand.Int() % 20; j > 0; j-- {
+			items = append(items, uint32(rand.Int()%500))
+		}
+		if rand.Int()%3 == 0 {
+			require.NoError(t, arr.Delete(items))
+			for _, item := range items {
+				delete(model, item)
+			}
+		} else {
+			require.NoError(t, arr.Add(items))
+			for _, item := range items {
+				model[item] = struct{}{}
+			}
+		}
+		require.NoError(t, arr.Flush())
+	}
+
+	expected := make([]uint32, 0, len(model))
+	for item := range model {
+		expected = append(expected, item)
+	}
+	slices.Sort(expected)
+	require.EqualValues(t, expected, NewSortedArray(3, storage).ToSlice())
+}
+
+func TestFlatMetaIsConvertedToPages(t *testing.T) {
+	blobs := NewInMemoryBlobStorage()
+	storage := NewBlobChunkStorage(blobs)
+
+	// imitate the layout written before paging
+	meta := NewMeta()
+	meta.Add([]*ChunkMeta{{meta.TakeNextId(), 10, 20, 2}})
+	flat, err := meta.Serialize()
+	require.NoError(t, err)
+	blobs.blobs[metaBlobKey] = flat
+	require.NoError(t, storage.Save(map[uint32]*Chunk{0: NewChunk([]uint32{10, 20})}))
+
+	arr := NewSortedArray(2, storage)
+	require.EqualValues(t, []uint32{10, 20}, arr.ToSlice())
+	require.NoError(t, arr.Add([]uint32{30}))
+	require.NoError(t, arr.Flush())
+
+	require.EqualValues(t, frameKindMetaSummary, frameKind(blobs.blobs[metaBlobKey]))
+	require.EqualValues(t, []uint32{10, 20, 30}, NewSortedArray(2, storage).ToSlice())
+}
+
+func TestMetaIndexFollowsChanges(t *testing.T) {
+	meta := NewMeta()
+	c1 := &ChunkMeta{meta.TakeNextId(), 10, 15, 1}
+	meta.Add([]*ChunkMeta{c1})
+	require.Equal(t, c1, meta.GetChunkById(c1.id)) // index is built here
+
+	c2 := &ChunkMeta{meta.TakeNextId(), 20, 25, 1}
+	meta.Add([]*ChunkMeta{c2})
+	require.Equal(t, c2, meta.GetChunkById(c2.id))
+
+	meta.Remove(c1)
+	require.Nil(t, meta.GetChunkById(c1.id))
+}
+
+// countingSaves counts written blobs
+type countingSaves struct {
+	BlobStorage
+	pageWrites, summaryWrites int
+}
+
+func (s *countingSaves) SaveBlobs(blobs map[string][]byte) error {
+	for key := range blobs {
+		if strings.HasPrefix(key, "_m") {
+			s.pageWrites++
+		} else if key == metaBlobKey {
+			s.summaryWrites++
+		}
+	}
+	return s.BlobStorage.SaveBlobs(blobs)
+}
+
+func TestMetaPagesIncrementalSave(t *testing.T) {
+	blobs := &countingSaves{BlobStorage: NewInMemoryBlobStorage()}
+	storage := NewBlobChunkStorage(blobs)
+	storage.metaPageSize = 2
+
+	arr := NewSortedArray(2, storage)
+	items := make([]uint32, 0, 200)
+	for i := uint32(0); i < 200; i++ {
+		items = append(items, i*10)
+	}
+	require.NoError(t, arr.Add(items))
+	require.NoError(t, arr.Flush())
+	require.Greater(t, blobs.pageWrites, 10)
+
+	// a size change of one chunk rewrites only its page
+	blobs.pageWrites, blobs.summaryWrites = 0, 0
+	arr = NewSortedArray(2, storage)
+	require.NoError(t, arr.Delete([]uint32{1000}))
+	require.NoError(t, arr.Flush())
+	require.Equal(t, 1, blobs.pageWrites)
+	require.Equal(t, 1, blobs.summaryWrites) // page stats changed (page boundaries are the same)
+
+	// loaded but untouched pages are not written again
+	blobs.pageWrites, blobs.summaryWrites = 0, 0
+	_, err := arr.Contains(1500)
+	require.NoError(t, err)
+	require.NoError(t, arr.Delete([]uint32{10}))
+	require.NoError(t, arr.Flush())
+	require.Equal(t, 1, blobs.pageWrites)
+	require.Equal(t, 1, blobs.summaryWrites)
+
+	// the summary is not written if sizes of chunks are the same
+	blobs.pageWrites, blobs.summaryWrites = 0, 0
+	require.NoError(t, arr.Delete([]uint32{1500}))
+	require.NoError(t, arr.Add([]uint32{1501}))
+	require.NoError(t, arr.Flush())
+	require.Equal(t, 1, blobs.pageWrites)
+	require.Equal(t, 0, blobs.summaryWrites)
+
+	items = append(items[:1], items[2:]...)    // 10
+	items = append(items[:99], items[100:]...) // 1000
+	items[148] = 1501
+	require.EqualValues(t, items, NewSortedArray(2, storage).ToSlice())
+}
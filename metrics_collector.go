@@ -0,0 +1,170 @@
+package sorted_array
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are upper bounds (seconds) of duration histograms
+var latencyBuckets = []float64{0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+var storageOps = []StorageOp{StorageRead, StorageSave, StorageRemove, StorageReadMeta, StorageSaveMeta, StorageReadMetaPages}
+
+// MetricsCollector is an Observer which aggregates events in memory
+// and exposes them in the Prometheus text format (it can serve /metrics as an http.Handler)
+// one collector can observe many arrays
+type MetricsCollector struct {
+	mu             sync.Mutex
+	chunksLoaded   uint64
+	chunksReleased uint64
+	splits         uint64
+	merges         uint64
+	flush          latencyHistogram
+	flushErrors    uint64
+	storage        map[StorageOp]*storageMetrics
+}
+
+type storageMetrics struct {
+	calls, chunks, errors uint64
+	latency               latencyHistogram
+}
+
+type latencyHistogram struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(latencyBuckets))
+	}
+	seconds := d.Seconds()
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+func (c *MetricsCollector) ChunksLoaded(ids []uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.chunksLoaded += uint64(len(ids))
+}
+func (c *MetricsCollector) ChunksReleased(ids []uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.chunksReleased += uint64(len(ids))
+}
+func (c *MetricsCollector) ChunkSplit(uint32, uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.splits++
+}
+func (c *MetricsCollector) ChunksMerged(uint32, uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.merges++
+}
+func (c *MetricsCollector) Flushed(d time.Duration, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.flush.observe(d)
+	if err != nil {
+		c.flushErrors++
+	}
+}
+func (c *MetricsCollector) StorageCalled(op StorageOp, ids int, d time.Duration, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m, ok := c.storage[op]
+	if !ok {
+		m = &storageMetrics{}
+		c.storage[op] = m
+	}
+	m.calls++
+	m.chunks += uint64(ids)
+	m.latency.observe(d)
+	if err != nil {
+		m.errors++
+	}
+}
+
+// WritePrometheus writes all metrics in the Prometheus text exposition format
+func (c *MetricsCollector) WritePrometheus(w io.Writer) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	bw := bufio.NewWriter(w)
+	counter := func(name, help string, value uint64) {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, value)
+	}
+	counter("sorted_array_chunks_loaded_total", "Chunks read from the storage into memory.", c.chunksLoaded)
+	counter("sorted_array_chunks_released_total", "Chunks freed from memory.", c.chunksReleased)
+	counter("sorted_array_chunk_splits_total", "Chunks split in two.", c.splits)
+	counter("sorted_array_chunk_merges_total", "Chunks merged into a neighbour.", c.merges)
+	counter("sorted_array_flush_errors_total", "Failed flushes.", c.flushErrors)
+	writeHistogram(bw, "sorted_array_flush_duration_seconds", "Duration of writing pending changes.", "", &c.flush, true)
+
+	perOp := func(name, help, typ string, value func(m *storageMetrics) uint64) {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+		for _, op := range storageOps {
+			if m, ok := c.storage[op]; ok {
+				fmt.Fprintf(bw, "%s{op=%q} %d\n", name, op, value(m))
+			}
+		}
+	}
+	perOp("sorted_array_storage_calls_total", "Calls of ChunkStorage methods.", "counter", func(m *storageMetrics) uint64 { return m.calls })
+	perOp("sorted_array_storage_chunks_total", "Chunk ids (meta page ids for read_meta_pages) passed to ChunkStorage methods.", "counter", func(m *storageMetrics) uint64 { return m.chunks })
+	perOp("sorted_array_storage_errors_total", "Failed calls of ChunkStorage methods.", "counter", func(m *storageMetrics) uint64 { return m.errors })
+	header := true
+	for _, op := range storageOps {
+		if m, ok := c.storage[op]; ok {
+			writeHistogram(bw, "sorted_array_storage_duration_seconds", "Duration of ChunkStorage calls.", fmt.Sprintf("op=%q", op), &m.latency, header)
+			header = false
+		}
+	}
+	return bw.Flush()
+}
+
+// writeHistogram writes a histogram with cumulative buckets, labels are added to every line
+func writeHistogram(w io.Writer, name, help, labels string, h *latencyHistogram, header bool) {
+	if header {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	}
+	prefix := labels
+	if prefix != "" {
+		prefix += ","
+	}
+	cumulative := uint64(0)
+	for i, bound := range latencyBuckets {
+		if h.counts != nil {
+			cumulative += h.counts[i]
+		}
+		fmt.Fprintf(w, "%s_bucket{%sle=%q} %d\n", name, prefix, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", name, prefix, h.count)
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, labels, strconv.FormatFloat(h.sum, 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, h.count)
+}
+
+// ServeHTTP exposes metrics for a Prometheus scraper
+func (c *MetricsCollector) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_ = c.WritePrometheus(w)
+}
+
+func NewMetricsCollector() *MetricsCollector {
+	return &MetricsCollector{storage: make(map[StorageOp]*storageMetrics)}
+}
@@ -0,0 +1,180 @@
+package sorted_array
+
+import (
+	"golang.org/x/exp/slices"
+	"math"
+)
+
+// A multiset array keeps a count per item: Add increments counts, Delete decrements them
+// and an item is gone when its count reaches 0. Counts are kept in chunks as a column
+// parallel to items (see Chunk.counts), the meta and streams (GetInRange) see distinct items only.
+
+// WithCounts makes the array a multiset, the option must be used every time the storage is opened
+// (chunks written without counts are read as items with the count of 1)
+func WithCounts() ArrayOption {
+	return func(a *SortedArray) { a.counted = true }
+}
+
+// CountInRange returns the sum of counts of items within [min,max] (the number of items for sets)
+func (a *SortedArray) CountInRange(min, max uint32) (uint64, error) {
+	err := a.initMeta()
+	if err == nil {
+		err = a.meta.load(min, max)
+	}
+	if err != nil {
+		return 0, err
+	}
+	total := uint64(0)
+	for _, cm := range a.meta.FindRelevantForReadRange(min, max) {
+		chunk, err := a.readChunk(cm)
+		if err != nil {
+			return 0, err
+		}
+		if chunk == nil {
+			continue // skipped as corrupted
+		}
+		total += chunk.CountInRange(min, max)
+		a.releaseChunks([]uint32{cm.id})
+	}
+	return total, nil
+}
+
+// newChunk makes a chunk of the array's kind (with counts, values or none)
+func (a *SortedArray) newChunk(items []uint32) *Chunk {
+	if a.counted {
+		return NewCountedChunk(items)
+	}
+	if a.valueWidth > 0 {
+		return NewValueChunk(a.valueWidth, items)
+	}
+	return NewChunk(items)
+}
+
+// NewCountedChunk makes a multiset chunk, repeated items are counted
+func NewCountedChunk(items []uint32) *Chunk {
+	c := &Chunk{counts: make([]uint32, 0)}
+	c.setItems(nil, arrayContainer)
+	c.addCounts(items)
+	return c
+}
+
+// Count returns how many times the item was added (0 or 1 for chunks without counts)
+func (c *Chunk) Count(item uint32) uint32 {
+	if !c.Contains(item) {
+		return 0
+	}
+	if c.counts == nil {
+		return 1
+	}
+	return c.counts[c.rank(item)]
+}
+
+// CountInRange returns the sum of counts of items within [from,to]
+func (c *Chunk) CountInRange(from, to uint32) uint64 {
+	if from > to {
+		panic("from > to")
+	}
+	lo, hi := c.rank(from), c.rank(to)
+	if c.containerContains(to) {
+		hi++
+	}
+	if c.counts == nil {
+		return uint64(hi - lo)
+	}
+	total := uint64(0)
+	for _, n := range c.counts[lo:hi] {
+		total += uint64(n)
+	}
+	return total
+}
+
+// addCounts adds occurrences of items (repeated items count several times) to a multiset chunk
+// counts saturate at MaxUint32, returns the number of NEW items
+func (c *Chunk) addCounts(items []uint32) (added int) {
+	if len(items) == 0 {
+		return
+	}
+	items = slices.Clone(items) // the caller's slice is left as is
+	slices.Sort(items)
+	existing := c.ToSlice()
+	merged := make([]uint32, 0, len(existing)+len(items))
+	counts := make([]uint32, 0, cap(merged))
+	i := 0
+	for j := 0; j < len(items); {
+		// 1. occurrences of the item
+		k := j + 1
+		for k < len(items) && items[k] == items[j] {
+			k++
+		}
+		n := uint32(k - j)
+		// 2. copy smaller existing items as is
+		for i < len(existing) && existing[i] < items[j] {
+			merged, counts = append(merged, existing[i]), append(counts, c.counts[i])
+			i++
+		}
+		// 3. increment or insert
+		if i < len(existing) && existing[i] == items[j] {
+			if n > math.MaxUint32-c.counts[i] {
+				n = math.MaxUint32
+			} else {
+				n += c.counts[i]
+			}
+			i++
+		} else {
+			added++
+		}
+		merged, counts = append(merged, items[j]), append(counts, n)
+		j = k
+	}
+	merged, counts = append(merged, existing[i:]...), append(counts, c.counts[i:]...)
+	c.setItems(merged, arrayContainer)
+	c.counts = counts
+	c.optimize()
+	return
+}
+
+// removeCounts removes one occurrence per item from a multiset chunk (all occurrences if all is set)
+// returns the number of removed occurrences
+func (c *Chunk) removeCounts(items []uint32, all bool) (removed int) {
+	if len(items) == 0 {
+		return
+	}
+	items = slices.Clone(items)
+	slices.Sort(items)
+	existing := c.ToSlice()
+	kept, counts := existing[:0], c.counts[:0] // in place, the write position never passes the read one
+	j := 0
+	for i, item := range existing {
+		count := c.counts[i]
+		for j < len(items) && items[j] < item {
+			j++
+		}
+		n := uint32(0)
+		for j < len(items) && items[j] == item {
+			n++
+			j++
+		}
+		if n > 0 && (all || n >= count) {
+			removed += int(count)
+			continue // the item is gone
+		}
+		count -= n
+		removed += int(n)
+		kept, counts = append(kept, item), append(counts, count)
+	}
+	if removed == 0 {
+		return
+	}
+	c.setItems(kept, arrayContainer)
+	c.counts = counts
+	c.optimize()
+	return
+}
+
+// removeAll removes items whatever their counts are
+func (c *Chunk) removeAll(items []uint32) (removed int) {
+	if c.counts != nil {
+		return c.removeCounts(items, true)
+	}
+	return c.Remove(items)
+}
@@ -0,0 +1,220 @@
+package sorted_array
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/exp/rand"
+	"math"
+	"testing"
+)
+
+func TestCountedChunk(t *testing.T) {
+	input := []uint32{5, 1, 5, 5, 3}
+	c := NewCountedChunk(input)
+	require.EqualValues(t, []uint32{5, 1, 5, 5, 3}, input) // the input is not changed
+	require.EqualValues(t, []uint32{1, 3, 5}, c.ToSlice())
+	require.Equal(t, 3, c.Len())
+	require.EqualValues(t, 3, c.Count(5))
+	require.EqualValues(t, 0, c.Count(4))
+	require.EqualValues(t, 5, c.CountInRange(0, math.MaxUint32))
+	require.EqualValues(t, 4, c.CountInRange(2, 5))
+
+	require.Equal(t, 1, c.Add([]uint32{3, 7}))
+	require.EqualValues(t, []uint32{1, 3, 5, 7}, c.ToSlice())
+	require.EqualValues(t, 2, c.Count(3))
+
+	// one occurrence is removed per item
+	input = []uint32{9, 5, 1, 5}
+	require.Equal(t, 3, c.Remove(input))
+	require.EqualValues(t, []uint32{9, 5, 1, 5}, input)
+	require.EqualValues(t, []uint32{3, 5, 7}, c.ToSlice())
+	require.EqualValues(t, 1, c.Count(5))
+	require.Equal(t, 0, c.Remove(nil))
+
+	// counts saturate
+	c.counts[0] = math.MaxUint32 - 1
+	c.Add([]uint32{3, 3, 3})
+	require.EqualValues(t, uint32(math.MaxUint32), c.Count(3))
+
+	require.Equal(t, math.MaxUint32+1, c.removeAll([]uint32{3, 5}))
+	require.EqualValues(t, []uint32{7}, c.ToSlice())
+
+	c.Remove([]uint32{7})
+	b, err := c.Serialize()
+	require.NoError(t, err)
+	c, err = UnserializeChunk(b)
+	require.NoError(t, err)
+	require.Equal(t, 0, c.Len())
+	require.Equal(t, 1, c.Add([]uint32{2})) // still a multiset
+	require.Equal(t, 0, c.Add([]uint32{2}))
+	require.EqualValues(t, 2, c.Count(2))
+}
+
+func TestCountedChunkContainers(t *testing.T) {
+	tests := []struct {
+		items []uint32
+		kind  containerKind
+	}{
+		{[]uint32{1, 100, 10_000}, arrayContainer},
+		{sequence(0, 1000, 3), bitmapContainer},
+		{sequence(0, 1000, 1), runContainer},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d", tt.kind), func(t *testing.T) {
+			c := NewCountedChunk(append(tt.items, tt.items[1:]...))
+			require.Equal(t, tt.kind, c.kind)
+
+			b, err := c.Serialize()
+			require.NoError(t, err)
+			c2, err := UnserializeChunk(b)
+			require.NoError(t, err)
+			require.Equal(t, c.ToSlice(), c2.ToSlice())
+			require.Equal(t, c.counts, c2.counts)
+			require.EqualValues(t, 1, c2.Count(tt.items[0]))
+			require.EqualValues(t, 2, c2.Count(tt.items[1]))
+
+			// split and merge keep counts along with items
+			tail := c2.splitAt(2)
+			require.EqualValues(t, []uint32{1, 2}, c2.counts)
+			require.EqualValues(t, 2, tail.Count(tt.items[2]))
+			c2.absorb(tail)
+			require.Equal(t, c.ToSlice(), c2.ToSlice())
+			require.Equal(t, c.counts, c2.counts)
+		})
+	}
+
+	// counts must be positive
+	c := NewChunk([]uint32{1, 2})
+	c.counts = []uint32{1, 0}
+	b, err := c.Serialize()
+	require.NoError(t, err)
+	_, err = UnserializeChunk(b)
+	require.ErrorAs(t, err, new(*ErrCorrupted))
+}
+
+func TestCountedChunkSearchesContainers(t *testing.T) {
+	for _, items := range [][]uint32{
+		{1, 100, 10_000},
+		sequence(10, 1000, 3),
+		append(sequence(10, 500, 1), sequence(600, 1000, 1)...),
+	} {
+		c := NewCountedChunk(append(items, items[len(items)/2:]...))
+		t.Run(fmt.Sprintf("%d", c.kind), func(t *testing.T) {
+			model := make(map[uint32]uint32)
+			for i, item := range items {
+				model[item] = 1
+				if i >= len(items)/2 {
+					model[item] = 2
+				}
+			}
+			for item := uint32(0); item < 10_010; item++ {
+				require.Equal(t, model[item], c.Count(item), "item %d", item)
+			}
+			for i := 0; i < 1000; i++ {
+				from := uint32(rand.Intn(10_010))
+				to := from + uint32(rand.Intn(2000))
+				expected := uint64(0)
+				for item, n := range model {
+					if item >= from && item <= to {
+						expected += uint64(n)
+					}
+				}
+				require.Equal(t, expected, c.CountInRange(from, to), "[%d,%d]", from, to)
+			}
+			require.EqualValues(t, 0, c.CountInRange(math.MaxUint32, math.MaxUint32))
+
+			// counts are looked up in the container, items are not copied out
+			require.Zero(t, testing.AllocsPerRun(10, func() {
+				c.Count(items[len(items)-1])
+				c.CountInRange(0, math.MaxUint32)
+			}))
+		})
+	}
+}
+
+func TestMultiset(t *testing.T) {
+	for _, storage := range []string{"memory", "blobs"} {
+		for _, chunkSize := range []uint32{1, 3, 16} {
+			t.Run(fmt.Sprintf("%s/%d", storage, chunkSize), func(t *testing.T) {
+				var s ChunkStorage = NewInMemoryChunkStorage()
+				if storage == "blobs" {
+					s = NewBlobChunkStorage(NewInMemoryBlobStorage())
+				}
+				runMultisetModel(t, chunkSize, s)
+			})
+		}
+	}
+}
+
+// runMultisetModel compares a multiset array with a map of counts, the array is reopened after flushes
+func runMultisetModel(t *testing.T, chunkSize uint32, storage ChunkStorage) {
+	rnd := rand.New(rand.NewSource(1))
+	model := make(map[uint32]uint64)
+	arr := NewSortedArray(chunkSize, storage, WithCounts())
+	for step := 0; step < 200; step++ {
+		items := make([]uint32, 1+rnd.Intn(10))
+		for i := range items {
+			items[i] = uint32(rnd.Intn(50))
+		}
+		if rnd.Intn(3) == 0 {
+			require.NoError(t, arr.Delete(items))
+			for _, item := range items {
+				if model[item] > 0 {
+					model[item]--
+				}
+			}
+		} else {
+			require.NoError(t, arr.Add(items))
+			for _, item := range items {
+				model[item]++
+			}
+		}
+		if step%20 == 0 {
+			require.NoError(t, arr.Flush())
+			arr = NewSortedArray(chunkSize, storage, WithCounts())
+		}
+
+		min := uint32(rnd.Intn(50))
+		max := min + uint32(rnd.Intn(20))
+		expected, distinct := uint64(0), make([]uint32, 0)
+		for item := uint32(0); item < 50; item++ {
+			if model[item] > 0 {
+				distinct = append(distinct, item)
+				if item >= min && item <= max {
+					expected += model[item]
+				}
+			}
+		}
+		count, err := arr.CountInRange(min, max)
+		require.NoError(t, err)
+		require.Equal(t, expected, count, "step %d [%d,%d]", step, min, max)
+		require.EqualValues(t, distinct, arr.ToSlice())
+	}
+	require.NoError(t, arr.Flush())
+	problems, err := arr.Validate()
+	require.NoError(t, err)
+	require.Empty(t, problems)
+}
+
+func TestMultisetReadsChunksWithoutCounts(t *testing.T) {
+	storage := NewInMemoryChunkStorage()
+	arr := NewSortedArray(4, storage)
+	require.NoError(t, arr.Add(sequence(0, 10, 1)))
+	require.NoError(t, arr.Flush())
+
+	arr = NewSortedArray(4, storage, WithCounts())
+	count, err := arr.CountInRange(0, 9)
+	require.NoError(t, err)
+	require.EqualValues(t, 10, count)
+	require.NoError(t, arr.Add([]uint32{1, 5, 5}))
+	require.NoError(t, arr.Delete([]uint32{9}))
+	require.NoError(t, arr.Flush())
+
+	arr = NewSortedArray(4, storage, WithCounts())
+	count, err = arr.CountInRange(0, 9)
+	require.NoError(t, err)
+	require.EqualValues(t, 12, count)
+	count, err = arr.CountInRange(5, 5)
+	require.NoError(t, err)
+	require.EqualValues(t, 3, count)
+}
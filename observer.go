@@ -0,0 +1,84 @@
+package sorted_array
+
+import (
+	"time"
+)
+
+// Observer receives events of an array, e.g. to export metrics or traces
+// it must be safe for concurrent use (GetInRange loads chunks in a separate goroutine)
+type Observer interface {
+	ChunksLoaded(ids []uint32)   // chunks read from the storage
+	ChunksReleased(ids []uint32) // chunks freed from memory
+	ChunkSplit(id, newId uint32)
+	ChunksMerged(id, removedId uint32)                               // items of removedId moved to id
+	Flushed(d time.Duration, err error)                              // pending changes written (or failed to)
+	StorageCalled(op StorageOp, ids int, d time.Duration, err error) // ids is the number of chunk ids in the call
+}
+
+// StorageOp names ChunkStorage methods
+type StorageOp string
+
+const (
+	StorageRead     StorageOp = "read"
+	StorageSave     StorageOp = "save"
+	StorageRemove   StorageOp = "remove"
+	StorageReadMeta StorageOp = "read_meta"
+	StorageSaveMeta StorageOp = "save_meta"
+	// StorageReadMetaPages is a lazy read of meta pages (ids is the number of pages), see meta_pages.go
+	StorageReadMetaPages StorageOp = "read_meta_pages"
+)
+
+// WithObserver makes the array report its events to the observer
+func WithObserver(o Observer) ArrayOption {
+	return func(a *SortedArray) { a.observer = o }
+}
+
+type nopObserver struct{}
+
+func (nopObserver) ChunksLoaded([]uint32)                              {}
+func (nopObserver) ChunksReleased([]uint32)                            {}
+func (nopObserver) ChunkSplit(uint32, uint32)                          {}
+func (nopObserver) ChunksMerged(uint32, uint32)                        {}
+func (nopObserver) Flushed(time.Duration, error)                       {}
+func (nopObserver) StorageCalled(StorageOp, int, time.Duration, error) {}
+
+// observedStorage reports every call to the observer
+type observedStorage struct {
+	ChunkStorage
+	observer Observer
+}
+
+func (s *observedStorage) Read(chunkIds []uint32) (chunks map[uint32]*Chunk, err error) {
+	defer s.observe(StorageRead, len(chunkIds), time.Now(), &err)
+	return s.ChunkStorage.Read(chunkIds)
+}
+func (s *observedStorage) Save(chunks map[uint32]*Chunk) (err error) {
+	defer s.observe(StorageSave, len(chunks), time.Now(), &err)
+	return s.ChunkStorage.Save(chunks)
+}
+func (s *observedStorage) Remove(chunkIds []uint32) (err error) {
+	defer s.observe(StorageRemove, len(chunkIds), time.Now(), &err)
+	return s.ChunkStorage.Remove(chunkIds)
+}
+func (s *observedStorage) ReadMeta() (meta *Meta, err error) {
+	defer s.observe(StorageReadMeta, 0, time.Now(), &err)
+	meta, err = s.ChunkStorage.ReadMeta()
+	if err == nil && meta.pageLoader != nil {
+		load := meta.pageLoader
+		meta.pageLoader = func(pageIds []uint32) (pages map[uint32][]byte, err error) {
+			defer s.observe(StorageReadMetaPages, len(pageIds), time.Now(), &err)
+			return load(pageIds)
+		}
+	}
+	return
+}
+func (s *observedStorage) SaveMeta(meta *Meta) (err error) {
+	defer s.observe(StorageSaveMeta, 0, time.Now(), &err)
+	return s.ChunkStorage.SaveMeta(meta)
+}
+
+func (s *observedStorage) Unwrap() ChunkStorage { return s.ChunkStorage }
+
+func (s *observedStorage) observe(op StorageOp, ids int, start time.Time, err *error) {
+	s.observer.StorageCalled(op, ids, time.Since(start), *err)
+}
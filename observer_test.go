@@ -0,0 +1,116 @@
+package sorted_array
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingObserver keeps events as text
+type recordingObserver struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (o *recordingObserver) record(format string, args ...any) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.events = append(o.events, fmt.Sprintf(format, args...))
+}
+func (o *recordingObserver) ChunksLoaded(ids []uint32)   { o.record("loaded %v", ids) }
+func (o *recordingObserver) ChunksReleased(ids []uint32) { o.record("released %d", len(ids)) }
+func (o *recordingObserver) ChunkSplit(id, newId uint32) { o.record("split %d %d", id, newId) }
+func (o *recordingObserver) ChunksMerged(id, removedId uint32) {
+	o.record("merged %d %d", id, removedId)
+}
+func (o *recordingObserver) Flushed(_ time.Duration, err error) { o.record("flushed %v", err) }
+func (o *recordingObserver) StorageCalled(op StorageOp, ids int, _ time.Duration, err error) {
+	o.record("%s %d %v", op, ids, err)
+}
+
+func TestObserverEvents(t *testing.T) {
+	storage := NewInMemoryChunkStorage()
+	o := &recordingObserver{}
+	arr := NewSortedArray(2, storage, WithObserver(o))
+	require.NoError(t, arr.Add([]uint32{1, 2, 3}))
+	require.NoError(t, arr.Flush())
+	require.Equal(t, []string{
+		"read_meta 0 <nil>",
+		"split 0 1",
+		"save_meta 0 <nil>",
+		"save 2 <nil>",
+		"flushed <nil>",
+		"released 2",
+	}, o.events)
+
+	o.events = nil
+	arr = NewSortedArray(2, storage, WithObserver(o))
+	require.NoError(t, arr.Delete([]uint32{2}))
+	require.Equal(t, []string{
+		"read_meta 0 <nil>",
+		"read 1 <nil>",
+		"loaded [0]",
+		"read 1 <nil>",
+		"loaded [1]",
+		"merged 0 1",
+	}, o.events)
+
+	o.events = nil
+	_, err := arr.Contains(1) // a loaded chunk is used
+	require.NoError(t, err)
+	require.Empty(t, o.events)
+}
+
+func TestObserverSeesMetaPageReads(t *testing.T) {
+	storage := NewBlobChunkStorage(NewInMemoryBlobStorage())
+	storage.metaPageSize = 2
+	arr := NewSortedArray(2, storage)
+	require.NoError(t, arr.Add(sequence(0, 100, 1)))
+	require.NoError(t, arr.Flush())
+
+	o := &recordingObserver{}
+	arr = NewSortedArray(2, storage, WithObserver(o))
+	_, err := arr.Contains(50)
+	require.NoError(t, err)
+	require.Equal(t, "read_meta 0 <nil>", o.events[0])
+	require.Equal(t, "read_meta_pages 1 <nil>", o.events[1])
+	require.Equal(t, "read 1 <nil>", o.events[2])
+}
+
+func TestMetricsCollector(t *testing.T) {
+	collector := NewMetricsCollector()
+	storage := &failingStorage{NewInMemoryChunkStorage(), false}
+	arr := NewSortedArray(2, storage, WithObserver(collector))
+	require.NoError(t, arr.Add([]uint32{1, 2, 3, 4, 5}))
+	require.NoError(t, arr.Flush())
+	storage.fail = true
+	require.NoError(t, arr.Add([]uint32{6}))
+	require.Error(t, arr.Flush())
+
+	var out bytes.Buffer
+	require.NoError(t, collector.WritePrometheus(&out))
+	metrics := out.String()
+	for _, line := range []string{
+		"# TYPE sorted_array_chunk_splits_total counter",
+		"sorted_array_chunk_splits_total 3",
+		"sorted_array_flush_errors_total 1",
+		`sorted_array_flush_duration_seconds_bucket{le="+Inf"} 2`,
+		"sorted_array_flush_duration_seconds_count 2",
+		`sorted_array_storage_calls_total{op="save_meta"} 2`,
+		`sorted_array_storage_errors_total{op="save"} 1`,
+		`sorted_array_storage_chunks_total{op="save"} 5`,
+		`sorted_array_storage_duration_seconds_count{op="read_meta"} 1`,
+	} {
+		require.Contains(t, metrics, line+"\n")
+	}
+	require.Equal(t, 1, strings.Count(metrics, "# TYPE sorted_array_storage_duration_seconds histogram"))
+
+	rec := httptest.NewRecorder()
+	collector.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	require.Equal(t, metrics, rec.Body.String())
+}
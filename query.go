@@ -0,0 +1,316 @@
+package sorted_array
+
+import (
+	"fmt"
+	sorted_numeric_streams "github.com/lezhnev74/SetOperationsOnSortedNumericStreams"
+	"golang.org/x/exp/slices"
+	"strings"
+)
+
+// QueryOp is the kind of query node
+type QueryOp byte
+
+const (
+	QueryTerm QueryOp = iota // items of the term's posting list
+	QueryAnd                 // items found in all args, NOT args are subtracted
+	QueryOr                  // items found in any arg
+	QueryNot                 // items not found in the arg (only allowed within AND)
+)
+
+// Query is a node of a boolean expression over posting lists, e.g. (a AND b) OR (c AND NOT d)
+type Query struct {
+	Op   QueryOp
+	Term string // QueryTerm only
+	Args []*Query
+}
+
+func Term(term string) *Query   { return &Query{Op: QueryTerm, Term: term} }
+func And(args ...*Query) *Query { return &Query{Op: QueryAnd, Args: args} }
+func Or(args ...*Query) *Query  { return &Query{Op: QueryOr, Args: args} }
+func Not(arg *Query) *Query     { return &Query{Op: QueryNot, Args: []*Query{arg}} }
+
+func (q *Query) String() string {
+	switch q.Op {
+	case QueryTerm:
+		return q.Term
+	case QueryNot:
+		return "NOT " + q.Args[0].String()
+	}
+	op := " AND "
+	if q.Op == QueryOr {
+		op = " OR "
+	}
+	args := make([]string, len(q.Args))
+	for i, arg := range q.Args {
+		args[i] = arg.String()
+	}
+	return "(" + strings.Join(args, op) + ")"
+}
+
+// queryPlan is a query node prepared for evaluation within a range
+type queryPlan struct {
+	op       QueryOp
+	arr      *SortedArray // terms only
+	card     uint64       // upper bound of items in range, 0 means the node is empty
+	min, max uint32       // bounds of items (if card > 0)
+	args     []*queryPlan // non-empty args, for AND sorted by card asc
+	negative []*queryPlan // non-empty NOT args of AND
+}
+
+// Evaluate returns items within [min,max] matching the query
+// posting lists are resolved with postings (see Index.Postings),
+// AND operands are intersected starting from the smallest one (estimated by meta),
+// much bigger terms are probed for items found so far (see Intersect),
+// and only chunks within bounds of all AND operands are read
+func Evaluate(q *Query, postings func(term string) *SortedArray, min, max uint32) (sorted_numeric_streams.SortedNumbersStream[uint32], error) {
+	p, err := planQuery(q, postings, min, max)
+	if err != nil {
+		return nil, err
+	}
+	if p.card == 0 {
+		return sorted_numeric_streams.NewSliceStream[uint32](nil), nil
+	}
+	return p.stream(p.min, p.max)
+}
+
+func planQuery(q *Query, postings func(term string) *SortedArray, min, max uint32) (*queryPlan, error) {
+	p := &queryPlan{op: q.Op, min: max, max: min}
+	switch q.Op {
+	case QueryTerm:
+		p.arr = postings(q.Term)
+		err := p.arr.estimate(p, min, max)
+		if err != nil {
+			return nil, err
+		}
+	case QueryOr:
+		if len(q.Args) == 0 {
+			return nil, fmt.Errorf("OR without operands")
+		}
+		for _, arg := range q.Args {
+			if arg.Op == QueryNot {
+				return nil, fmt.Errorf("NOT is only allowed within AND: %s", q)
+			}
+			argPlan, err := planQuery(arg, postings, min, max)
+			if err != nil {
+				return nil, err
+			}
+			if argPlan.card == 0 {
+				continue
+			}
+			p.args = append(p.args, argPlan)
+			p.card += argPlan.card
+			if argPlan.min < p.min {
+				p.min = argPlan.min
+			}
+			if argPlan.max > p.max {
+				p.max = argPlan.max
+			}
+		}
+	case QueryAnd:
+		negative := make([]*Query, 0)
+		for _, arg := range q.Args {
+			if arg.Op == QueryNot {
+				negative = append(negative, arg.Args[0])
+				continue
+			}
+			argPlan, err := planQuery(arg, postings, min, max)
+			if err != nil {
+				return nil, err
+			}
+			if argPlan.card == 0 {
+				return &queryPlan{op: q.Op}, nil // nothing can match, other operands are not even read
+			}
+			p.args = append(p.args, argPlan)
+		}
+		if len(p.args) == 0 {
+			return nil, fmt.Errorf("AND needs an operand without NOT: %s", q)
+		}
+		// narrow the range to bounds of all operands
+		p.card, p.min, p.max = p.args[0].card, p.args[0].min, p.args[0].max
+		for _, argPlan := range p.args[1:] {
+			if argPlan.card < p.card {
+				p.card = argPlan.card
+			}
+			if argPlan.min > p.min {
+				p.min = argPlan.min
+			}
+			if argPlan.max < p.max {
+				p.max = argPlan.max
+			}
+		}
+		if p.min > p.max {
+			return &queryPlan{op: q.Op}, nil
+		}
+		slices.SortStableFunc(p.args, func(a, b *queryPlan) bool { return a.card < b.card })
+		for _, arg := range negative {
+			argPlan, err := planQuery(arg, postings, p.min, p.max)
+			if err != nil {
+				return nil, err
+			}
+			if argPlan.card > 0 {
+				p.negative = append(p.negative, argPlan)
+			}
+		}
+	case QueryNot:
+		return nil, fmt.Errorf("NOT is only allowed within AND: %s", q)
+	default:
+		return nil, fmt.Errorf("unknown query op %d", q.Op)
+	}
+	return p, nil
+}
+
+// stream returns items of the (non-empty) plan within [min,max]
+func (p *queryPlan) stream(min, max uint32) (sorted_numeric_streams.SortedNumbersStream[uint32], error) {
+	if p.op == QueryTerm {
+		return p.arr.GetInRange(min, max)
+	}
+	if p.op == QueryAnd && p.min > min {
+		min = p.min
+	}
+	if p.op == QueryAnd && p.max < max {
+		max = p.max
+	}
+	result, err := p.args[0].stream(min, max)
+	if err != nil {
+		return nil, err
+	}
+	opened := []sorted_numeric_streams.SortedNumbersStream[uint32]{result}
+	for _, arg := range p.args[1:] {
+		if p.op == QueryAnd && arg.op == QueryTerm && arg.card >= gallopRatio*p.card {
+			result = arg.arr.probe(result) // much bigger posting lists are looked up, not streamed
+			continue
+		}
+		s, err := arg.stream(min, max)
+		if err != nil {
+			drain(opened...)
+			return nil, err
+		}
+		opened = append(opened, s)
+		if p.op == QueryAnd {
+			result = &setOperation{op: QueryAnd, left: result, right: s}
+		} else {
+			result = &setOperation{op: QueryOr, left: result, right: s}
+		}
+	}
+	for _, arg := range p.negative {
+		s, err := arg.stream(min, max)
+		if err != nil {
+			drain(opened...)
+			return nil, err
+		}
+		opened = append(opened, s)
+		result = &setOperation{op: QueryNot, left: result, right: s}
+	}
+	return result, nil
+}
+
+// drain reads streams to the end, so goroutines behind them (see GetInRange) finish and release their chunks
+func drain(streams ...sorted_numeric_streams.SortedNumbersStream[uint32]) {
+	for _, s := range streams {
+		for _, ok := s.Next(); ok; _, ok = s.Next() {
+		}
+	}
+}
+
+// estimate sets the number of items within [min,max] (an upper bound, partially covered chunks count fully)
+// and bounds of these items to the plan, only the meta is read
+func (a *SortedArray) estimate(p *queryPlan, min, max uint32) error {
+	err := a.initMeta()
+	if err == nil {
+		err = a.meta.load(min, max)
+	}
+	if err != nil {
+		return err
+	}
+	chunks := a.meta.FindRelevantForReadRange(min, max)
+	for _, cm := range chunks {
+		p.card += uint64(cm.size)
+	}
+	if len(chunks) > 0 {
+		p.min, p.max = chunks[0].min, chunks[len(chunks)-1].max
+		if p.min < min {
+			p.min = min
+		}
+		if p.max > max {
+			p.max = max
+		}
+	}
+	return nil
+}
+
+// setOperation merges two asc streams lazily: AND intersects, OR unites, NOT subtracts the right one
+// (Union and Diff of sorted_numeric_streams repeat items when the left stream ends first)
+type setOperation struct {
+	op                 QueryOp
+	left, right        sorted_numeric_streams.SortedNumbersStream[uint32]
+	l, r               uint32
+	lPending, rPending bool // l and r are read, but not consumed yet
+	lDrained, rDrained bool
+	err                error // the first error of left or right
+}
+
+// Next ends the stream early if left or right can't be read, see Err
+func (s *setOperation) Next() (item uint32, ok bool) {
+	for {
+		if !s.lPending && !s.lDrained {
+			s.l, s.lPending = s.left.Next()
+			s.lDrained = s.drained(s.left, s.lPending)
+		}
+		if !s.rPending && !s.rDrained {
+			s.r, s.rPending = s.right.Next()
+			s.rDrained = s.drained(s.right, s.rPending)
+		}
+		switch {
+		case s.err != nil:
+			return s.finish() // a partial result would be wrong, e.g. NOT would keep items it must remove
+		case !s.lPending && !s.rPending:
+			return 0, false
+		case s.lPending && s.rPending && s.l == s.r:
+			s.lPending, s.rPending = false, false
+			if s.op != QueryNot {
+				return s.l, true
+			}
+		case s.lPending && (!s.rPending || s.l < s.r):
+			s.lPending = false
+			if s.op != QueryAnd {
+				return s.l, true
+			}
+			if !s.rPending {
+				return s.finish() // nothing left to intersect with
+			}
+		default: // the right item is smaller or the left stream is drained
+			s.rPending = false
+			if s.op == QueryOr {
+				return s.r, true
+			}
+			if !s.lPending {
+				return s.finish() // the result can only come from the left stream
+			}
+		}
+	}
+}
+
+// finish drains both streams, so goroutines behind them (see GetInRange) are not left blocked
+func (s *setOperation) finish() (item uint32, ok bool) {
+	for !s.lDrained {
+		_, ok = s.left.Next()
+		s.lDrained = s.drained(s.left, ok)
+	}
+	for !s.rDrained {
+		_, ok = s.right.Next()
+		s.rDrained = s.drained(s.right, ok)
+	}
+	s.lPending, s.rPending = false, false
+	return 0, false
+}
+
+// drained tells if the stream has ended (ok=false of its Next) and keeps the first error streams end with
+func (s *setOperation) drained(stream sorted_numeric_streams.SortedNumbersStream[uint32], ok bool) bool {
+	if !ok && s.err == nil {
+		s.err = StreamErr(stream)
+	}
+	return !ok
+}
+
+// Err returns the error the stream ended with, call it once Next returned ok=false
+func (s *setOperation) Err() error { return s.err }
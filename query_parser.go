@@ -0,0 +1,330 @@
+package sorted_array
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Query strings look like `error AND service:api NOT debug [1697000000..1697100000]`:
+//
+//	query   := or [range]
+//	or      := and ("OR" and)*
+//	and     := unary (["AND"] unary)*      adjacent operands are joined with AND
+//	unary   := "NOT" unary | term | "(" or ")"
+//	term    := word | "quoted word"        keywords are upper-case, quotes allow spaces and keywords in terms
+//	range   := "[" number ".." number "]"  inclusive, one per query, anywhere at the top level
+//
+// AND binds tighter than OR, NOT is only allowed as an operand of AND (see Evaluate).
+
+// ParsedQuery is a query with its range of ids (the whole uint32 range by default)
+type ParsedQuery struct {
+	Query    *Query
+	Min, Max uint32
+}
+
+// QueryError tells where a query string is malformed
+type QueryError struct {
+	Pos int // byte offset in the query string
+	Msg string
+}
+
+func (e *QueryError) Error() string { return fmt.Sprintf("query error at %d: %s", e.Pos, e.Msg) }
+
+type queryTokenKind byte
+
+const (
+	tokenEnd queryTokenKind = iota
+	tokenWord
+	tokenQuoted
+	tokenOpen
+	tokenClose
+	tokenRange
+)
+
+type queryToken struct {
+	kind     queryTokenKind
+	text     string // words and quoted terms (unquoted)
+	pos      int
+	min, max uint32 // ranges
+}
+
+func (t queryToken) is(keyword string) bool { return t.kind == tokenWord && t.text == keyword }
+
+func (t queryToken) String() string {
+	switch t.kind {
+	case tokenEnd:
+		return "end of query"
+	case tokenOpen:
+		return `"("`
+	case tokenClose:
+		return `")"`
+	case tokenRange:
+		return "range"
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+// ParseQuery turns a query string into a query for Evaluate, errors are *QueryError
+func ParseQuery(s string) (*ParsedQuery, error) {
+	tokens, err := tokenizeQuery(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &queryParser{tokens: tokens, notPos: make(map[*Query]int)}
+	parsed := &ParsedQuery{Max: math.MaxUint32}
+
+	// 1. The range is taken out, it can be anywhere at the top level
+	rest := make([]queryToken, 0, len(tokens))
+	var rangeToken *queryToken
+	for i, t := range tokens {
+		if t.kind != tokenRange {
+			rest = append(rest, t)
+			continue
+		}
+		if rangeToken != nil {
+			return nil, &QueryError{t.pos, "only one range is allowed"}
+		}
+		rangeToken = &tokens[i]
+		parsed.Min, parsed.Max = t.min, t.max
+	}
+	p.tokens = rest
+
+	// 2. The expression
+	if p.peek().kind == tokenEnd {
+		return nil, &QueryError{p.peek().pos, "empty query"}
+	}
+	parsed.Query, err = p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokenEnd {
+		return nil, &QueryError{t.pos, fmt.Sprintf("unexpected %s", t)}
+	}
+	if rangeToken != nil && p.depthAt(rangeToken.pos) > 0 {
+		return nil, &QueryError{rangeToken.pos, "range must be at the top level"}
+	}
+	err = p.validate(parsed.Query, false)
+	if err != nil {
+		return nil, err
+	}
+	return parsed, nil
+}
+
+type queryParser struct {
+	tokens []queryToken
+	pos    int
+	notPos map[*Query]int // positions of NOT for error messages
+	groups [][2]int       // spans of parentheses
+}
+
+func (p *queryParser) peek() queryToken { return p.tokens[p.pos] }
+
+func (p *queryParser) next() queryToken {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEnd {
+		p.pos++
+	}
+	return t
+}
+
+func (p *queryParser) parseOr() (*Query, error) {
+	q, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	args := []*Query{q}
+	for p.peek().is("OR") {
+		p.next()
+		q, err = p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, q)
+	}
+	if len(args) == 1 {
+		return args[0], nil
+	}
+	return Or(args...), nil
+}
+
+func (p *queryParser) parseAnd() (*Query, error) {
+	q, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	args := []*Query{q}
+	for {
+		t := p.peek()
+		if t.is("AND") {
+			p.next()
+		} else if t.kind == tokenEnd || t.kind == tokenClose || t.is("OR") {
+			break
+		}
+		q, err = p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, q)
+	}
+	if len(args) == 1 {
+		return args[0], nil
+	}
+	return And(args...), nil
+}
+
+func (p *queryParser) parseUnary() (*Query, error) {
+	t := p.next()
+	switch {
+	case t.is("NOT"):
+		arg, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		q := Not(arg)
+		p.notPos[q] = t.pos
+		return q, nil
+	case t.is("AND") || t.is("OR"):
+		return nil, &QueryError{t.pos, fmt.Sprintf("%s needs an operand before it", t.text)}
+	case t.kind == tokenWord || t.kind == tokenQuoted:
+		return Term(t.text), nil
+	case t.kind == tokenOpen:
+		q, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		closing := p.next()
+		if closing.kind != tokenClose {
+			return nil, &QueryError{t.pos, `"(" is not closed`}
+		}
+		p.groups = append(p.groups, [2]int{t.pos, closing.pos})
+		return q, nil
+	case t.kind == tokenClose:
+		return nil, &QueryError{t.pos, `unexpected ")"`}
+	default:
+		return nil, &QueryError{t.pos, "unexpected end of query"}
+	}
+}
+
+// depthAt returns the number of parentheses around the position
+func (p *queryParser) depthAt(pos int) (depth int) {
+	for _, g := range p.groups {
+		if g[0] < pos && pos < g[1] {
+			depth++
+		}
+	}
+	return
+}
+
+// validate checks that NOT is only used as an operand of AND which has an operand without NOT
+func (p *queryParser) validate(q *Query, inAnd bool) error {
+	switch q.Op {
+	case QueryNot:
+		if !inAnd {
+			return &QueryError{p.notPos[q], "NOT must be combined with a term, e.g. a NOT b"}
+		}
+		return p.validate(q.Args[0], false)
+	case QueryAnd:
+		positive := false
+		for _, arg := range q.Args {
+			positive = positive || arg.Op != QueryNot
+			err := p.validate(arg, true)
+			if err != nil {
+				return err
+			}
+		}
+		if !positive {
+			return &QueryError{p.notPos[q.Args[0]], "NOT must be combined with a term, e.g. a NOT b"}
+		}
+	case QueryOr:
+		for _, arg := range q.Args {
+			err := p.validate(arg, false)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func tokenizeQuery(s string) ([]queryToken, error) {
+	tokens := make([]queryToken, 0)
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(':
+			tokens = append(tokens, queryToken{kind: tokenOpen, pos: i})
+			i++
+		case c == ')':
+			tokens = append(tokens, queryToken{kind: tokenClose, pos: i})
+			i++
+		case c == '[':
+			t, end, err := tokenizeRange(s, i)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, t)
+			i = end
+		case c == ']':
+			return nil, &QueryError{i, `unexpected "]"`}
+		case c == '"':
+			var term strings.Builder
+			j := i + 1
+			for ; j < len(s) && s[j] != '"'; j++ {
+				if s[j] == '\\' && j+1 < len(s) {
+					j++
+				}
+				term.WriteByte(s[j])
+			}
+			if j == len(s) {
+				return nil, &QueryError{i, "quote is not closed"}
+			}
+			if term.Len() == 0 {
+				return nil, &QueryError{i, "empty term"}
+			}
+			tokens = append(tokens, queryToken{kind: tokenQuoted, text: term.String(), pos: i})
+			i = j + 1
+		default:
+			j := i
+			for j < len(s) && !strings.ContainsRune(" \t\n\r()[]\"", rune(s[j])) {
+				j++
+			}
+			tokens = append(tokens, queryToken{kind: tokenWord, text: s[i:j], pos: i})
+			i = j
+		}
+	}
+	return append(tokens, queryToken{kind: tokenEnd, pos: len(s)}), nil
+}
+
+// tokenizeRange reads [min..max] starting at pos, returns the token and the position after it
+func tokenizeRange(s string, pos int) (t queryToken, end int, err error) {
+	closing := strings.IndexByte(s[pos:], ']')
+	if closing < 0 {
+		return t, 0, &QueryError{pos, "range is not closed"}
+	}
+	body := s[pos+1 : pos+closing]
+	sep := strings.Index(body, "..")
+	if sep < 0 {
+		return t, 0, &QueryError{pos + 1, `range must look like [min..max]`}
+	}
+	t = queryToken{kind: tokenRange, pos: pos}
+	bounds := []*uint32{&t.min, &t.max}
+	for i, text := range []string{body[:sep], body[sep+2:]} {
+		offset := pos + 1 + i*(sep+2) // position of the number
+		trimmed := strings.TrimLeft(text, " ")
+		offset += len(text) - len(trimmed)
+		trimmed = strings.TrimRight(trimmed, " ")
+		v, err := strconv.ParseUint(trimmed, 10, 32)
+		if err != nil {
+			return t, 0, &QueryError{offset, fmt.Sprintf("%q is not a valid range bound", trimmed)}
+		}
+		*bounds[i] = uint32(v)
+	}
+	if t.min > t.max {
+		return t, 0, &QueryError{pos, "range min is greater than max"}
+	}
+	return t, pos + closing + 1, nil
+}
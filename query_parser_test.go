@@ -0,0 +1,88 @@
+package sorted_array
+
+import (
+	"errors"
+	SortedArrayStream "github.com/lezhnev74/SetOperationsOnSortedNumericStreams"
+	"github.com/stretchr/testify/require"
+	"math"
+	"testing"
+)
+
+func TestParseQuery(t *testing.T) {
+	type test struct {
+		query    string
+		expected string // see Query.String
+		min, max uint32
+	}
+	tests := []test{
+		{"error", "error", 0, math.MaxUint32},
+		{"error AND service:api NOT debug [1697000000..1697100000]", "(error AND service:api AND NOT debug)", 1697000000, 1697100000},
+		{"a b c", "(a AND b AND c)", 0, math.MaxUint32},
+		{"a OR b c", "(a OR (b AND c))", 0, math.MaxUint32},
+		{"(a OR b) c", "((a OR b) AND c)", 0, math.MaxUint32},
+		{"(a AND b) OR (c AND NOT d)", "((a AND b) OR (c AND NOT d))", 0, math.MaxUint32},
+		{"[ 5 .. 10 ] a", "a", 5, 10},
+		{`"NOT" "two words" "a\"b"`, `(NOT AND two words AND a"b)`, 0, math.MaxUint32},
+		{"a NOT (b OR c)", "(a AND NOT (b OR c))", 0, math.MaxUint32},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			parsed, err := ParseQuery(tt.query)
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, parsed.Query.String())
+			require.Equal(t, tt.min, parsed.Min)
+			require.Equal(t, tt.max, parsed.Max)
+		})
+	}
+}
+
+func TestParseQueryErrors(t *testing.T) {
+	type test struct {
+		query string
+		pos   int
+	}
+	tests := []test{
+		{"", 0},
+		{"   [1..2]", 9},
+		{"a AND", 5},
+		{"AND a", 0},
+		{"a OR OR b", 5},
+		{"(a b", 0},
+		{"a b)", 3},
+		{"a ]", 2},
+		{`a "b`, 2},
+		{`a ""`, 2},
+		{"a [1..2", 2},
+		{"a [1-2]", 3},
+		{"a [1..x]", 6},
+		{"a [ -1..2]", 4},
+		{"a [1..99999999999]", 6},
+		{"a [5..1]", 2},
+		{"a [1..2] [3..4]", 9},
+		{"(a [1..2])", 3},
+		{"NOT a", 0},
+		{"a OR NOT b", 5},
+		{"NOT a NOT b", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			_, err := ParseQuery(tt.query)
+			var queryErr *QueryError
+			require.True(t, errors.As(err, &queryErr), "error: %v", err)
+			require.Equal(t, tt.pos, queryErr.Pos, queryErr.Error())
+		})
+	}
+}
+
+func TestParsedQueryEvaluation(t *testing.T) {
+	index := NewIndex(3, nil, func(term string) ChunkStorage { return NewInMemoryChunkStorage() })
+	require.NoError(t, index.Index("error", []uint32{10, 20, 30, 40}))
+	require.NoError(t, index.Index("service:api", []uint32{10, 30, 40}))
+	require.NoError(t, index.Index("debug", []uint32{30}))
+
+	parsed, err := ParseQuery("error AND service:api NOT debug [15..100]")
+	require.NoError(t, err)
+	items, err := index.Search(parsed.Query, parsed.Min, parsed.Max)
+	require.NoError(t, err)
+	require.EqualValues(t, []uint32{40}, SortedArrayStream.ToSlice(items))
+}
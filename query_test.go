@@ -0,0 +1,224 @@
+package sorted_array
+
+import (
+	"fmt"
+	SortedArrayStream "github.com/lezhnev74/SetOperationsOnSortedNumericStreams"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/exp/rand"
+	"testing"
+)
+
+func TestEvaluate(t *testing.T) {
+	index := NewIndex(3, nil, func(term string) ChunkStorage { return NewInMemoryChunkStorage() })
+	require.NoError(t, index.Index("a", []uint32{1, 2, 3, 4, 5, 6}))
+	require.NoError(t, index.Index("b", []uint32{2, 4, 6, 8}))
+	require.NoError(t, index.Index("c", []uint32{10, 11, 12}))
+	require.NoError(t, index.Index("d", []uint32{4, 11}))
+
+	type test struct {
+		query    *Query
+		min, max uint32
+		expected []uint32
+	}
+	tests := []test{
+		{Term("a"), 0, 100, []uint32{1, 2, 3, 4, 5, 6}},
+		{Term("missing"), 0, 100, []uint32{}},
+		{And(Term("a"), Term("b")), 0, 100, []uint32{2, 4, 6}},
+		{And(Term("a"), Term("b")), 3, 5, []uint32{4}},
+		{Or(Term("a"), Term("c")), 5, 10, []uint32{5, 6, 10}},
+		{And(Term("a"), Not(Term("b"))), 0, 100, []uint32{1, 3, 5}},
+		{Or(And(Term("a"), Term("b")), And(Term("c"), Not(Term("d")))), 0, 100, []uint32{2, 4, 6, 10, 12}},
+		{And(Term("a"), Term("c")), 0, 100, []uint32{}}, // disjoint bounds
+		{And(Term("a"), Term("missing")), 0, 100, []uint32{}},
+		{And(Or(Term("b"), Term("c")), Not(Term("d"))), 0, 100, []uint32{2, 6, 8, 10, 12}},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s [%d,%d]", tt.query, tt.min, tt.max), func(t *testing.T) {
+			items, err := index.Search(tt.query, tt.min, tt.max)
+			require.NoError(t, err)
+			require.EqualValues(t, tt.expected, SortedArrayStream.ToSlice(items))
+		})
+	}
+}
+
+func TestEvaluateInvalidQueries(t *testing.T) {
+	postings := func(term string) *SortedArray { return NewSortedArray(3, NewInMemoryChunkStorage()) }
+	for _, q := range []*Query{
+		Not(Term("a")),
+		Or(Term("a"), Not(Term("b"))),
+		And(Not(Term("a"))),
+		And(),
+		Or(),
+	} {
+		_, err := Evaluate(q, postings, 0, 100)
+		require.Error(t, err, q.String())
+	}
+}
+
+func TestEvaluateReadsRelevantChunksOnly(t *testing.T) {
+	storages := map[string]*recordingStorage{}
+	index := NewIndex(10, nil, func(term string) ChunkStorage {
+		if storages[term] == nil {
+			storages[term] = &recordingStorage{ChunkStorage: NewInMemoryChunkStorage()}
+		}
+		return storages[term]
+	})
+	require.NoError(t, index.Index("rare", []uint32{500, 505}))
+	require.NoError(t, index.Index("frequent", sequence(0, 999, 1))) // 100 chunks
+	require.NoError(t, index.Flush())
+	chunks, err := NewSortedArray(10, storages["frequent"]).Chunks()
+	require.NoError(t, err)
+	relevant := make([]uint32, 0)
+	for _, cm := range chunks {
+		if cm.max >= 500 && cm.min <= 505 {
+			relevant = append(relevant, cm.id)
+		}
+	}
+	require.Len(t, relevant, 1)
+
+	// only chunks of "frequent" within bounds of "rare" are read
+	storages["frequent"].takeReads()
+	items, err := index.Search(And(Term("frequent"), Term("rare")), 0, 1000)
+	require.NoError(t, err)
+	require.EqualValues(t, []uint32{500, 505}, SortedArrayStream.ToSlice(items))
+	require.Equal(t, relevant, storages["frequent"].takeReads())
+
+	// an empty operand stops the evaluation before any chunk is read
+	items, err = index.Search(And(Term("frequent"), Term("missing")), 0, 1000)
+	require.NoError(t, err)
+	require.Empty(t, SortedArrayStream.ToSlice(items))
+	require.Empty(t, storages["frequent"].takeReads())
+}
+
+// unreadableMetaStorage imitates a storage whose meta can't be read
+type unreadableMetaStorage struct{ ChunkStorage }
+
+func (unreadableMetaStorage) ReadMeta() (*Meta, error) { return nil, fmt.Errorf("meta is gone") }
+
+func TestQueryPlanDrainsStreamsOnError(t *testing.T) {
+	storage := &recordingStorage{ChunkStorage: NewInMemoryChunkStorage()}
+	a := NewSortedArray(2, storage)
+	require.NoError(t, a.Add([]uint32{1, 2, 3, 4, 5}))
+	require.NoError(t, a.Flush())
+	chunks, err := a.Chunks()
+	require.NoError(t, err)
+	broken := NewSortedArray(2, unreadableMetaStorage{NewInMemoryChunkStorage()})
+
+	storage.takeReads()
+	p := &queryPlan{op: QueryOr, args: []*queryPlan{{op: QueryTerm, arr: a}, {op: QueryTerm, arr: broken}}}
+	_, err = p.stream(0, 100)
+	require.ErrorContains(t, err, "meta is gone")
+	// the stream of "a" was read to the end (its goroutine is not left blocked) and released its chunks
+	require.Equal(t, []uint32{chunks[0].id, chunks[1].id, chunks[2].id}, storage.takeReads())
+	require.Empty(t, a.loadedChunks)
+}
+
+// unreadableChunksStorage imitates a storage whose chunks can't be read
+type unreadableChunksStorage struct{ ChunkStorage }
+
+func (unreadableChunksStorage) Read([]uint32) (map[uint32]*Chunk, error) {
+	return nil, fmt.Errorf("chunks are gone")
+}
+
+func TestEvaluateKeepsStreamErrors(t *testing.T) {
+	arrays := map[string]*SortedArray{}
+	for _, term := range []string{"a", "broken"} {
+		storage := NewInMemoryChunkStorage()
+		arr := NewSortedArray(3, storage)
+		require.NoError(t, arr.Add([]uint32{1, 2, 3, 4, 5, 6}))
+		require.NoError(t, arr.Flush())
+		arrays[term] = NewSortedArray(3, storage)
+	}
+	arrays["broken"].storage = unreadableChunksStorage{arrays["broken"].storage}
+	postings := func(term string) *SortedArray { return arrays[term] }
+
+	for _, q := range []*Query{
+		And(Term("a"), Term("broken")),
+		Or(Term("a"), Term("broken")),
+		And(Term("a"), Not(Term("broken"))), // the result would have all items of "a" otherwise
+	} {
+		t.Run(q.String(), func(t *testing.T) {
+			items, err := Evaluate(q, postings, 0, 100)
+			require.NoError(t, err)
+			SortedArrayStream.ToSlice(items)
+			require.ErrorContains(t, StreamErr(items), "chunks are gone")
+			require.Empty(t, arrays["a"].loadedChunks) // the other stream was drained
+		})
+	}
+}
+
+// TestEvaluateRandomized compares random queries with the same queries evaluated on plain sets
+func TestEvaluateRandomized(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	terms := []string{"a", "b", "c", "d", "e"}
+	sets := make(map[string]map[uint32]bool)
+	index := NewIndex(4, nil, func(term string) ChunkStorage { return NewInMemoryChunkStorage() })
+	for _, term := range terms {
+		sets[term] = make(map[uint32]bool)
+		items := make([]uint32, 0)
+		for i := rng.Intn(100); i >= 0; i-- {
+			item := uint32(rng.Intn(300))
+			items = append(items, item)
+			sets[term][item] = true
+		}
+		require.NoError(t, index.Index(term, items))
+	}
+
+	var randomQuery func(depth int) *Query
+	randomQuery = func(depth int) *Query {
+		if depth == 0 || rng.Intn(3) == 0 {
+			return Term(terms[rng.Intn(len(terms))])
+		}
+		args := []*Query{randomQuery(depth - 1)}
+		for i := rng.Intn(3); i >= 0; i-- {
+			args = append(args, randomQuery(depth-1))
+		}
+		if rng.Intn(2) == 0 {
+			return Or(args...)
+		}
+		for i := 1; i < len(args); i++ {
+			if rng.Intn(2) == 0 {
+				args[i] = Not(args[i])
+			}
+		}
+		return And(args...)
+	}
+	var matches func(q *Query, item uint32) bool
+	matches = func(q *Query, item uint32) bool {
+		switch q.Op {
+		case QueryTerm:
+			return sets[q.Term][item]
+		case QueryNot:
+			return !matches(q.Args[0], item)
+		case QueryOr:
+			for _, arg := range q.Args {
+				if matches(arg, item) {
+					return true
+				}
+			}
+			return false
+		default:
+			for _, arg := range q.Args {
+				if !matches(arg, item) {
+					return false
+				}
+			}
+			return true
+		}
+	}
+
+	for i := 0; i < 500; i++ {
+		q := randomQuery(3)
+		min := uint32(rng.Intn(300))
+		max := min + uint32(rng.Intn(150))
+		expected := make([]uint32, 0)
+		for item := min; item <= max; item++ {
+			if matches(q, item) {
+				expected = append(expected, item)
+			}
+		}
+		items, err := index.Search(q, min, max)
+		require.NoError(t, err)
+		require.EqualValues(t, expected, SortedArrayStream.ToSlice(items), "%s [%d,%d]", q, min, max)
+	}
+}
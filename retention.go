@@ -0,0 +1,145 @@
+package sorted_array
+
+import (
+	"github.com/pkg/errors"
+	"math"
+	"time"
+)
+
+// RetentionPolicy limits what the array keeps, the smallest items (the oldest timestamps) are dropped first
+type RetentionPolicy struct {
+	MaxAge   time.Duration    // items are unix timestamps (seconds), older than MaxAge are dropped, 0 means no limit
+	MaxCount uint64           // only this many biggest items are kept, 0 means no limit
+	Clock    func() time.Time // time.Now if nil
+}
+
+// WithRetention makes the array apply the policy on every Flush (and on Trim)
+func WithRetention(p RetentionPolicy) ArrayOption {
+	return func(a *SortedArray) { a.retention = &p }
+}
+
+// WithCap keeps only the biggest n items (e.g. the last n occurrences), the smallest are evicted after every Add
+// leading chunks are removed without loading them
+func WithCap(n uint64) ArrayOption {
+	return func(a *SortedArray) { a.capacity = n }
+}
+
+// Trim applies the retention policy now, leading chunks are dropped without loading them,
+// only the chunk on the boundary is loaded (and merged with its neighbour if it becomes small)
+func (a *SortedArray) Trim() error {
+	if a.retention == nil {
+		return nil
+	}
+	err := a.initMeta()
+	if err != nil {
+		return err
+	}
+	if a.retention.MaxAge > 0 {
+		clock := a.retention.Clock
+		if clock == nil {
+			clock = time.Now
+		}
+		cutoff := clock().Add(-a.retention.MaxAge).Unix()
+		if cutoff > math.MaxUint32 {
+			cutoff = math.MaxUint32
+		}
+		if cutoff > 0 {
+			err = a.trimBelow(uint32(cutoff))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if a.retention.MaxCount > 0 {
+		return a.trimToCount(a.retention.MaxCount)
+	}
+	return nil
+}
+
+// trimToCount drops the smallest items so that at most n items are left, sizes are taken from the meta
+// which is walked from the tail, pages of kept chunks are not loaded if their stats are known
+func (a *SortedArray) trimToCount(n uint64) error {
+	// 1. Find the last chunk to drop (the boundary one), chunks before it are dropped as a whole
+	total := uint64(0)
+	var boundary *ChunkMeta
+	if a.meta.pages == nil {
+		boundary = lastOverCount(a.meta.chunks, n, &total)
+	}
+	for i := len(a.meta.pages) - 1; i >= 0 && boundary == nil; i-- {
+		p := a.meta.pages[i]
+		if !p.loaded && p.stats != nil && len(a.meta.pageChunks(i)) == 0 && total+p.stats.items <= n {
+			total += p.stats.items // the page is kept as a whole
+			continue
+		}
+		err := a.meta.loadPages(i, i)
+		if err != nil {
+			return err
+		}
+		boundary = lastOverCount(a.meta.pageChunks(i), n, &total)
+	}
+	if boundary == nil {
+		return nil
+	}
+	// 2. Its item at size-keep is the smallest item to keep
+	keep := n - total
+	if keep == 0 {
+		return a.trimBelow(boundary.max + 1) // a later chunk exists, so max+1 does not overflow
+	}
+	err := a.loadChunks([]uint32{boundary.id})
+	if err != nil {
+		return errors.Wrapf(err, "unable to load chunk %d", boundary.id)
+	}
+	defer a.releaseChunks([]uint32{boundary.id})
+	items := a.loadedChunks[boundary.id].ToSlice()
+	return a.trimBelow(items[uint64(len(items))-keep])
+}
+
+// lastOverCount adds sizes of chunks to total from the tail, returns the chunk which makes it exceed n
+func lastOverCount(chunks []*ChunkMeta, n uint64, total *uint64) *ChunkMeta {
+	for i := len(chunks) - 1; i >= 0; i-- {
+		if *total+uint64(chunks[i].size) > n {
+			return chunks[i]
+		}
+		*total += uint64(chunks[i].size)
+	}
+	return nil
+}
+
+// trimBelow drops all items smaller than the item
+func (a *SortedArray) trimBelow(item uint32) error {
+	err := a.meta.load(0, item)
+	if err != nil {
+		return err
+	}
+	// 1. Drop leading chunks as a whole
+	n := 0
+	a.chunksLock.Lock()
+	for n < len(a.meta.chunks) && a.meta.chunks[n].max < item {
+		id := a.meta.chunks[n].id
+		delete(a.loadedChunks, id)
+		delete(a.dirtyChunks, id)
+		a.removedChunks[id] = struct{}{}
+		n++
+	}
+	a.chunksLock.Unlock()
+	if n > 0 {
+		a.meta.removeFirst(n)
+		a.dirtyMeta = true
+	}
+	if len(a.meta.chunks) == 0 || a.meta.chunks[0].min >= item {
+		return nil
+	}
+	// 2. Cut the boundary chunk
+	cm := a.meta.chunks[0]
+	err = a.loadChunks([]uint32{cm.id})
+	if err != nil {
+		return errors.Wrapf(err, "unable to load chunk %d", cm.id)
+	}
+	chunk := a.loadedChunks[cm.id]
+	chunk.removeAll(chunk.appendInRange(nil, cm.min, item-1))
+	cm.min, cm.size = chunk.Min(), uint32(chunk.Len())
+	a.dirtyChunks[cm.id] = struct{}{}
+	a.dirtyMeta = true
+	a.merge()
+	return nil
+}
@@ -0,0 +1,183 @@
+package sorted_array
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/exp/rand"
+	"golang.org/x/exp/slices"
+	"testing"
+	"time"
+)
+
+func TestRetentionMaxAge(t *testing.T) {
+	now := time.Unix(10_000, 0)
+	policy := RetentionPolicy{MaxAge: 5_000 * time.Second, Clock: func() time.Time { return now }}
+	storage := &recordingStorage{ChunkStorage: NewInMemoryChunkStorage()}
+	arr := NewSortedArray(100, storage, WithRetention(policy))
+	require.NoError(t, arr.Add(sequence(0, 10_000, 1)))
+	require.NoError(t, arr.Flush())
+	require.EqualValues(t, sequence(5_000, 10_000, 1), arr.ToSlice())
+
+	// later, on demand: leading chunks are dropped without reading them
+	arr = NewSortedArray(100, storage, WithRetention(policy))
+	chunks, err := arr.Chunks()
+	require.NoError(t, err)
+	expired := 0
+	for chunks[expired].max < 7_520 {
+		expired++
+	}
+	boundary := chunks[expired]
+	require.Less(t, boundary.min, uint32(7_520)) // the boundary chunk is cut
+	now = now.Add(2_520 * time.Second)
+	storage.takeReads()
+	require.NoError(t, arr.Trim())
+	require.Equal(t, []uint32{boundary.id}, storage.takeReads()) // only the boundary chunk
+	require.NoError(t, arr.Flush())
+
+	arr = NewSortedArray(100, storage)
+	require.EqualValues(t, sequence(7_520, 10_000, 1), arr.ToSlice())
+	expiredIds := make([]uint32, 0, expired)
+	for _, cm := range chunks[:expired] {
+		expiredIds = append(expiredIds, cm.id)
+	}
+	removed, err := storage.ChunkStorage.Read(expiredIds)
+	require.NoError(t, err)
+	require.Empty(t, removed)
+	chunks, err = arr.Chunks()
+	require.NoError(t, err)
+	require.Equal(t, boundary.id, chunks[0].id)
+	problems, err := arr.Validate()
+	require.NoError(t, err)
+	require.Empty(t, problems)
+}
+
+func TestRetentionMaxCount(t *testing.T) {
+	storage := NewInMemoryChunkStorage()
+	arr := NewSortedArray(100, storage, WithRetention(RetentionPolicy{MaxCount: 1_234}))
+	require.NoError(t, arr.Add(sequence(0, 10_000, 1)))
+	require.NoError(t, arr.Flush())
+	require.EqualValues(t, sequence(10_000-1_234, 10_000, 1), arr.ToSlice())
+
+	require.NoError(t, arr.Add([]uint32{20_000, 20_001}))
+	require.NoError(t, arr.Flush())
+	require.Len(t, NewSortedArray(100, storage).ToSlice(), 1_234)
+	require.EqualValues(t, 10_000-1_232, NewSortedArray(100, storage).ToSlice()[0])
+}
+
+func TestRetentionRandomized(t *testing.T) {
+	storages := map[string]func() ChunkStorage{
+		"memory": func() ChunkStorage { return NewInMemoryChunkStorage() },
+		"pages":  func() ChunkStorage { return &BlobChunkStorage{NewInMemoryBlobStorage(), 4} },
+	}
+	for name, newStorage := range storages {
+		for _, chunkSize := range []uint32{1, 4, 50} {
+			t.Run(fmt.Sprintf("%s/size %d", name, chunkSize), func(t *testing.T) {
+				rng := rand.New(rand.NewSource(1))
+				now := int64(0)
+				maxCount := uint64(rng.Intn(300) + 1)
+				policy := RetentionPolicy{
+					MaxAge:   1_000 * time.Second,
+					MaxCount: maxCount,
+					Clock:    func() time.Time { return time.Unix(now, 0) },
+				}
+				storage := newStorage()
+				arr := NewSortedArray(chunkSize, storage, WithRetention(policy))
+				model := make(map[uint32]bool)
+				for step := 0; step < 50; step++ {
+					now += int64(rng.Intn(200))
+					items := make([]uint32, 0)
+					for i := rng.Intn(100); i >= 0; i-- {
+						item := uint32(now) - uint32(rng.Intn(int(now)+1)) // timestamps up to now
+						items = append(items, item)
+						model[item] = true
+					}
+					require.NoError(t, arr.Add(items))
+					require.NoError(t, arr.Flush())
+
+					expected := make([]uint32, 0)
+					for item := uint32(now); ; item-- {
+						if model[item] && int64(item) >= now-1_000 && uint64(len(expected)) < maxCount {
+							expected = append([]uint32{item}, expected...)
+						}
+						if item == 0 {
+							break
+						}
+					}
+					arr = NewSortedArray(chunkSize, storage, WithRetention(policy))
+					require.Equal(t, expected, arr.ToSlice(), "step %d", step)
+				}
+				problems, err := arr.Validate()
+				require.NoError(t, err)
+				require.Empty(t, problems)
+			})
+		}
+	}
+}
+
+func TestCap(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	storage := NewInMemoryChunkStorage()
+	arr := NewSortedArray(10, storage, WithCap(100))
+	model := make([]uint32, 0)
+	for i := 0; i < 100; i++ {
+		items := make([]uint32, 0)
+		for j := rng.Intn(30); j >= 0; j-- {
+			items = append(items, uint32(rng.Intn(10_000)))
+		}
+		require.NoError(t, arr.Add(items))
+		model = append(model, items...)
+		slices.Sort(model)
+		model = slices.Compact(model)
+		if len(model) > 100 {
+			model = model[len(model)-100:]
+		}
+		stats, err := arr.Stats()
+		require.NoError(t, err)
+		require.LessOrEqual(t, stats.Items, uint64(100))
+		require.Equal(t, model, arr.ToSlice())
+	}
+	require.NoError(t, arr.Flush())
+	require.Equal(t, model, NewSortedArray(10, storage).ToSlice())
+}
+
+func TestCapEvictsWithoutLoading(t *testing.T) {
+	for _, name := range []string{"flat", "paged"} {
+		t.Run(name, func(t *testing.T) {
+			var inner ChunkStorage = NewInMemoryChunkStorage()
+			if name == "paged" {
+				blobStorage := NewBlobChunkStorage(NewInMemoryBlobStorage())
+				blobStorage.metaPageSize = 4
+				inner = blobStorage
+			}
+			storage := &recordingStorage{ChunkStorage: inner}
+			arr := NewSortedArray(100, storage)
+			require.NoError(t, arr.Add(sequence(0, 10_000, 1)))
+			require.NoError(t, arr.Flush())
+			chunks, err := arr.Chunks()
+			require.NoError(t, err)
+			last, boundary := chunks[len(chunks)-1], (*ChunkMeta)(nil)
+			evicted := make(map[uint32]bool)
+			for _, cm := range chunks {
+				if cm.contains(5_000) {
+					boundary = cm
+				} else if cm.max < 5_000 {
+					evicted[cm.id] = true
+				}
+			}
+
+			arr = NewSortedArray(100, storage, WithCap(5_000))
+			storage.takeReads()
+			require.NoError(t, arr.Add([]uint32{20_000}))
+			reads := storage.takeReads()
+			require.Equal(t, []uint32{last.id, boundary.id}, reads) // the last chunk and the boundary one
+			for _, id := range reads {
+				require.False(t, evicted[id], "evicted chunk %d is read", id)
+			}
+			require.NoError(t, arr.Flush())
+			items := NewSortedArray(100, storage).ToSlice()
+			require.Len(t, items, 5_000)
+			require.EqualValues(t, 5_001, items[0])
+			require.EqualValues(t, 20_000, items[len(items)-1])
+		})
+	}
+}
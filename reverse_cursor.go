@@ -0,0 +1,75 @@
+package sorted_array
+
+import (
+	"golang.org/x/exp/slices"
+)
+
+// GetInRangeDesc returns a cursor over items in desc order (min,max are INCLUDED), e.g. newest timestamps first,
+// chunks are read from the last one, one chunk is loaded at a time
+// it is not a SortedNumbersStream: set operations (Intersect, Evaluate, sorted_numeric_streams) expect asc order
+func (a *SortedArray) GetInRangeDesc(min, max uint32) (*ReverseCursor, error) {
+	return a.ReverseCursor(min, max)
+}
+
+// ReverseCursor returns a cursor over items within [min,max] (INCLUDED) starting from the biggest one
+func (a *SortedArray) ReverseCursor(min, max uint32) (*ReverseCursor, error) {
+	c := &ReverseCursor{arr: a, min: min}
+	err := c.Seek(max)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// ReverseCursor walks items in desc order, one chunk is loaded at a time
+// it can be moved with Seek, e.g. to continue a page after the last shown item
+type ReverseCursor struct {
+	arr      *SortedArray
+	min, max uint32
+	chunks   []*ChunkMeta // not read yet, the next one is the last
+	items    []uint32     // left from the last read chunk (asc), the next one is the last
+	err      error
+}
+
+// Seek moves the cursor, so Next returns the biggest item <= item (and >= min of the cursor)
+func (c *ReverseCursor) Seek(item uint32) error {
+	c.max, c.chunks, c.items, c.err = item, nil, nil, nil
+	if c.max < c.min {
+		return nil
+	}
+	err := c.arr.initMeta()
+	if err == nil {
+		err = c.arr.meta.load(c.min, c.max)
+	}
+	if err != nil {
+		return err
+	}
+	c.chunks = slices.Clone(c.arr.meta.FindRelevantForReadRange(c.min, c.max))
+	return nil
+}
+
+// Next returns ok=false at the end or if a chunk can't be read, see Err
+func (c *ReverseCursor) Next() (item uint32, ok bool) {
+	for len(c.items) == 0 {
+		if len(c.chunks) == 0 || c.err != nil {
+			return 0, false
+		}
+		cm := c.chunks[len(c.chunks)-1]
+		c.chunks = c.chunks[:len(c.chunks)-1]
+		chunk, err := c.arr.readChunk(cm)
+		if err != nil {
+			c.err = err
+			return 0, false
+		}
+		if chunk == nil {
+			continue // skipped as corrupted
+		}
+		c.items = chunk.appendInRange(nil, c.min, c.max)
+		c.arr.releaseChunks([]uint32{cm.id})
+	}
+	item, c.items = c.items[len(c.items)-1], c.items[:len(c.items)-1]
+	return item, true
+}
+
+// Err returns the error the cursor stopped with, call it once Next returned ok=false (Seek resets it)
+func (c *ReverseCursor) Err() error { return c.err }
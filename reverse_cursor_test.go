@@ -0,0 +1,78 @@
+package sorted_array
+
+import (
+	SortedArrayStream "github.com/lezhnev74/SetOperationsOnSortedNumericStreams"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/exp/rand"
+	"testing"
+)
+
+func TestGetInRangeDesc(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	arr := NewSortedArray(10, NewInMemoryChunkStorage())
+	items := make([]uint32, 500)
+	for i := range items {
+		items[i] = uint32(rnd.Intn(2000))
+	}
+	require.NoError(t, arr.Add(items))
+	require.NoError(t, arr.Flush())
+
+	for i := 0; i < 100; i++ {
+		min := uint32(rnd.Intn(2100))
+		max := min + uint32(rnd.Intn(500))
+		asc, err := arr.GetInRange(min, max)
+		require.NoError(t, err)
+		expected := SortedArrayStream.ToSlice(asc)
+		for l, r := 0, len(expected)-1; l < r; l, r = l+1, r-1 {
+			expected[l], expected[r] = expected[r], expected[l]
+		}
+
+		desc, err := arr.GetInRangeDesc(min, max)
+		require.NoError(t, err)
+		require.Equal(t, expected, SortedArrayStream.ToSlice[uint32](desc), "[%d,%d]", min, max)
+	}
+
+	desc, err := NewSortedArray(10, NewInMemoryChunkStorage()).GetInRangeDesc(0, 100)
+	require.NoError(t, err)
+	require.Empty(t, SortedArrayStream.ToSlice[uint32](desc))
+	desc, err = arr.GetInRangeDesc(10, 5)
+	require.NoError(t, err)
+	require.Empty(t, SortedArrayStream.ToSlice[uint32](desc))
+}
+
+func TestReverseCursorLoadsOneChunkAtATime(t *testing.T) {
+	storage := &recordingStorage{ChunkStorage: NewInMemoryChunkStorage()}
+	arr := NewSortedArray(100, storage)
+	require.NoError(t, arr.Add(sequence(0, 10_000, 1))) // 100+ chunks
+	require.NoError(t, arr.Flush())
+
+	storage.takeReads()
+	cursor, err := arr.ReverseCursor(0, 10_000)
+	require.NoError(t, err)
+	for expected := uint32(9999); expected > 9989; expected-- {
+		item, ok := cursor.Next()
+		require.True(t, ok)
+		require.Equal(t, expected, item)
+	}
+	last := arr.meta.FindRelevantForRead(9999)
+	require.Equal(t, []uint32{last.id}, storage.takeReads()) // only the last chunk is read
+	require.Empty(t, arr.loadedChunks)                       // and released
+
+	// the next page starts after the last shown item
+	require.NoError(t, cursor.Seek(4999))
+	page := make([]uint32, 0)
+	for len(page) < 3 {
+		item, ok := cursor.Next()
+		require.True(t, ok)
+		page = append(page, item)
+	}
+	require.EqualValues(t, []uint32{4999, 4998, 4997}, page)
+	require.Equal(t, []uint32{arr.meta.FindRelevantForRead(4999).id}, storage.takeReads())
+
+	// min of the cursor is kept
+	cursor, err = arr.ReverseCursor(5000, 10_000)
+	require.NoError(t, err)
+	require.NoError(t, cursor.Seek(4999))
+	_, ok := cursor.Next()
+	require.False(t, ok)
+}
@@ -0,0 +1,316 @@
+package sorted_array
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"math/bits"
+)
+
+// Portable Roaring serialization (https://github.com/RoaringBitmap/RoaringFormatSpec),
+// understood by Java, Go, Rust and C implementations. All numbers are little-endian.
+//
+//	cookie | [run flags] | (key, cardinality-1) per container | [offsets] | containers
+//
+// Items are grouped into containers by their high 16 bits (the key), each container keeps low 16 bits.
+const (
+	roaringCookieNoRuns      = 12346 // followed by the number of containers
+	roaringCookie            = 12347 // the number of containers-1 is in the high 16 bits
+	roaringNoOffsetThreshold = 4     // with runs, offsets are written only for this many containers or more
+	roaringArrayMaxSize      = 4096  // bigger non-run containers are bitmaps
+	roaringBitmapBytes       = 8192
+)
+
+// roaringContainer describes a container for the header
+type roaringContainer struct {
+	key  uint16
+	card int
+	runs int
+}
+
+// isRun tells if runs are smaller than the array/bitmap alternative
+func (c *roaringContainer) isRun() bool {
+	alternative := roaringBitmapBytes
+	if c.card <= roaringArrayMaxSize {
+		alternative = 2 * c.card
+	}
+	return 2+4*c.runs < alternative
+}
+
+func (c *roaringContainer) serializedSize() int {
+	switch {
+	case c.isRun():
+		return 2 + 4*c.runs
+	case c.card <= roaringArrayMaxSize:
+		return 2 * c.card
+	default:
+		return roaringBitmapBytes
+	}
+}
+
+// ExportRoaring writes the array in the portable Roaring format
+// the array is read chunk by chunk twice: to describe containers and then to write them
+func (a *SortedArray) ExportRoaring(w io.Writer) error {
+	// 1. Describe containers
+	containers := make([]*roaringContainer, 0)
+	var prev uint32
+	err := a.eachChunk(func(chunk *Chunk) error {
+		for _, item := range chunk.ToSlice() {
+			key := uint16(item >> 16)
+			if len(containers) == 0 || containers[len(containers)-1].key != key {
+				containers = append(containers, &roaringContainer{key: key})
+			}
+			c := containers[len(containers)-1]
+			if c.card == 0 || prev+1 != item {
+				c.runs++
+			}
+			c.card++
+			prev = item
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "unable to describe containers")
+	}
+
+	// 2. Write the header
+	bw := bufio.NewWriter(w)
+	hasRuns := false
+	for _, c := range containers {
+		hasRuns = hasRuns || c.isRun()
+	}
+	header := make([]byte, 0)
+	headerSize := 8 + 8*len(containers)
+	if hasRuns {
+		header = binary.LittleEndian.AppendUint32(header, roaringCookie|uint32(len(containers)-1)<<16)
+		flags := make([]byte, (len(containers)+7)/8)
+		for i, c := range containers {
+			if c.isRun() {
+				flags[i/8] |= 1 << (i % 8)
+			}
+		}
+		header = append(header, flags...)
+		headerSize = 4 + len(flags) + 4*len(containers)
+		if len(containers) >= roaringNoOffsetThreshold {
+			headerSize += 4 * len(containers)
+		}
+	} else {
+		header = binary.LittleEndian.AppendUint32(header, roaringCookieNoRuns)
+		header = binary.LittleEndian.AppendUint32(header, uint32(len(containers)))
+	}
+	for _, c := range containers {
+		header = binary.LittleEndian.AppendUint16(header, c.key)
+		header = binary.LittleEndian.AppendUint16(header, uint16(c.card-1))
+	}
+	if !hasRuns || len(containers) >= roaringNoOffsetThreshold {
+		offset := headerSize
+		for _, c := range containers {
+			header = binary.LittleEndian.AppendUint32(header, uint32(offset))
+			offset += c.serializedSize()
+		}
+	}
+	_, err = bw.Write(header)
+	if err != nil {
+		return errors.Wrap(err, "unable to write header")
+	}
+
+	// 3. Write containers, values of one container may come from several chunks
+	pos, values := 0, make([]uint16, 0)
+	err = a.eachChunk(func(chunk *Chunk) error {
+		for _, item := range chunk.ToSlice() {
+			if uint16(item>>16) != containers[pos].key {
+				err := writeRoaringContainer(bw, containers[pos], values)
+				if err != nil {
+					return err
+				}
+				pos, values = pos+1, values[:0]
+			}
+			values = append(values, uint16(item))
+		}
+		return nil
+	})
+	if err == nil && len(containers) > 0 {
+		err = writeRoaringContainer(bw, containers[pos], values)
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		return errors.Wrap(err, "unable to write containers")
+	}
+	return nil
+}
+
+func writeRoaringContainer(w io.Writer, c *roaringContainer, values []uint16) error {
+	if len(values) != c.card {
+		return fmt.Errorf("container %d changed while exporting", c.key)
+	}
+	buf := make([]byte, 0, c.serializedSize())
+	switch {
+	case c.isRun():
+		buf = binary.LittleEndian.AppendUint16(buf, uint16(c.runs))
+		for i := 0; i < len(values); {
+			j := i + 1
+			for j < len(values) && values[j-1]+1 == values[j] {
+				j++
+			}
+			buf = binary.LittleEndian.AppendUint16(buf, values[i])
+			buf = binary.LittleEndian.AppendUint16(buf, uint16(j-i-1))
+			i = j
+		}
+	case c.card <= roaringArrayMaxSize:
+		for _, v := range values {
+			buf = binary.LittleEndian.AppendUint16(buf, v)
+		}
+	default:
+		bitmap := make([]uint64, roaringBitmapBytes/8)
+		for _, v := range values {
+			bitmap[v/64] |= 1 << (v % 64)
+		}
+		for _, word := range bitmap {
+			buf = binary.LittleEndian.AppendUint64(buf, word)
+		}
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+// ImportRoaring reads the portable Roaring format into the array in the storage
+// containers are added one by one and flushed, so the whole bitmap is never in memory
+func ImportRoaring(r io.Reader, maxChunkSize uint32, storage ChunkStorage, opts ...ArrayOption) (*SortedArray, error) {
+	br := bufio.NewReader(r)
+	read := func(data any) error { return binary.Read(br, binary.LittleEndian, data) }
+
+	// 1. Read the header
+	var cookie uint32
+	err := read(&cookie)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read cookie")
+	}
+	var (
+		size     uint32
+		runFlags []byte
+	)
+	switch {
+	case cookie&0xFFFF == roaringCookie:
+		size = cookie>>16 + 1
+		runFlags = make([]byte, (size+7)/8)
+		err = read(runFlags)
+	case cookie == roaringCookieNoRuns:
+		err = read(&size)
+		if err == nil && size > 1<<16 {
+			err = fmt.Errorf("too many containers: %d", size)
+		}
+	default:
+		err = fmt.Errorf("unknown cookie %d", cookie)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read header")
+	}
+	containers := make([]*roaringContainer, size)
+	for i := range containers {
+		var kc [2]uint16
+		err = read(&kc)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to read header")
+		}
+		containers[i] = &roaringContainer{key: kc[0], card: int(kc[1]) + 1}
+		if i > 0 && containers[i-1].key >= kc[0] {
+			return nil, fmt.Errorf("container keys are not sorted")
+		}
+	}
+	if runFlags == nil || size >= roaringNoOffsetThreshold {
+		_, err = br.Discard(4 * int(size)) // containers are read in order, offsets are not needed
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to read offsets")
+		}
+	}
+
+	// 2. Read containers
+	arr := NewSortedArray(maxChunkSize, storage, opts...)
+	for i, c := range containers {
+		isRun := runFlags != nil && runFlags[i/8]&(1<<(i%8)) != 0
+		values, err := readRoaringContainer(br, c, isRun)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to read container %d", c.key)
+		}
+		items := make([]uint32, len(values))
+		for j, v := range values {
+			items[j] = uint32(c.key)<<16 | uint32(v)
+		}
+		for len(items) > 0 {
+			batch := items
+			if len(batch) > int(maxChunkSize) {
+				batch = items[:maxChunkSize]
+			}
+			items = items[len(batch):]
+			err = arr.Add(batch)
+			if err != nil {
+				return nil, err
+			}
+		}
+		err = arr.Flush()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return arr, nil
+}
+
+func readRoaringContainer(r io.Reader, c *roaringContainer, isRun bool) ([]uint16, error) {
+	read := func(data any) error { return binary.Read(r, binary.LittleEndian, data) }
+	values := make([]uint16, 0, c.card)
+	switch {
+	case isRun:
+		var n uint16
+		err := read(&n)
+		if err != nil {
+			return nil, err
+		}
+		runs := make([]uint16, 2*int(n))
+		err = read(runs)
+		if err != nil {
+			return nil, err
+		}
+		next := 0 // the smallest possible start of the next run
+		for i := 0; i < len(runs); i += 2 {
+			start, last := int(runs[i]), int(runs[i])+int(runs[i+1])
+			if start < next || last > 0xFFFF || len(values)+last-start+1 > c.card {
+				return nil, fmt.Errorf("unexpected runs")
+			}
+			for v := start; v <= last; v++ {
+				values = append(values, uint16(v))
+			}
+			next = last + 1
+		}
+	case c.card <= roaringArrayMaxSize:
+		values = values[:c.card]
+		err := read(values)
+		if err != nil {
+			return nil, err
+		}
+		for i := 1; i < len(values); i++ {
+			if values[i-1] >= values[i] {
+				return nil, fmt.Errorf("values are not sorted")
+			}
+		}
+	default:
+		bitmap := make([]uint64, roaringBitmapBytes/8)
+		err := read(bitmap)
+		if err != nil {
+			return nil, err
+		}
+		for w, word := range bitmap {
+			for word != 0 {
+				values = append(values, uint16(w*64+bits.TrailingZeros64(word)))
+				word &= word - 1
+			}
+		}
+	}
+	if len(values) != c.card {
+		return nil, fmt.Errorf("cardinality is %d, expected %d", len(values), c.card)
+	}
+	return values, nil
+}
@@ -0,0 +1,102 @@
+package sorted_array
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/exp/rand"
+	"golang.org/x/exp/slices"
+	"testing"
+)
+
+func TestExportRoaringFormat(t *testing.T) {
+	tests := []struct {
+		items    []uint32
+		expected []byte
+	}{
+		{ // an array container, no runs
+			[]uint32{1, 2, 3, 1000},
+			[]byte{
+				0x3a, 0x30, 0, 0, 1, 0, 0, 0, // cookie, size
+				0, 0, 3, 0, // key, card-1
+				16, 0, 0, 0, // offset
+				1, 0, 2, 0, 3, 0, 0xe8, 0x03,
+			},
+		},
+		{ // a run container
+			sequence(0, 100, 1),
+			[]byte{
+				0x3b, 0x30, 0, 0, // cookie with size-1
+				1,           // run flags
+				0, 0, 99, 0, // key, card-1
+				1, 0, 0, 0, 99, 0, // runs count, start, length-1
+			},
+		},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("test %d", i), func(t *testing.T) {
+			arr := NewSortedArray(10, NewInMemoryChunkStorage())
+			require.NoError(t, arr.Add(tt.items))
+			require.NoError(t, arr.Flush())
+
+			var buf bytes.Buffer
+			require.NoError(t, arr.ExportRoaring(&buf))
+			require.Equal(t, tt.expected, buf.Bytes())
+		})
+	}
+}
+
+func TestRoaringRoundTrip(t *testing.T) {
+	datasets := map[string][]uint32{
+		"empty":  {},
+		"sparse": sequence(0, 1<<24, 997),                                            // array containers
+		"dense":  sequence(1<<16, 1<<17, 3),                                          // a bitmap container
+		"runs":   append(sequence(0, 1<<16+500, 1), sequence(1<<20, 1<<20+10, 1)...), // run containers
+		"mixed":  append(sequence(10, 5000, 7), sequence(1<<16, 1<<17+100, 2)...),
+	}
+	random := make([]uint32, 0)
+	for i := 0; i < 5000; i++ {
+		random = append(random, uint32(rand.Intn(1<<20)))
+	}
+	slices.Sort(random)
+	datasets["random"] = slices.Compact(random)
+
+	for name, items := range datasets {
+		t.Run(name, func(t *testing.T) {
+			arr := NewSortedArray(1000, NewInMemoryChunkStorage())
+			require.NoError(t, arr.Add(slices.Clone(items)))
+			require.NoError(t, arr.Flush())
+
+			var buf bytes.Buffer
+			require.NoError(t, arr.ExportRoaring(&buf))
+
+			arr2, err := ImportRoaring(bytes.NewReader(buf.Bytes()), 1000, NewInMemoryChunkStorage())
+			require.NoError(t, err)
+			require.EqualValues(t, items, arr2.ToSlice())
+
+			// the export is stable
+			var buf2 bytes.Buffer
+			require.NoError(t, arr2.ExportRoaring(&buf2))
+			require.Equal(t, buf.Bytes(), buf2.Bytes())
+		})
+	}
+}
+
+func TestImportRoaringDamaged(t *testing.T) {
+	arr := NewSortedArray(100, NewInMemoryChunkStorage())
+	require.NoError(t, arr.Add(append(sequence(0, 300, 3), sequence(1<<16, 1<<16+100, 1)...)))
+	var buf bytes.Buffer
+	require.NoError(t, arr.ExportRoaring(&buf))
+	data := buf.Bytes()
+
+	_, err := ImportRoaring(bytes.NewReader(data[:len(data)-1]), 100, NewInMemoryChunkStorage())
+	require.Error(t, err)
+	_, err = ImportRoaring(bytes.NewReader([]byte{1, 2, 3, 4}), 100, NewInMemoryChunkStorage())
+	require.ErrorContains(t, err, "unknown cookie")
+
+	for i := range data { // garbage must not panic
+		damaged := slices.Clone(data)
+		damaged[i] ^= 0xff
+		_, _ = ImportRoaring(bytes.NewReader(damaged), 100, NewInMemoryChunkStorage())
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"golang.org/x/exp/maps"
 	"math"
 	"sync"
+	"time"
 )
 
 var (
@@ -17,17 +18,72 @@ var (
 // SortedArray manages ASC sorted array in chunks for better performance
 // Chunks contain up to maxInsertSize items and may not intersect with each other
 type SortedArray struct {
-	maxChunkSize uint32
-	chunksLock   sync.Mutex
-	loadedChunks map[uint32]*Chunk
-	dirtyChunks  map[uint32]struct{} // which loadedChunks are pending flushing
-	meta         *Meta               // sorted array
-	dirtyMeta    bool                // meta is pending flushing
-	metaInit     bool                // meta is loaded from storage
-	storage      ChunkStorage
+	maxChunkSize  uint32
+	chunksLock    sync.Mutex
+	loadedChunks  map[uint32]*Chunk
+	dirtyChunks   map[uint32]struct{} // which loadedChunks are pending flushing
+	removedChunks map[uint32]struct{} // which chunks are pending removal from the storage
+	meta          *Meta               // sorted array
+	dirtyMeta     bool                // meta is pending flushing
+	metaInit      bool                // meta is loaded from storage
+	storage       ChunkStorage
+
+	skipCorrupted     bool   // reads ignore corrupted chunks instead of failing
+	filterBitsPerItem uint32 // build chunk filters of this size, 0 means no filters
+	observer          Observer
+	retention         *RetentionPolicy // trims the array on flush, nil means keep everything
+	capacity          uint64           // max items kept after every Add, 0 means no limit
+	counted           bool             // a multiset, chunks keep a count per item (see WithCounts)
+	valueWidth        int              // a sorted map, chunks keep a value per item (see WithValues)
+}
+
+// ArrayOption configures optional behaviour of SortedArray
+type ArrayOption func(*SortedArray)
+
+// WithSkipCorrupted makes reads (GetInRange, ToSlice) ignore corrupted chunks instead of failing
+// modifications that touch a corrupted chunk still fail
+func WithSkipCorrupted() ArrayOption {
+	return func(a *SortedArray) { a.skipCorrupted = true }
+}
+
+// WithChunkFilters makes the array keep a bloom filter per chunk in the meta
+// so Contains can skip loading chunks that definitely don't hold the value
+// 10 bits per item give ~1% false positives
+func WithChunkFilters(bitsPerItem uint32) ArrayOption {
+	return func(a *SortedArray) { a.filterBitsPerItem = bitsPerItem }
+}
+
+// Contains checks if the item is in the array
+func (a *SortedArray) Contains(item uint32) (bool, error) {
+	err := a.initMeta()
+	if err != nil {
+		return false, err
+	}
+	err = a.meta.load(item, item)
+	if err != nil {
+		return false, err
+	}
+	cm := a.meta.FindRelevantForRead(item)
+	if cm == nil {
+		return false, nil
+	}
+	// a loaded chunk may be modified, its filter is only refreshed on flush
+	if chunk, ok := a.loadedChunks[cm.id]; ok {
+		return chunk.Contains(item), nil
+	}
+	if !a.meta.mayContain(cm.id, item) {
+		return false, nil
+	}
+	chunk, err := a.readChunk(cm)
+	if err != nil || chunk == nil {
+		return false, err // nil if skipped as corrupted
+	}
+	defer a.releaseChunks([]uint32{cm.id})
+	return chunk.Contains(item), nil
 }
 
 // GetInRange returns a stream of items (min,max are INCLUDED)
+// if a chunk can't be read, the stream ends early and StreamErr tells why
 func (a *SortedArray) GetInRange(min, max uint32) (sorted_numeric_streams.SortedNumbersStream[uint32], error) {
 	err := a.initMeta()
 	if err != nil {
@@ -35,21 +91,27 @@ func (a *SortedArray) GetInRange(min, max uint32) (sorted_numeric_streams.Sorted
 	}
 
 	// 1. See appropriate chunks in meta
+	err = a.meta.load(min, max)
+	if err != nil {
+		return nil, err
+	}
 	relevantChunkMeta := a.meta.FindRelevantForReadRange(min, max)
 
-	result := sorted_numeric_streams.NewChannelStream[uint32]()
+	result := &rangeStream{ChannelStream: sorted_numeric_streams.NewChannelStream[uint32]()}
 	go func() {
 		defer result.Close()
 		// 2. Iterate over all chunks in order and push items to the outbound stream
 		for _, cm := range relevantChunkMeta {
-			err := a.loadChunks([]uint32{cm.id}) // load the chunk
+			chunk, err := a.readChunk(cm)
 			if err != nil {
-				panic(err)
+				result.err = err // visible to the reader once the stream is closed
+				return
 			}
-			for _, item := range a.loadedChunks[cm.id].Items {
-				if item >= min && item <= max {
-					result.Push(item)
-				}
+			if chunk == nil {
+				continue // skipped as corrupted
+			}
+			for _, item := range chunk.appendInRange(nil, min, max) {
+				result.Push(item)
 			}
 			a.releaseChunks([]uint32{cm.id})
 		}
@@ -57,11 +119,39 @@ func (a *SortedArray) GetInRange(min, max uint32) (sorted_numeric_streams.Sorted
 	return result, nil
 }
 
+// rangeStream is the stream of GetInRange
+type rangeStream struct {
+	*sorted_numeric_streams.ChannelStream[uint32]
+	err error
+}
+
+// Err returns the error the stream ended with, call it once Next returned ok=false
+func (s *rangeStream) Err() error { return s.err }
+
+// StreamErr returns the error a stream of the array ended with (nil if it was read to the end),
+// call it once Next returned ok=false, streams of other packages have no errors
+func StreamErr(s sorted_numeric_streams.SortedNumbersStream[uint32]) error {
+	if f, ok := s.(interface{ Err() error }); ok {
+		return f.Err()
+	}
+	return nil
+}
+
 func (a *SortedArray) Delete(items []uint32) error {
+	if len(items) == 0 {
+		return nil
+	}
 	err := a.initMeta()
 	if err != nil {
 		return err
 	}
+	err = a.meta.load(bounds(items))
+	if err != nil {
+		return err
+	}
+	if len(a.meta.chunks) == 0 {
+		return nil // nothing to delete from
+	}
 	// 1. Plan. Make a chunk map for new items (where to put each item) - a modification plan
 	plan, err := a.planModification(items)
 	if err != nil {
@@ -81,7 +171,7 @@ func (a *SortedArray) Delete(items []uint32) error {
 			continue
 		}
 		// detect empty chunk
-		if len(chunk.Items) == 0 {
+		if chunk.Len() == 0 {
 			emptyChunkIds = append(emptyChunkIds, chunkId)
 			continue
 		}
@@ -89,14 +179,17 @@ func (a *SortedArray) Delete(items []uint32) error {
 		// update meta
 		a.dirtyMeta = true
 		cm := a.meta.GetChunkById(chunkId)
-		cm.min = chunk.Items[0]
-		cm.max = chunk.Items[len(chunk.Items)-1]
-		cm.size = uint32(len(chunk.Items))
+		cm.min = chunk.Min()
+		cm.max = chunk.Max()
+		cm.size = uint32(chunk.Len())
 	}
 	// 4. Cleanup empty
-	a.storage.Remove(emptyChunkIds)
 	for _, chunkId := range emptyChunkIds {
 		a.meta.Remove(a.meta.GetChunkById(chunkId))
+		a.dirtyMeta = true
+		delete(a.loadedChunks, chunkId)
+		delete(a.dirtyChunks, chunkId)
+		a.removedChunks[chunkId] = struct{}{}
 	}
 	// 5. Detect too small chunks and MERGE those
 	a.merge()
@@ -105,10 +198,26 @@ func (a *SortedArray) Delete(items []uint32) error {
 
 // Add Puts new items to the array
 func (a *SortedArray) Add(items []uint32) error {
+	return a.add(items, nil)
+}
+
+// add puts items to the array, with values (by item) for key-value arrays, see Put
+func (a *SortedArray) add(items []uint32, values map[uint32][]byte) (err error) {
 	if len(items) == 0 {
 		return nil
 	}
-	err := a.initMeta()
+	if a.capacity > 0 {
+		defer func() {
+			if err == nil {
+				err = a.trimToCount(a.capacity) // evict the smallest items
+			}
+		}()
+	}
+	err = a.initMeta()
+	if err != nil {
+		return err
+	}
+	err = a.meta.load(bounds(items))
 	if err != nil {
 		return err
 	}
@@ -116,7 +225,11 @@ func (a *SortedArray) Add(items []uint32) error {
 	// 0. edge-case: the birth of the index, first chunk is created here
 	// all further chunks are made by SPLITTING only
 	if len(a.meta.chunks) == 0 {
-		a.createChunkFor(items[:1])
+		c := a.newChunk(items[:1])
+		if values != nil {
+			c.Put(items[:1], [][]byte{values[items[0]]})
+		}
+		a.createChunk(c)
 		items = items[1:]    // the first item was consumed to spawn a new chunk
 		if len(items) == 0 { // another check after consuming one item
 			return nil
@@ -134,19 +247,28 @@ func (a *SortedArray) Add(items []uint32) error {
 	}
 	// 3. Make insertion
 	for chunkId, items := range plan {
-		added := a.loadedChunks[chunkId].Add(items)
-		if added == 0 {
-			continue // no new items added
+		var added int
+		if values == nil {
+			added = a.loadedChunks[chunkId].Add(items)
+		} else {
+			chunkValues := make([][]byte, len(items))
+			for i, item := range items {
+				chunkValues[i] = values[item]
+			}
+			added = a.loadedChunks[chunkId].Put(items, chunkValues)
+		}
+		if added == 0 && !a.counted && values == nil {
+			continue // no new items added (multisets still have counts incremented, maps have values replaced)
 		}
 		a.dirtyChunks[chunkId] = struct{}{}
 		// update meta
 		cm := a.meta.GetChunkById(chunkId)
 		cm.size += uint32(added)
-		if a.loadedChunks[chunkId].Items[0] < cm.min {
-			cm.min = a.loadedChunks[chunkId].Items[0]
+		if a.loadedChunks[chunkId].Min() < cm.min {
+			cm.min = a.loadedChunks[chunkId].Min()
 		}
-		if a.loadedChunks[chunkId].Items[len(a.loadedChunks[chunkId].Items)-1] > cm.max {
-			cm.max = a.loadedChunks[chunkId].Items[len(a.loadedChunks[chunkId].Items)-1]
+		if a.loadedChunks[chunkId].Max() > cm.max {
+			cm.max = a.loadedChunks[chunkId].Max()
 		}
 		a.dirtyMeta = true
 	}
@@ -158,6 +280,9 @@ func (a *SortedArray) Add(items []uint32) error {
 // ToSlice dump all index to a single slice (for debugging/testing)
 func (a *SortedArray) ToSlice() []uint32 {
 	err := a.initMeta()
+	if err == nil {
+		err = a.meta.loadAll()
+	}
 	if err != nil {
 		panic(err)
 	}
@@ -167,14 +292,17 @@ func (a *SortedArray) ToSlice() []uint32 {
 		size += cm.size
 		ids = append(ids, cm.id)
 	}
-	err = a.loadChunks(ids)
+	err = a.loadChunksForRead(ids)
 	if err != nil {
 		panic(errors.Wrap(err, "ToSlice() failed"))
 	}
 	ret := make([]uint32, 0, size)
 	for _, cm := range a.meta.chunks {
-		chunk := a.loadedChunks[cm.id]
-		ret = append(ret, chunk.Items...)
+		chunk, ok := a.loadedChunks[cm.id]
+		if !ok {
+			continue // skipped as corrupted
+		}
+		ret = chunk.appendInRange(ret, 0, math.MaxUint32)
 	}
 
 	return ret
@@ -182,16 +310,47 @@ func (a *SortedArray) ToSlice() []uint32 {
 func (a *SortedArray) dumpChunks() {
 	fmt.Printf("--- chunks ---\n")
 	for _, cm := range a.meta.chunks {
-		fmt.Printf("chunk %d: %v\n", cm.id, a.loadedChunks[cm.id].Items)
+		fmt.Printf("chunk %d: %v\n", cm.id, a.loadedChunks[cm.id].ToSlice())
 	}
 }
 func (a *SortedArray) getChunks() (chunks [][]uint32) {
 	for _, cm := range a.meta.chunks {
-		chunks = append(chunks, a.loadedChunks[cm.id].Items)
+		chunks = append(chunks, a.loadedChunks[cm.id].ToSlice())
 	}
 	return
 }
 
+// eachChunk calls fn with every chunk in order, loading one chunk at a time
+func (a *SortedArray) eachChunk(fn func(chunk *Chunk) error) error {
+	err := a.initMeta()
+	if err == nil {
+		err = a.meta.loadAll()
+	}
+	if err != nil {
+		return err
+	}
+	ids := make([]uint32, 0, len(a.meta.chunks))
+	for _, cm := range a.meta.chunks {
+		ids = append(ids, cm.id)
+	}
+	for _, id := range ids {
+		err = a.loadChunksForRead([]uint32{id})
+		if err != nil {
+			return err
+		}
+		chunk, ok := a.loadedChunks[id]
+		if !ok {
+			continue // skipped as corrupted
+		}
+		err = fn(chunk)
+		a.releaseChunks([]uint32{id})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // planModification returns items grouped by relevant chunk
 func (a *SortedArray) planModification(items []uint32) (plan map[uint32][]uint32, err error) {
 	plan = make(map[uint32][]uint32)
@@ -231,17 +390,14 @@ func (a *SortedArray) selectChunkIdForInsertion(item uint32) (chunkId uint32, er
 	return
 }
 
-// createChunkFor allocates a new chunk for the item and puts it into
-// items are sorted
-func (a *SortedArray) createChunkFor(items []uint32) uint32 {
+// createChunk puts a new (non-empty) chunk to the array
+func (a *SortedArray) createChunk(c *Chunk) uint32 {
 	// Make Chunk Description
 	chunkId := a.meta.TakeNextId()
-	chunkMeta := &ChunkMeta{chunkId, items[0], items[len(items)-1], uint32(len(items))}
+	chunkMeta := &ChunkMeta{chunkId, c.Min(), c.Max(), uint32(c.Len())}
 	a.meta.Add([]*ChunkMeta{chunkMeta})
 	a.dirtyMeta = true
 
-	// Make a chunk
-	c := NewChunk(items)
 	a.loadedChunks[chunkId] = c
 	a.dirtyChunks[chunkId] = struct{}{}
 
@@ -270,31 +426,138 @@ func (a *SortedArray) loadChunks(ids []uint32) error {
 		return err
 	}
 	// 3. merge with the existing load
+	for id, c := range loaded {
+		if a.counted {
+			c.counts = c.allCounts() // chunks written without counts
+		}
+		if a.valueWidth > 0 && c.valueWidth == 0 {
+			c.valueWidth, c.values = a.valueWidth, make([]byte, c.Len()*a.valueWidth) // chunks written without values
+		}
+		if c.valueWidth != a.valueWidth {
+			return fmt.Errorf("chunk %d has values of %d bytes, expected %d", id, c.valueWidth, a.valueWidth)
+		}
+	}
 	maps.Copy(a.loadedChunks, loaded)
+	a.observer.ChunksLoaded(ids)
+	return nil
+}
+
+// loadChunksForRead works as loadChunks, but corrupted chunks are left unloaded if the array skips them
+func (a *SortedArray) loadChunksForRead(ids []uint32) error {
+	ids = append([]uint32(nil), ids...) // loadChunks reuses the slice
+	err := a.loadChunks(ids)
+	var corrupted *ErrCorrupted
+	if err == nil || !a.skipCorrupted || !errors.As(err, &corrupted) {
+		return err
+	}
+	// isolate damaged chunks by loading one at a time
+	for _, id := range ids {
+		err = a.loadChunks([]uint32{id})
+		if err != nil && !errors.As(err, &corrupted) {
+			return err
+		}
+	}
 	return nil
 }
 
+// readChunk loads the chunk for reading, it is nil if skipped as corrupted, the caller releases it
+func (a *SortedArray) readChunk(cm *ChunkMeta) (*Chunk, error) {
+	err := a.loadChunksForRead([]uint32{cm.id})
+	if err != nil {
+		return nil, err
+	}
+	return a.loadedChunks[cm.id], nil
+}
+
 // releaseChunks removes pointers to chunk instances for later GC
+// dirty chunks stay in memory until flushed
 func (a *SortedArray) releaseChunks(ids []uint32) {
 	a.chunksLock.Lock()
 	defer a.chunksLock.Unlock()
+	released := make([]uint32, 0, len(ids))
 	for _, id := range ids {
-		delete(a.loadedChunks, id)
+		if _, dirty := a.dirtyChunks[id]; dirty {
+			continue
+		}
+		if _, ok := a.loadedChunks[id]; ok {
+			delete(a.loadedChunks, id)
+			released = append(released, id)
+		}
 	}
+	a.observer.ChunksReleased(released)
 }
 
+// Flush writes all pending changes to the storage
+// if it fails, pending changes are kept in memory so Flush can be retried
 func (a *SortedArray) Flush() error {
+	err := a.writePending()
+	if err != nil {
+		return err
+	}
+	a.clearPending()
+	return nil
+}
+
+// writePending sends pending changes to the storage without forgetting them
+func (a *SortedArray) writePending() (err error) {
+	defer func(start time.Time) { a.observer.Flushed(time.Since(start), err) }(time.Now())
+	err = a.Trim()
+	if err != nil {
+		return errors.Wrap(err, "unable to apply the retention policy")
+	}
+	if len(a.removedChunks) > 0 {
+		err := a.storage.Remove(maps.Keys(a.removedChunks))
+		if err != nil {
+			return errors.Wrap(err, "unable to remove chunks")
+		}
+	}
+	// filters of modified chunks are rebuilt (or dropped if this array does not keep them)
+	for id := range a.dirtyChunks {
+		var f chunkFilter
+		if a.filterBitsPerItem > 0 {
+			f = newChunkFilter(a.loadedChunks[id].ToSlice(), a.filterBitsPerItem)
+		}
+		a.meta.setFilter(id, f)
+		a.dirtyMeta = true
+	}
 	if a.dirtyMeta {
-		a.dirtyMeta = false
-		a.storage.SaveMeta(a.meta)
+		err := a.storage.SaveMeta(a.meta)
+		if err != nil {
+			return errors.Wrap(err, "unable to save meta")
+		}
 	}
-	chunksToSave := make(map[uint32]*Chunk, 0)
-	for id, _ := range a.dirtyChunks {
+	chunksToSave := make(map[uint32]*Chunk, len(a.dirtyChunks))
+	for id := range a.dirtyChunks {
 		chunksToSave[id] = a.loadedChunks[id]
+	}
+	err = a.storage.Save(chunksToSave)
+	if err != nil {
+		return errors.Wrap(err, "unable to save chunks")
+	}
+	return nil
+}
+
+// forgetPersisted makes the next flush write the whole loaded meta again
+// used when writes were rolled back outside the array
+func (a *SortedArray) forgetPersisted() {
+	if a.meta != nil {
+		a.meta.forgetPersisted()
+	}
+}
+
+// clearPending forgets pending changes once they are persisted
+func (a *SortedArray) clearPending() {
+	a.dirtyMeta = false
+	for id := range a.removedChunks {
+		delete(a.removedChunks, id)
+	}
+	released := make([]uint32, 0, len(a.dirtyChunks))
+	for id := range a.dirtyChunks {
 		delete(a.dirtyChunks, id)
 		delete(a.loadedChunks, id) // free the chunk
+		released = append(released, id)
 	}
-	return a.storage.Save(chunksToSave)
+	a.observer.ChunksReleased(released)
 }
 
 // split detects Too Big chunks based on Meta and split those
@@ -310,13 +573,13 @@ func (a *SortedArray) split() (split bool) {
 		split = true
 		chunk := a.loadedChunks[cm.id]
 		newSize := uint32(math.Ceil(float64(cm.size) / 2))
-		newChunkItems := chunk.Items[newSize:] // split in half
-		chunk.Items = chunk.Items[:newSize]
+		newChunk := chunk.splitAt(int(newSize)) // split in half
 		// Update original chunk's meta
 		cm.size = newSize
-		cm.max = chunk.Items[newSize-1]
+		cm.max = chunk.Max()
 		// Create a new chunk
-		a.createChunkFor(newChunkItems)
+		newId := a.createChunk(newChunk)
+		a.observer.ChunkSplit(cm.id, newId)
 	}
 	if split {
 		return a.split() // go on until no more to split
@@ -331,7 +594,7 @@ func (a *SortedArray) merge() {
 		cm := a.meta.chunks[i]
 		prevCm := a.meta.chunks[i-1]
 		mergeSize := cm.size + prevCm.size
-		if mergeSize > a.maxChunkSize {
+		if mergeSize > a.maxChunkSize || !a.meta.adjacent(prevCm, cm) {
 			continue
 		}
 		plan = append(plan, []*ChunkMeta{prevCm, cm}) // ordered
@@ -346,36 +609,44 @@ func (a *SortedArray) merge() {
 	a.loadChunks(chunkIds)
 
 	// 3. merge
-	removeChunkIds := make([]uint32, 0, len(plan))
 	a.dirtyMeta = true
 	for _, cms := range plan {
-		// update meta
-		cm1, cm2 := cms[0], cms[1]
-		cm1.size += cm2.size
-		cm1.max = cm2.max
-		a.meta.Remove(cm2)
-		// update chunks
-		a.loadedChunks[cm1.id].Add(a.loadedChunks[cm2.id].Items)
-		a.dirtyChunks[cm1.id] = struct{}{}
-		delete(a.loadedChunks, cm2.id)
-		delete(a.dirtyChunks, cm2.id)
-		removeChunkIds = append(removeChunkIds, cm2.id)
-	}
-	err := a.storage.Remove(removeChunkIds)
-	if err != nil {
-		panic(err)
+		a.mergePair(cms[0], cms[1])
 	}
 }
 
+// mergePair moves items of the loaded chunk cm2 to the loaded chunk cm1 (the previous one) and drops cm2
+func (a *SortedArray) mergePair(cm1, cm2 *ChunkMeta) {
+	// update meta
+	cm1.size += cm2.size
+	cm1.max = cm2.max
+	a.meta.Remove(cm2)
+	a.dirtyMeta = true
+	// update chunks
+	a.loadedChunks[cm1.id].absorb(a.loadedChunks[cm2.id])
+	a.dirtyChunks[cm1.id] = struct{}{}
+	delete(a.loadedChunks, cm2.id)
+	delete(a.dirtyChunks, cm2.id)
+	a.removedChunks[cm2.id] = struct{}{}
+	a.observer.ChunksMerged(cm1.id, cm2.id)
+}
+
 // initMeta loads meta into memory
 func (a *SortedArray) initMeta() (err error) {
 	if a.metaInit {
 		return nil
 	}
-	a.metaInit = true
-	a.meta, err = a.storage.ReadMeta()
+	if a.counted && a.valueWidth > 0 {
+		return fmt.Errorf("WithCounts can't be combined with WithValues")
+	}
+	meta, err := a.storage.ReadMeta()
 	if err != nil {
-		return
+		return // the next call tries again
+	}
+	a.meta, a.metaInit = meta, true
+	a.meta.chunkSize = a.maxChunkSize
+	if a.meta.pages != nil {
+		return // a paged meta is not fully loaded, trust its nextId
 	}
 	a.meta.nextId = 0
 	for _, cm := range a.meta.chunks {
@@ -386,12 +657,22 @@ func (a *SortedArray) initMeta() (err error) {
 	return
 }
 
-func NewSortedArray(maxChunkSize uint32, s ChunkStorage) *SortedArray {
-	return &SortedArray{
-		chunksLock:   sync.Mutex{},
-		loadedChunks: make(map[uint32]*Chunk),
-		dirtyChunks:  make(map[uint32]struct{}),
-		maxChunkSize: maxChunkSize,
-		storage:      s,
+func NewSortedArray(maxChunkSize uint32, s ChunkStorage, opts ...ArrayOption) *SortedArray {
+	a := &SortedArray{
+		chunksLock:    sync.Mutex{},
+		loadedChunks:  make(map[uint32]*Chunk),
+		dirtyChunks:   make(map[uint32]struct{}),
+		removedChunks: make(map[uint32]struct{}),
+		maxChunkSize:  maxChunkSize,
+		storage:       s,
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	if a.observer == nil {
+		a.observer = nopObserver{}
+	} else {
+		a.storage = &observedStorage{a.storage, a.observer}
 	}
+	return a
 }
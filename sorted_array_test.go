@@ -1,10 +1,12 @@
 package sorted_array
 
 import (
+	"errors"
 	"fmt"
 	SortedArrayStream "github.com/lezhnev74/SetOperationsOnSortedNumericStreams"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/exp/rand"
+	"sort"
 	"testing"
 )
 
@@ -142,3 +144,267 @@ func TestSimpleAPI(t *testing.T) {
 	arr.Flush()
 	require.EqualValues(t, []uint32{2, 4, 5}, arr.ToSlice())
 }
+
+func TestCorruptedChunksOnRead(t *testing.T) {
+	blobs := NewInMemoryBlobStorage()
+	storage := NewBlobChunkStorage(blobs)
+	arr := NewSortedArray(2, storage)
+	require.NoError(t, arr.Add([]uint32{10, 20, 30, 40}))
+	require.NoError(t, arr.Flush()) // chunks: (10,20), (30,40)
+
+	// damage the first chunk
+	blob := blobs.blobs[chunkBlobKey(0)]
+	blob[len(blob)-1] ^= 1
+
+	// fail by default
+	arr = NewSortedArray(2, storage)
+	require.Panics(t, func() { arr.ToSlice() })
+	items, err := arr.GetInRange(0, 100)
+	require.NoError(t, err)
+	require.Empty(t, SortedArrayStream.ToSlice(items)) // the stream ends early
+	require.ErrorAs(t, StreamErr(items), new(*ErrCorrupted))
+
+	// skip if asked
+	arr = NewSortedArray(2, storage, WithSkipCorrupted())
+	require.EqualValues(t, []uint32{30, 40}, arr.ToSlice())
+	items, err = arr.GetInRange(0, 100)
+	require.NoError(t, err)
+	require.EqualValues(t, []uint32{30, 40}, SortedArrayStream.ToSlice(items))
+	require.NoError(t, StreamErr(items))
+
+	// modifications can't skip
+	arr = NewSortedArray(2, storage, WithSkipCorrupted())
+	var corrupted *ErrCorrupted
+	require.True(t, errors.As(arr.Add([]uint32{15}), &corrupted))
+	require.EqualValues(t, 0, corrupted.ChunkId)
+}
+
+func TestCorruptedChunksOnCursors(t *testing.T) {
+	blobs := NewInMemoryBlobStorage()
+	storage := NewBlobChunkStorage(blobs)
+	arr := NewSortedArray(2, storage, WithValues(1))
+	require.NoError(t, arr.Add([]uint32{10, 20, 30, 40}))
+	require.NoError(t, arr.Flush()) // chunks: (10,20), (30,40)
+	blob := blobs.blobs[chunkBlobKey(0)]
+	blob[len(blob)-1] ^= 1
+
+	// streams end early and keep the error
+	arr = NewSortedArray(2, storage, WithValues(1))
+	cursor, err := arr.ReverseCursor(0, 100)
+	require.NoError(t, err)
+	require.EqualValues(t, []uint32{40, 30}, SortedArrayStream.ToSlice[uint32](cursor))
+	require.ErrorAs(t, cursor.Err(), new(*ErrCorrupted))
+	require.NoError(t, cursor.Seek(40)) // seek starts over
+	require.NoError(t, cursor.Err())
+
+	pairs, err := arr.GetPairsInRange(0, 100)
+	require.NoError(t, err)
+	_, ok := pairs.Next()
+	require.False(t, ok)
+	require.ErrorAs(t, pairs.Err(), new(*ErrCorrupted))
+
+	other := NewSortedArray(2, NewInMemoryChunkStorage())
+	require.NoError(t, other.Add([]uint32{20, 40}))
+	items, err := other.Intersect(arr, 0, 100) // the damaged array is probed
+	require.NoError(t, err)
+	require.Empty(t, SortedArrayStream.ToSlice(items))
+	require.ErrorAs(t, StreamErr(items), new(*ErrCorrupted))
+	big := NewSortedArray(2, NewInMemoryChunkStorage())
+	require.NoError(t, big.Add(sequence(0, 100, 2)))
+	items, err = big.Intersect(arr, 0, 100) // the damaged array is streamed
+	require.NoError(t, err)
+	require.Empty(t, SortedArrayStream.ToSlice(items))
+	require.ErrorAs(t, StreamErr(items), new(*ErrCorrupted))
+
+	// or skip if asked
+	arr = NewSortedArray(2, storage, WithValues(1), WithSkipCorrupted())
+	cursor, err = arr.ReverseCursor(0, 100)
+	require.NoError(t, err)
+	require.EqualValues(t, []uint32{40, 30}, SortedArrayStream.ToSlice[uint32](cursor))
+	require.NoError(t, cursor.Err())
+	items, err = other.Intersect(arr, 0, 100)
+	require.NoError(t, err)
+	require.EqualValues(t, []uint32{40}, SortedArrayStream.ToSlice(items))
+	require.NoError(t, StreamErr(items))
+}
+
+func TestCorruptedMetaOnRead(t *testing.T) {
+	blobs := NewInMemoryBlobStorage()
+	storage := NewBlobChunkStorage(blobs)
+	arr := NewSortedArray(2, storage)
+	require.NoError(t, arr.Add([]uint32{10, 20, 30}))
+	require.NoError(t, arr.Flush())
+
+	blob := blobs.blobs[metaBlobKey]
+	blob[len(blob)-1] ^= 1
+
+	// every call reports the damage, the meta is not taken as loaded
+	arr = NewSortedArray(2, storage)
+	for i := 0; i < 2; i++ {
+		_, err := arr.GetInRange(0, 100)
+		require.ErrorAs(t, err, new(*ErrCorrupted))
+	}
+
+	// the meta is read again once it is repaired
+	blob[len(blob)-1] ^= 1
+	items, err := arr.GetInRange(0, 100)
+	require.NoError(t, err)
+	require.EqualValues(t, []uint32{10, 20, 30}, SortedArrayStream.ToSlice(items))
+}
+
+// countingStorage counts chunk reads
+type countingStorage struct {
+	ChunkStorage
+	chunkReads int
+}
+
+func (s *countingStorage) Read(chunkIds []uint32) (map[uint32]*Chunk, error) {
+	s.chunkReads += len(chunkIds)
+	return s.ChunkStorage.Read(chunkIds)
+}
+
+func TestContainsWithChunkFilters(t *testing.T) {
+	storage := &countingStorage{ChunkStorage: NewBlobChunkStorage(NewInMemoryBlobStorage())}
+	arr := NewSortedArray(100, storage, WithChunkFilters(10))
+	items := make([]uint32, 0, 1000)
+	for i := uint32(0); i < 1000; i++ {
+		items = append(items, i*10)
+	}
+	require.NoError(t, arr.Add(items))
+	exists, err := arr.Contains(20) // before flush loaded chunks are used
+	require.NoError(t, err)
+	require.True(t, exists)
+	require.NoError(t, arr.Flush())
+
+	arr = NewSortedArray(100, storage, WithChunkFilters(10))
+	storage.chunkReads = 0
+	for _, item := range items {
+		exists, err = arr.Contains(item)
+		require.NoError(t, err)
+		require.True(t, exists)
+	}
+	require.Equal(t, len(items), storage.chunkReads) // every hit loads a chunk
+
+	// misses inside chunk ranges are mostly answered by filters
+	storage.chunkReads = 0
+	for _, item := range items {
+		exists, err = arr.Contains(item + 5)
+		require.NoError(t, err)
+		require.False(t, exists)
+	}
+	require.Less(t, storage.chunkReads, len(items)/20)
+
+	// modifications without the option drop stale filters
+	arr = NewSortedArray(100, storage)
+	require.NoError(t, arr.Add([]uint32{25}))
+	require.NoError(t, arr.Flush())
+	arr = NewSortedArray(100, storage, WithChunkFilters(10))
+	exists, err = arr.Contains(25)
+	require.NoError(t, err)
+	require.True(t, exists)
+}
+
+// TestModelBased runs random sequences of operations against the array and a reference set
+// pending changes of a dropped instance are lost, so the reference is reverted to the last flushed state
+func TestModelBased(t *testing.T) {
+	storages := map[string]func() ChunkStorage{
+		"memory": func() ChunkStorage { return NewInMemoryChunkStorage() },
+		"blobs":  func() ChunkStorage { return NewBlobChunkStorage(NewInMemoryBlobStorage()) },
+		"pages":  func() ChunkStorage { return &BlobChunkStorage{NewInMemoryBlobStorage(), 4} },
+	}
+	for name, newStorage := range storages {
+		for _, chunkSize := range []uint32{1, 3, 16, 100} {
+			for seed := uint64(1); seed <= 5; seed++ {
+				t.Run(fmt.Sprintf("%s/size %d/seed %d", name, chunkSize, seed), func(t *testing.T) {
+					runModel(t, seed, chunkSize, newStorage(), WithChunkFilters(8))
+				})
+			}
+		}
+	}
+}
+
+func runModel(t *testing.T, seed uint64, chunkSize uint32, storage ChunkStorage, opts ...ArrayOption) {
+	rng := rand.New(rand.NewSource(seed))
+	arr := NewSortedArray(chunkSize, storage, opts...)
+	model, flushed := make(map[uint32]struct{}), make(map[uint32]struct{})
+	clone := func(src map[uint32]struct{}) map[uint32]struct{} {
+		dst := make(map[uint32]struct{}, len(src))
+		for item := range src {
+			dst[item] = struct{}{}
+		}
+		return dst
+	}
+	inRange := func(from, to uint32) []uint32 {
+		items := make([]uint32, 0)
+		for item := range model {
+			if item >= from && item <= to {
+				items = append(items, item)
+			}
+		}
+		sort.Slice(items, func(i, j int) bool { return items[i] < items[j] })
+		return items
+	}
+	// randomItems returns scattered items or a run of consecutive ones (to exercise all containers)
+	randomItems := func() []uint32 {
+		items := make([]uint32, 0)
+		if rng.Intn(3) == 0 {
+			start := uint32(rng.Intn(2000))
+			for i := rng.Intn(200); i >= 0; i-- {
+				items = append(items, start)
+				start++
+			}
+			return items
+		}
+		for i := rng.Intn(50); i >= 0; i-- {
+			items = append(items, uint32(rng.Intn(2000)))
+		}
+		return items
+	}
+
+	for step := 0; step < 300; step++ {
+		op := rng.Intn(7)
+		msg := fmt.Sprintf("seed %d, step %d, op %d", seed, step, op)
+		switch op {
+		case 0, 1: // add
+			items := randomItems()
+			require.NoError(t, arr.Add(items), msg)
+			for _, item := range items {
+				model[item] = struct{}{}
+			}
+		case 2: // delete, mostly existing items
+			items := randomItems()
+			if existing := inRange(0, 2000); len(existing) > 0 && rng.Intn(2) == 0 {
+				from := rng.Intn(len(existing))
+				items = existing[from : from+rng.Intn(len(existing)-from)]
+			}
+			require.NoError(t, arr.Delete(items), msg)
+			for _, item := range items {
+				delete(model, item)
+			}
+		case 3: // flush
+			require.NoError(t, arr.Flush(), msg)
+			flushed = clone(model)
+			problems, err := NewSortedArray(chunkSize, storage, opts...).Validate()
+			require.NoError(t, err, msg)
+			require.Empty(t, problems, msg)
+		case 4: // reopen from the storage, pending changes are lost
+			arr = NewSortedArray(chunkSize, storage, opts...)
+			model = clone(flushed)
+		case 5: // range query
+			from := uint32(rng.Intn(2000))
+			to := from + uint32(rng.Intn(500))
+			items, err := arr.GetInRange(from, to)
+			require.NoError(t, err, msg)
+			require.Equal(t, inRange(from, to), SortedArrayStream.ToSlice(items), msg)
+		case 6: // point lookups
+			for i := 0; i < 10; i++ {
+				item := uint32(rng.Intn(2000))
+				_, expected := model[item]
+				found, err := arr.Contains(item)
+				require.NoError(t, err, msg)
+				require.Equal(t, expected, found, msg+fmt.Sprintf(", item %d", item))
+			}
+		}
+	}
+	require.Equal(t, inRange(0, 1<<32-1), arr.ToSlice())
+}
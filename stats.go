@@ -0,0 +1,93 @@
+package sorted_array
+
+const fillHistogramBuckets = 10
+
+// Stats describes the chunks layout of an array, see SortedArray.Stats
+type Stats struct {
+	Chunks       int
+	Items        uint64
+	MinChunkSize uint32
+	MaxChunkSize uint32
+	AvgChunkSize float64
+	// FillHistogram counts chunks by their fill (size/maxChunkSize) in 10% steps, full chunks are in the last bucket
+	FillHistogram [fillHistogramBuckets]int
+
+	LoadedChunks int // chunks in memory
+	DirtyChunks  int // chunks pending flush
+
+	ChunkBytes map[uint32]int // serialized size by chunk id, nil if the storage can't report it
+	TotalBytes int
+}
+
+// ChunkSizeReporter is implemented by storages that can tell serialized sizes of chunks without reading them
+type ChunkSizeReporter interface {
+	// ChunkBytes returns sizes of all chunks of the array by chunk id
+	ChunkBytes() (map[uint32]int, error)
+}
+
+// Stats is computed from the meta, chunks are not read and meta pages are only read
+// if their stats are unknown (written by older versions or for another max chunk size),
+// so it is cheap enough for metrics endpoints
+func (a *SortedArray) Stats() (*Stats, error) {
+	err := a.initMeta()
+	if err != nil {
+		return nil, err
+	}
+	s := &Stats{
+		LoadedChunks: len(a.loadedChunks),
+		DirtyChunks:  len(a.dirtyChunks),
+	}
+	if a.meta.pages == nil {
+		s.add(newPageStats(a.meta.chunks, a.maxChunkSize))
+	}
+	for i, p := range a.meta.pages {
+		if !p.loaded && p.stats != nil && p.stats.chunkSize == a.maxChunkSize {
+			s.add(p.stats)
+		} else if !p.loaded {
+			err = a.meta.loadPages(i, i)
+			if err != nil {
+				return nil, err
+			}
+		}
+		s.add(newPageStats(a.meta.pageChunks(i), a.maxChunkSize)) // chunks in memory
+	}
+	if s.Chunks > 0 {
+		s.AvgChunkSize = float64(s.Items) / float64(s.Chunks)
+	}
+
+	storage := a.storage
+	for { // decorators hide the reporter
+		wrapper, ok := storage.(interface{ Unwrap() ChunkStorage })
+		if !ok {
+			break
+		}
+		storage = wrapper.Unwrap()
+	}
+	if reporter, ok := storage.(ChunkSizeReporter); ok {
+		s.ChunkBytes, err = reporter.ChunkBytes()
+		if err != nil {
+			return nil, err
+		}
+		for _, size := range s.ChunkBytes {
+			s.TotalBytes += size
+		}
+	}
+	return s, nil
+}
+
+func (s *Stats) add(ps *pageStats) {
+	if ps.chunks == 0 {
+		return
+	}
+	s.Chunks += int(ps.chunks)
+	s.Items += ps.items
+	if s.MinChunkSize == 0 || ps.minSize < s.MinChunkSize {
+		s.MinChunkSize = ps.minSize
+	}
+	if ps.maxSize > s.MaxChunkSize {
+		s.MaxChunkSize = ps.maxSize
+	}
+	for i, n := range ps.fill {
+		s.FillHistogram[i] += int(n)
+	}
+}
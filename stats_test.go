@@ -0,0 +1,100 @@
+package sorted_array
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	arr := NewSortedArray(10, NewInMemoryChunkStorage())
+	stats, err := arr.Stats()
+	require.NoError(t, err)
+	require.Equal(t, &Stats{}, stats)
+
+	require.NoError(t, arr.Add(sequence(0, 25, 1)))
+	stats, err = arr.Stats()
+	require.NoError(t, err)
+	require.Equal(t, 4, stats.Chunks)
+	require.EqualValues(t, 25, stats.Items)
+	require.EqualValues(t, 6, stats.MinChunkSize)
+	require.EqualValues(t, 7, stats.MaxChunkSize)
+	require.Equal(t, 6.25, stats.AvgChunkSize)
+	require.Equal(t, [10]int{6: 3, 7: 1}, stats.FillHistogram)
+	require.Equal(t, 4, stats.DirtyChunks)
+	require.Nil(t, stats.ChunkBytes) // the in-memory storage can't report sizes
+
+	require.NoError(t, arr.Flush())
+	stats, err = arr.Stats()
+	require.NoError(t, err)
+	require.Equal(t, 0, stats.LoadedChunks)
+	require.Equal(t, 0, stats.DirtyChunks)
+}
+
+func TestStatsDoesNotReadMetaPages(t *testing.T) {
+	blobs := &countingBlobStorage{BlobStorage: NewInMemoryBlobStorage()}
+	storage := NewBlobChunkStorage(blobs)
+	storage.metaPageSize = 2
+	arr := NewSortedArray(10, storage)
+	require.NoError(t, arr.Add(sequence(0, 250, 1)))
+	require.NoError(t, arr.Flush())
+	expected, err := arr.Stats()
+	require.NoError(t, err)
+	require.Equal(t, 32, expected.Chunks)
+
+	blobs.pageReads = 0
+	arr = NewSortedArray(10, storage)
+	stats, err := arr.Stats()
+	require.NoError(t, err)
+	require.Equal(t, expected, stats)
+	require.Zero(t, blobs.pageReads)
+
+	// pending changes are seen, only the changed page is read
+	require.NoError(t, arr.Add([]uint32{1000, 1001}))
+	stats, err = arr.Stats()
+	require.NoError(t, err)
+	require.Equal(t, 32, stats.Chunks)
+	require.EqualValues(t, 252, stats.Items)
+	require.Equal(t, 1, blobs.pageReads)
+
+	// the fill of another max chunk size is computed from pages
+	blobs.pageReads = 0
+	stats, err = NewSortedArray(20, storage).Stats()
+	require.NoError(t, err)
+	require.Greater(t, blobs.pageReads, 10)
+	chunks, err := NewSortedArray(20, storage).Chunks()
+	require.NoError(t, err)
+	fill := [10]int{}
+	for _, cm := range chunks {
+		fill[cm.size*10/20]++
+	}
+	require.Equal(t, fill, stats.FillHistogram)
+}
+
+func TestStatsChunkBytes(t *testing.T) {
+	db := MakeSqliteDb()
+	defer db.Close()
+	tx, err := db.Begin()
+	require.NoError(t, err)
+	defer tx.Rollback()
+
+	arr := NewSortedArray(10, NewSqliteTxSortedArrayStorage(tx, []byte("term")))
+	require.NoError(t, arr.Add(sequence(0, 25, 1)))
+	require.NoError(t, arr.Flush())
+
+	// arrays with similar keys are not counted
+	for _, key := range []string{"Term", "term_x", "ter"} {
+		other := NewSortedArray(10, NewSqliteTxSortedArrayStorage(tx, []byte(key)))
+		require.NoError(t, other.Add(sequence(0, 25, 1)))
+		require.NoError(t, other.Flush())
+	}
+
+	stats, err := arr.Stats()
+	require.NoError(t, err)
+	require.Len(t, stats.ChunkBytes, stats.Chunks)
+	total := 0
+	for _, size := range stats.ChunkBytes {
+		require.Greater(t, size, frameHeaderSize)
+		total += size
+	}
+	require.Equal(t, total, stats.TotalBytes)
+}
@@ -0,0 +1,334 @@
+// Package storagetest is a conformance suite for sorted_array.ChunkStorage implementations.
+//
+// A storage is expected to:
+//   - omit missing ids from Read results (missing chunks are not an error)
+//   - replace a chunk saved again under the same id
+//   - forget removed chunks, removing missing ids is not an error
+//   - return an empty meta (not an error) until a meta is saved
+//   - keep all chunk descriptions and the next id of a saved meta
+//   - accept empty id lists and empty chunk maps
+//   - keep what was saved, later changes of saved or read instances are not visible until saved again
+//
+// A storage on top of a BlobStorage is also expected to (see RunBlobs):
+//   - return errors of the blobs below from every method
+//   - report damaged blobs as *sorted_array.ErrCorrupted (with the chunk id for chunks)
+package storagetest
+
+import (
+	"errors"
+	sorted_array "github.com/lezhnev74/SortedArray"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+// Factory returns a new empty storage, storages returned by one factory must not share data
+type Factory func(t *testing.T) sorted_array.ChunkStorage
+
+// Run checks the storage semantics against storages made by the factory
+func Run(t *testing.T, factory Factory) {
+	t.Run("ReadMissing", func(t *testing.T) { testReadMissing(t, factory(t)) })
+	t.Run("SaveAndRead", func(t *testing.T) { testSaveAndRead(t, factory(t)) })
+	t.Run("Overwrite", func(t *testing.T) { testOverwrite(t, factory(t)) })
+	t.Run("Remove", func(t *testing.T) { testRemove(t, factory(t)) })
+	t.Run("RemoveMissing", func(t *testing.T) { testRemoveMissing(t, factory(t)) })
+	t.Run("EmptyInput", func(t *testing.T) { testEmptyInput(t, factory(t)) })
+	t.Run("EmptyMeta", func(t *testing.T) { testEmptyMeta(t, factory(t)) })
+	t.Run("MetaRoundTrip", func(t *testing.T) { testMetaRoundTrip(t, factory(t)) })
+	t.Run("Snapshot", func(t *testing.T) { testSnapshot(t, factory(t)) })
+	t.Run("Isolation", func(t *testing.T) { testIsolation(t, factory(t), factory(t)) })
+	t.Run("Array", func(t *testing.T) { testArray(t, factory(t)) })
+}
+
+func testReadMissing(t *testing.T, s sorted_array.ChunkStorage) {
+	chunks, err := s.Read([]uint32{1, 2})
+	require.NoError(t, err)
+	require.Empty(t, chunks)
+}
+
+func testSaveAndRead(t *testing.T, s sorted_array.ChunkStorage) {
+	err := s.Save(map[uint32]*sorted_array.Chunk{
+		1: sorted_array.NewChunk([]uint32{1, 2, 3}),
+		2: sorted_array.NewChunk([]uint32{10, 20}),
+	})
+	require.NoError(t, err)
+
+	chunks, err := s.Read([]uint32{1, 2, 3})
+	require.NoError(t, err)
+	requireChunks(t, map[uint32][]uint32{1: {1, 2, 3}, 2: {10, 20}}, chunks)
+
+	chunks, err = s.Read([]uint32{2})
+	require.NoError(t, err)
+	requireChunks(t, map[uint32][]uint32{2: {10, 20}}, chunks)
+}
+
+func testOverwrite(t *testing.T, s sorted_array.ChunkStorage) {
+	err := s.Save(map[uint32]*sorted_array.Chunk{1: sorted_array.NewChunk([]uint32{1, 2, 3})})
+	require.NoError(t, err)
+	err = s.Save(map[uint32]*sorted_array.Chunk{1: sorted_array.NewChunk([]uint32{4})})
+	require.NoError(t, err)
+
+	chunks, err := s.Read([]uint32{1})
+	require.NoError(t, err)
+	requireChunks(t, map[uint32][]uint32{1: {4}}, chunks)
+}
+
+func testRemove(t *testing.T, s sorted_array.ChunkStorage) {
+	err := s.Save(map[uint32]*sorted_array.Chunk{
+		1: sorted_array.NewChunk([]uint32{1}),
+		2: sorted_array.NewChunk([]uint32{2}),
+	})
+	require.NoError(t, err)
+
+	err = s.Remove([]uint32{1, 3}) // 3 is missing
+	require.NoError(t, err)
+	chunks, err := s.Read([]uint32{1, 2})
+	require.NoError(t, err)
+	requireChunks(t, map[uint32][]uint32{2: {2}}, chunks)
+
+	err = s.Remove([]uint32{1}) // removed twice
+	require.NoError(t, err)
+
+	// a removed id can be saved again
+	err = s.Save(map[uint32]*sorted_array.Chunk{1: sorted_array.NewChunk([]uint32{5})})
+	require.NoError(t, err)
+	chunks, err = s.Read([]uint32{1})
+	require.NoError(t, err)
+	requireChunks(t, map[uint32][]uint32{1: {5}}, chunks)
+}
+
+func testRemoveMissing(t *testing.T, s sorted_array.ChunkStorage) {
+	require.NoError(t, s.Remove([]uint32{1, 2})) // nothing was saved
+	meta, err := s.ReadMeta()
+	require.NoError(t, err)
+	require.EqualValues(t, 0, meta.TakeNextId())
+}
+
+func testEmptyInput(t *testing.T, s sorted_array.ChunkStorage) {
+	chunks, err := s.Read(nil)
+	require.NoError(t, err)
+	require.Empty(t, chunks)
+	require.NoError(t, s.Save(map[uint32]*sorted_array.Chunk{}))
+	require.NoError(t, s.Remove(nil))
+}
+
+func testEmptyMeta(t *testing.T, s sorted_array.ChunkStorage) {
+	meta, err := s.ReadMeta()
+	require.NoError(t, err)
+	require.NotNil(t, meta)
+	require.Empty(t, meta.FindRelevantForReadRange(0, 1<<32-1))
+	require.EqualValues(t, 0, meta.TakeNextId())
+}
+
+func testMetaRoundTrip(t *testing.T, s sorted_array.ChunkStorage) {
+	meta, err := s.ReadMeta()
+	require.NoError(t, err)
+	expected := make([]*sorted_array.ChunkMeta, 0)
+	for i := uint32(0); i < 3; i++ {
+		expected = append(expected, sorted_array.NewChunkMeta(meta.TakeNextId(), i*10, i*10+5, 2))
+	}
+	meta.Add(expected)
+	require.NoError(t, s.SaveMeta(meta))
+
+	// the meta may be paged, so all descriptions are read through an array
+	chunks, err := sorted_array.NewSortedArray(1000, s).Chunks()
+	require.NoError(t, err)
+	require.Len(t, chunks, len(expected))
+	for i, cm := range chunks {
+		require.Equal(t, expected[i].Id(), cm.Id())
+		require.Equal(t, expected[i].Min(), cm.Min())
+		require.Equal(t, expected[i].Max(), cm.Max())
+		require.Equal(t, expected[i].Size(), cm.Size())
+	}
+
+	meta, err = s.ReadMeta()
+	require.NoError(t, err)
+	require.EqualValues(t, 3, meta.TakeNextId())
+}
+
+func testSnapshot(t *testing.T, s sorted_array.ChunkStorage) {
+	chunk := sorted_array.NewChunk([]uint32{1})
+	require.NoError(t, s.Save(map[uint32]*sorted_array.Chunk{1: chunk}))
+	chunk.Add([]uint32{2})
+	chunks, err := s.Read([]uint32{1})
+	require.NoError(t, err)
+	requireChunks(t, map[uint32][]uint32{1: {1}}, chunks)
+	chunks[1].Add([]uint32{3})
+	chunks, err = s.Read([]uint32{1})
+	require.NoError(t, err)
+	requireChunks(t, map[uint32][]uint32{1: {1}}, chunks)
+
+	meta := sorted_array.NewMeta()
+	meta.Add([]*sorted_array.ChunkMeta{sorted_array.NewChunkMeta(meta.TakeNextId(), 1, 1, 1)})
+	require.NoError(t, s.SaveMeta(meta))
+	meta.Add([]*sorted_array.ChunkMeta{sorted_array.NewChunkMeta(meta.TakeNextId(), 5, 5, 1)})
+	meta, err = s.ReadMeta()
+	require.NoError(t, err)
+	require.EqualValues(t, 1, meta.TakeNextId())
+	chunkMetas, err := sorted_array.NewSortedArray(1000, s).Chunks()
+	require.NoError(t, err)
+	require.Len(t, chunkMetas, 1)
+}
+
+func testIsolation(t *testing.T, s1, s2 sorted_array.ChunkStorage) {
+	err := s1.Save(map[uint32]*sorted_array.Chunk{1: sorted_array.NewChunk([]uint32{1})})
+	require.NoError(t, err)
+	meta := sorted_array.NewMeta()
+	meta.Add([]*sorted_array.ChunkMeta{sorted_array.NewChunkMeta(meta.TakeNextId(), 1, 1, 1)})
+	require.NoError(t, s1.SaveMeta(meta))
+
+	chunks, err := s2.Read([]uint32{1})
+	require.NoError(t, err)
+	require.Empty(t, chunks)
+	meta, err = s2.ReadMeta()
+	require.NoError(t, err)
+	require.EqualValues(t, 0, meta.TakeNextId())
+}
+
+// testArray runs an array on top of the storage and reopens it after every flush
+func testArray(t *testing.T, s sorted_array.ChunkStorage) {
+	arr := sorted_array.NewSortedArray(2, s)
+	require.NoError(t, arr.Add([]uint32{10, 20, 30, 40, 50}))
+	require.NoError(t, arr.Delete([]uint32{10, 30}))
+	require.NoError(t, arr.Flush())
+
+	arr = sorted_array.NewSortedArray(2, s)
+	require.EqualValues(t, []uint32{20, 40, 50}, arr.ToSlice())
+	require.NoError(t, arr.Delete([]uint32{20, 40, 50}))
+	require.NoError(t, arr.Flush())
+
+	arr = sorted_array.NewSortedArray(2, s)
+	require.Empty(t, arr.ToSlice())
+}
+
+// BlobFactory returns a new storage on top of the blobs
+type BlobFactory func(t *testing.T, blobs sorted_array.BlobStorage) sorted_array.ChunkStorage
+
+// RunBlobs runs Run against storages on top of in-memory blobs and checks how failing and damaged blobs are reported
+func RunBlobs(t *testing.T, factory BlobFactory) {
+	Run(t, func(t *testing.T) sorted_array.ChunkStorage { return factory(t, newMemoryBlobs()) })
+	t.Run("FailingBlobs", func(t *testing.T) { testFailingBlobs(t, factory) })
+	t.Run("CorruptedChunk", func(t *testing.T) { testCorruptedChunk(t, factory) })
+	t.Run("CorruptedMeta", func(t *testing.T) { testCorruptedMeta(t, factory) })
+}
+
+func testFailingBlobs(t *testing.T, factory BlobFactory) {
+	blobs := newMemoryBlobs()
+	s := factory(t, blobs)
+	arr := sorted_array.NewSortedArray(2, s)
+	require.NoError(t, arr.Add([]uint32{1, 2, 3}))
+	require.NoError(t, arr.Flush())
+
+	blobs.err = errors.New("disk is gone")
+	_, err := s.Read([]uint32{0})
+	require.ErrorIs(t, err, blobs.err)
+	require.ErrorIs(t, s.Save(map[uint32]*sorted_array.Chunk{5: sorted_array.NewChunk([]uint32{5})}), blobs.err)
+	require.ErrorIs(t, s.Remove([]uint32{0}), blobs.err)
+	_, err = s.ReadMeta()
+	require.ErrorIs(t, err, blobs.err)
+	require.ErrorIs(t, s.SaveMeta(sorted_array.NewMeta()), blobs.err)
+	_, err = sorted_array.NewSortedArray(2, s).Chunks()
+	require.ErrorIs(t, err, blobs.err)
+
+	// nothing is lost
+	blobs.err = nil
+	require.EqualValues(t, []uint32{1, 2, 3}, sorted_array.NewSortedArray(2, s).ToSlice())
+}
+
+func testCorruptedChunk(t *testing.T, factory BlobFactory) {
+	blobs := newMemoryBlobs()
+	s := factory(t, blobs)
+	require.NoError(t, s.Save(map[uint32]*sorted_array.Chunk{
+		1: sorted_array.NewChunk([]uint32{1}),
+		2: sorted_array.NewChunk([]uint32{2}),
+	}))
+	blobs.saved = nil
+	require.NoError(t, s.Save(map[uint32]*sorted_array.Chunk{7: sorted_array.NewChunk([]uint32{1, 2, 3})}))
+	blobs.damage()
+
+	_, err := s.Read([]uint32{1, 7})
+	var corrupted *sorted_array.ErrCorrupted
+	require.ErrorAs(t, err, &corrupted)
+	require.False(t, corrupted.Meta)
+	require.EqualValues(t, 7, corrupted.ChunkId)
+
+	chunks, err := s.Read([]uint32{1, 2}) // other chunks are fine
+	require.NoError(t, err)
+	requireChunks(t, map[uint32][]uint32{1: {1}, 2: {2}}, chunks)
+}
+
+func testCorruptedMeta(t *testing.T, factory BlobFactory) {
+	blobs := newMemoryBlobs()
+	s := factory(t, blobs)
+	meta, err := s.ReadMeta()
+	require.NoError(t, err)
+	meta.Add([]*sorted_array.ChunkMeta{sorted_array.NewChunkMeta(meta.TakeNextId(), 1, 5, 2)})
+	blobs.saved = nil
+	require.NoError(t, s.SaveMeta(meta))
+	blobs.damage()
+
+	_, err = sorted_array.NewSortedArray(2, s).Chunks() // the meta may be paged
+	var corrupted *sorted_array.ErrCorrupted
+	require.ErrorAs(t, err, &corrupted)
+	require.True(t, corrupted.Meta)
+}
+
+// memoryBlobs keeps blobs in a map, it can fail every call and damage the last saved blobs
+type memoryBlobs struct {
+	blobs map[string][]byte
+	saved []string // keys saved since the last reset
+	err   error    // returned by every call if set
+}
+
+func newMemoryBlobs() *memoryBlobs { return &memoryBlobs{blobs: make(map[string][]byte)} }
+
+func (b *memoryBlobs) ReadBlobs(keys []string) (map[string][]byte, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	ret := make(map[string][]byte, len(keys))
+	for _, key := range keys {
+		if blob, ok := b.blobs[key]; ok {
+			ret[key] = append([]byte(nil), blob...)
+		}
+	}
+	return ret, nil
+}
+
+func (b *memoryBlobs) SaveBlobs(blobs map[string][]byte) error {
+	if b.err != nil {
+		return b.err
+	}
+	for key, blob := range blobs {
+		b.blobs[key] = append([]byte(nil), blob...)
+		b.saved = append(b.saved, key)
+	}
+	return nil
+}
+
+func (b *memoryBlobs) RemoveBlobs(keys []string) error {
+	if b.err != nil {
+		return b.err
+	}
+	for _, key := range keys {
+		delete(b.blobs, key)
+	}
+	return nil
+}
+
+// damage flips the last byte of saved blobs
+func (b *memoryBlobs) damage() {
+	for _, key := range b.saved {
+		if blob := b.blobs[key]; len(blob) > 0 {
+			blob[len(blob)-1] ^= 0xff
+		}
+	}
+}
+
+func requireChunks(t *testing.T, expected map[uint32][]uint32, chunks map[uint32]*sorted_array.Chunk) {
+	require.Len(t, chunks, len(expected))
+	for id, items := range expected {
+		require.Contains(t, chunks, id)
+		require.NotNil(t, chunks[id])
+		require.EqualValues(t, items, chunks[id].ToSlice())
+	}
+}
@@ -0,0 +1,48 @@
+package storagetest
+
+import (
+	"database/sql"
+	"fmt"
+	sorted_array "github.com/lezhnev74/SortedArray"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestInMemoryChunkStorage(t *testing.T) {
+	Run(t, func(t *testing.T) sorted_array.ChunkStorage { return sorted_array.NewInMemoryChunkStorage() })
+}
+
+func TestBlobChunkStorage(t *testing.T) {
+	RunBlobs(t, func(t *testing.T, blobs sorted_array.BlobStorage) sorted_array.ChunkStorage {
+		return sorted_array.NewBlobChunkStorage(blobs)
+	})
+}
+
+func TestEncryptedChunkStorage(t *testing.T) {
+	RunBlobs(t, func(t *testing.T, blobs sorted_array.BlobStorage) sorted_array.ChunkStorage {
+		key := sorted_array.EncryptionKey{Id: 1, Key: []byte("0123456789abcdef")}
+		s, err := sorted_array.NewEncryptedChunkStorage(blobs, key)
+		require.NoError(t, err)
+		return s
+	})
+}
+
+func TestSqliteChunkStorage(t *testing.T) {
+	db, err := sql.Open("sqlite3", "file::memory:")
+	require.NoError(t, err)
+	db.SetMaxOpenConns(1) // every connection would get its own in-memory db
+	defer db.Close()
+	_, err = db.Exec("CREATE TABLE sorted_array_chunks(key text PRIMARY KEY, chunk BLOB)")
+	require.NoError(t, err)
+
+	tx, err := db.Begin()
+	require.NoError(t, err)
+	defer tx.Rollback()
+
+	arrays := 0 // storages share the table, but not keys
+	Run(t, func(t *testing.T) sorted_array.ChunkStorage {
+		arrays++
+		return sorted_array.NewSqliteTxSortedArrayStorage(tx, []byte(fmt.Sprintf("array%d", arrays)))
+	})
+}